@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"perot.me/splitfs/split"
+)
+
+// currentAccessLogLevel is the verbosity set by the --access_log_level flag.
+// At the error level, only failed operations are logged. At the info level,
+// Open and Release operations are logged too. At the debug level, every
+// operation is logged.
+var currentAccessLogLevel = levelError
+
+// accessLogEntry is a line of the access log.
+type accessLogEntry struct {
+	Mountpoint string `json:"mountpoint"`
+	*split.AccessLogEntry
+}
+
+// accessLog writes FUSE operations as JSON lines.
+type accessLog struct {
+	path string
+
+	// mu protects file and encoder.
+	mu      sync.Mutex
+	file    io.WriteCloser
+	encoder *json.Encoder
+}
+
+// openAccessLog opens the access log at the given path, appending to it.
+// The path "-" means standard error.
+func openAccessLog(path string) (*accessLog, error) {
+	a := &accessLog{path: path}
+	if err := a.reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reopen closes and reopens the log file, so that it can be rotated.
+func (a *accessLog) reopen() error {
+	var file io.WriteCloser = os.Stderr
+	if a.path != "-" {
+		var err error
+		file, err = os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil && a.file != os.Stderr {
+		a.file.Close()
+	}
+	a.file = file
+	a.encoder = json.NewEncoder(file)
+	return nil
+}
+
+// shouldLog reports whether the entry is verbose enough for the current level.
+func shouldLog(entry *split.AccessLogEntry) bool {
+	switch level := currentAccessLogLevel.get(); {
+	case level >= levelDebug || entry.Failed():
+		return true
+	case level >= levelInfo:
+		return entry.Op == "Open" || entry.Op == "Release"
+	}
+	return false
+}
+
+// forMount returns a function that logs the entries of the given mount.
+func (a *accessLog) forMount(mountpoint string) func(*split.AccessLogEntry) {
+	return func(entry *split.AccessLogEntry) {
+		if !shouldLog(entry) {
+			return
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err := a.encoder.Encode(&accessLogEntry{mountpoint, entry}); err != nil {
+			log.Printf("Cannot write to access log: %v", err)
+		}
+	}
+}
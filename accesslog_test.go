@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"perot.me/splitfs/split"
+)
+
+// readAccessLog returns the lines of the access log at the given path,
+// parsed as JSON objects.
+func readAccessLog(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("invalid access log line %q: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	defer func(level logLevel) { currentAccessLogLevel = level }(currentAccessLogLevel)
+	currentAccessLogLevel = levelInfo
+	path := filepath.Join(t.TempDir(), "access.log")
+	a, err := openAccessLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logEntry := a.forMount("/mnt")
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	chunk := int64(2)
+	logEntry(&split.AccessLogEntry{Time: start, Op: "Open", Path: "big.bin/chunk", Chunk: &chunk, LatencyMS: 0.5})
+	// Successful operations other than Open and Release are only logged at
+	// the debug level.
+	logEntry(&split.AccessLogEntry{Time: start, Op: "Read", Path: "big.bin/chunk", Chunk: &chunk, LatencyMS: 0.25})
+	logEntry(&split.AccessLogEntry{Time: start, Op: "Lookup", Path: "missing", Errno: "ENOENT", Reason: "no such file or directory", LatencyMS: 1})
+	want := []map[string]interface{}{
+		{"mountpoint": "/mnt", "time": "2020-01-02T03:04:05Z", "op": "Open", "path": "big.bin/chunk", "chunk": 2.0, "latency_ms": 0.5},
+		{"mountpoint": "/mnt", "time": "2020-01-02T03:04:05Z", "op": "Lookup", "path": "missing", "errno": "ENOENT", "reason": "no such file or directory", "latency_ms": 1.0},
+	}
+	if got := readAccessLog(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("access log:\n%v\nwant:\n%v", got, want)
+	}
+
+	// After the log is rotated and reopened, entries go to the new file.
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	logEntry(&split.AccessLogEntry{Time: start, Op: "Release", Path: "big.bin/chunk", LatencyMS: 0.125})
+	if err := a.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	currentAccessLogLevel = levelDebug
+	logEntry(&split.AccessLogEntry{Time: start, Op: "Read", Path: "other", LatencyMS: 2})
+	if got := readAccessLog(t, rotated); len(got) != 3 || got[2]["op"] != "Release" {
+		t.Errorf("rotated access log has %v, want the entries before the reopen", got)
+	}
+	wantNew := []map[string]interface{}{
+		{"mountpoint": "/mnt", "time": "2020-01-02T03:04:05Z", "op": "Read", "path": "other", "latency_ms": 2.0},
+	}
+	if got := readAccessLog(t, path); !reflect.DeepEqual(got, wantNew) {
+		t.Errorf("reopened access log:\n%v\nwant:\n%v", got, wantNew)
+	}
+	if err := a.file.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"perot.me/splitfs/fusefs"
+	"perot.me/splitfs/hashes"
+	"perot.me/splitfs/split"
+)
+
+// mountOptions holds the settings of a single mount.
+// They can come from command-line flags, from a configuration file, or from both.
+type mountOptions struct {
+	chunkSize                   string
+	excludeRegexp               string
+	includeRegexp               string
+	filenameHash                string
+	filenameHashKeyFile         string
+	chunkNameKey                string
+	filenameIncludesTotalChunks bool
+	filenameIncludesMtime       bool
+	chunkNameTemplate           string
+	chunkFanOut                 int64
+	hideSpecialFiles            bool
+	symlinks                    string
+	dedupHardLinks              bool
+	nfsExport                   bool
+	allowOther                  bool
+	defaultPermissions          bool
+	readOnly                    bool
+	attrCacheTTL                time.Duration
+	controlDir                  bool
+}
+
+// register defines one flag per mount option in the given flag set.
+// This is the single place where mount options are declared; configuration
+// files refer to mount options by the name of their flag.
+func (o *mountOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.chunkSize, "chunk_size", "32MiB", "Chunk size. Available units: B, KiB, MiB, GiB, TiB.")
+	flags.StringVar(&o.excludeRegexp, "exclude_regexp", "", "If specified, files with paths matching this regex (rooted at the source directory) will be reflected as plain, non-split files in the mountpoint. The regex is not full-match; use ^ and $ to make it so.")
+	flags.StringVar(&o.includeRegexp, "include_regexp", "", "If specified, files with paths matching this regex are split even if they match exclude_regexp.")
+	flags.StringVar(&o.filenameHash, "filename_hash", "sha256-b32", fmt.Sprintf("Algorithm for filename hashes in chunked filenames. Options: %v, or keyed with filename_hash_key_file: %v", hashes.HashNames, hashes.KeyedHashNames))
+	flags.StringVar(&o.filenameHashKeyFile, "filename_hash_key_file", "", fmt.Sprintf("File containing the secret key for keyed filename hashes. The whole file is the key, and must be at least %d bytes long, and at most %d bytes long for BLAKE2b or %d bytes long for BLAKE2s.", hashes.MinKeySize, blake2b.Size, blake2s.Size))
+	flags.StringVar(&o.chunkNameKey, "chunk_name_key", "path", fmt.Sprintf("What the hash in chunk filenames is computed over: the path of the file, or its identity in the source filesystem, which survives renames: the user.splitfs.id extended attribute of the file if set (splitfs never sets it), or else its inode number and birth time, or its inode number and filesystem ID. No database of identities is kept. Options: %v", split.ChunkNameKeyNames))
+	flags.BoolVar(&o.filenameIncludesTotalChunks, "filename_includes_total_chunks", true, "Whether or not chunk filenames will contain the total number of chunks of the overall file.")
+	flags.BoolVar(&o.filenameIncludesMtime, "filename_includes_mtime", false, "Controls whether or not chunk filenames will contain the mtime of the overall file.")
+	flags.StringVar(&o.chunkNameTemplate, "chunk_name_template", "", fmt.Sprintf("If specified, template for chunk filenames, overriding filename_includes_total_chunks and filename_includes_mtime. Placeholders: %v, written as {name}, or {name:width} to zero-pad numbers.", split.ChunkNameFields))
+	flags.Int64Var(&o.chunkFanOut, "chunk_fanout", 0, "If nonzero, nest the chunks of files with more chunks than this into subdirectories named after the range of chunks they hold, so that no directory has more entries than this.")
+	flags.BoolVar(&o.hideSpecialFiles, "hide_special_files", false, "Whether to hide FIFOs, sockets and device nodes, rather than mirroring them.")
+	flags.StringVar(&o.symlinks, "symlinks", "preserve", fmt.Sprintf("How to present symlinks: keep their target, rewrite absolute targets inside the source to relative ones, follow them, or hide them. Options: %v", split.SymlinkPolicyNames))
+	flags.BoolVar(&o.dedupHardLinks, "dedup_hard_links", false, "Whether to present files with several hard links only once. Other hard links become symlinks to the first path, and are listed in a '.splitfs-hardlinks.json' file at the root of the mountpoint.")
+	flags.BoolVar(&o.nfsExport, "nfs_export", false, "Whether to support re-exporting the mountpoint over NFS, with file handles that stay valid across cache evictions and remounts.")
+	flags.DurationVar(&o.attrCacheTTL, "attr_cache_ttl", time.Minute, "How long the kernel may cache file attributes.")
+	flags.BoolVar(&o.controlDir, "control_dir", false, "Whether to expose a hidden '.splitfs' directory at the root of the mountpoint, with statistics and command files.")
+	flags.BoolVar(&o.allowOther, "allow_other", false, "Allow users other than the one running splitfs to access the mountpoint. Requires 'user_allow_other' in /etc/fuse.conf when not running as root.")
+	flags.BoolVar(&o.defaultPermissions, "default_permissions", false, "Let the kernel enforce permission checks based on file modes.")
+	flags.BoolVar(&o.readOnly, "ro", false, "Mount the filesystem as read-only at the kernel level. The filesystem never allows writes regardless.")
+}
+
+// mountOptionNames returns the names of all mount option flags.
+func mountOptionNames() map[string]bool {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	(&mountOptions{}).register(flags)
+	names := make(map[string]bool)
+	flags.VisitAll(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+	return names
+}
+
+// values returns the options as they would appear in a configuration file.
+func (o *mountOptions) values() optionValues {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	copied := &mountOptions{}
+	copied.register(flags)
+	*copied = *o
+	values := make(optionValues)
+	flags.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// splitOptions converts mount options into a chunk size and a list of split.Option.
+func (o *mountOptions) splitOptions() (int64, []split.Option, error) {
+	chunkSize, err := parseChunkSize(o.chunkSize)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid chunk size %q: %v", o.chunkSize, err)
+	}
+	hashFunc, err := o.hashFunc()
+	if err != nil {
+		return 0, nil, err
+	}
+	chunkNameKey, err := split.ParseChunkNameKey(o.chunkNameKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if o.filenameHash == hashes.EncryptedName && chunkNameKey != split.ChunkNamesByPath {
+		return 0, nil, fmt.Errorf("hash function %q encrypts paths, so chunk_name_key must be %q", o.filenameHash, split.ChunkNamesByPath)
+	}
+	if o.filenameHash == hashes.EncryptedName && !strings.Contains(o.template(), "{hash}") {
+		return 0, nil, fmt.Errorf("hash function %q encrypts paths, so chunk_name_template must contain {hash}", o.filenameHash)
+	}
+	symlinks, err := split.ParseSymlinkPolicy(o.symlinks)
+	if err != nil {
+		return 0, nil, err
+	}
+	var options []split.Option
+	if o.excludeRegexp != "" {
+		options = append(options, split.ExcludeRegexp(o.excludeRegexp))
+	}
+	if o.includeRegexp != "" {
+		options = append(options, split.IncludeRegexp(o.includeRegexp))
+	}
+	options = append(options, split.FilenameHashFunc(hashFunc))
+	options = append(options, split.ChunkNamesKeyedOn(chunkNameKey))
+	options = append(options, split.FilenameIncludesTotalChunks(o.filenameIncludesTotalChunks))
+	options = append(options, split.FilenameIncludesMtime(o.filenameIncludesMtime))
+	if o.chunkNameTemplate != "" {
+		options = append(options, split.ChunkNameTemplate(o.chunkNameTemplate))
+	}
+	options = append(options, split.ChunkFanOut(o.chunkFanOut))
+	options = append(options, split.HideSpecialFiles(o.hideSpecialFiles))
+	options = append(options, split.Symlinks(symlinks))
+	options = append(options, split.DedupHardLinks(o.dedupHardLinks))
+	options = append(options, split.NFSExport(o.nfsExport))
+	options = append(options, split.AttrCacheTTL(o.attrCacheTTL))
+	return chunkSize, options, nil
+}
+
+// template returns the chunk name template in effect.
+func (o *mountOptions) template() string {
+	if o.chunkNameTemplate != "" {
+		return o.chunkNameTemplate
+	}
+	return split.DefaultChunkNameTemplate(o.filenameIncludesTotalChunks, o.filenameIncludesMtime)
+}
+
+// filenameHashKey reads the key of the filename hash function.
+func (o *mountOptions) filenameHashKey() ([]byte, error) {
+	if o.filenameHashKeyFile == "" {
+		return nil, fmt.Errorf("hash function %q requires filename_hash_key_file", o.filenameHash)
+	}
+	key, err := ioutil.ReadFile(o.filenameHashKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read filename hash key: %v", err)
+	}
+	return key, nil
+}
+
+// hashFunc returns the filename hash function, reading its key if it is keyed.
+func (o *mountOptions) hashFunc() (hashes.HashFunc, error) {
+	if !hashes.IsKeyed(o.filenameHash) {
+		if o.filenameHashKeyFile != "" {
+			return nil, fmt.Errorf("hash function %q does not use a key; use one of %v", o.filenameHash, hashes.KeyedHashNames)
+		}
+		hashFunc := hashes.GetHashFunc(o.filenameHash)
+		if hashFunc == nil {
+			return nil, fmt.Errorf("invalid hash function %q; must use one of %v or %v", o.filenameHash, hashes.HashNames, hashes.KeyedHashNames)
+		}
+		return hashFunc, nil
+	}
+	key, err := o.filenameHashKey()
+	if err != nil {
+		return nil, err
+	}
+	hashFunc, err := hashes.GetKeyedHashFunc(o.filenameHash, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename hash key in %q: %v", o.filenameHashKeyFile, err)
+	}
+	return hashFunc, nil
+}
+
+// fuseMountOptions returns the mount options to pass to fuse.Mount.
+func (o *mountOptions) fuseMountOptions(chunkSize int64, source string) ([]fuse.MountOption, error) {
+	options := []fuse.MountOption{
+		fuse.FSName("splitfs"),
+		fuse.LocalVolume(),
+		fuse.VolumeName(fmt.Sprintf("splitfs %d %s", chunkSize, filepath.Base(source))),
+	}
+	if o.allowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if o.defaultPermissions {
+		options = append(options, fuse.DefaultPermissions())
+	}
+	if o.readOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	if o.nfsExport {
+		exportSupport, err := fusefs.ExportSupport()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, exportSupport)
+	}
+	return options, nil
+}
+
+// sameFuseMountOptions reports whether both options result in the same
+// options being passed to fuse.Mount.
+func (o *mountOptions) sameFuseMountOptions(other *mountOptions) bool {
+	return o.allowOther == other.allowOther && o.defaultPermissions == other.defaultPermissions && o.readOnly == other.readOnly && o.nfsExport == other.nfsExport
+}
+
+// optionValues maps flag names to their values in a configuration file.
+// Values may be JSON strings, numbers or booleans.
+type optionValues map[string]interface{}
+
+// configMount is a single mount definition in a configuration file.
+type configMount struct {
+	Source     string       `json:"source"`
+	Mountpoint string       `json:"mountpoint"`
+	Options    optionValues `json:"options"`
+}
+
+// configFile is the structure of the file passed to --config.
+//
+// Example:
+//
+//	{
+//	  "options": {"chunk_size": "32MiB", "pprof_host_port": "localhost:6060"},
+//	  "mounts": [
+//	    {"source": "/data", "mountpoint": "/mnt/data"},
+//	    {"source": "/media", "mountpoint": "/mnt/media", "options": {"chunk_size": "1GiB"}}
+//	  ]
+//	}
+//
+// Top-level options apply to every mount and may also set global flags.
+// Per-mount options override top-level ones. Flags given on the command line
+// override both.
+type configFile struct {
+	Options optionValues  `json:"options"`
+	Mounts  []configMount `json:"mounts"`
+}
+
+// readConfigFile parses the configuration file at the given path.
+func readConfigFile(path string) (*configFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	config := &configFile{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %v", path, err)
+	}
+	return config, nil
+}
+
+// apply sets the given flags to the values in v, except for those in skip.
+// Flags are applied in name order so that errors are deterministic.
+func (v optionValues) apply(flags *flag.FlagSet, skip map[string]bool) error {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if skip[name] {
+			continue
+		}
+		if err := flags.Set(name, fmt.Sprint(v[name])); err != nil {
+			return fmt.Errorf("invalid value %v for option %q: %v", v[name], name, err)
+		}
+	}
+	return nil
+}
+
+// mountDefinition is a fully-resolved mount to serve.
+type mountDefinition struct {
+	source     string
+	mountpoint string
+	// optionsMu protects options, which are replaced when a reload changes
+	// the settings of the mount.
+	optionsMu sync.Mutex
+	options   *mountOptions
+}
+
+// resolveMount computes the options of a mount.
+// They are derived from the global flags, then overridden by the per-mount
+// values, then overridden again by flags that were set on the command line.
+func resolveMount(source, mountpoint string, values optionValues, commandLine map[string]bool) (*mountDefinition, error) {
+	options := &mountOptions{}
+	flags := flag.NewFlagSet(source, flag.ContinueOnError)
+	options.register(flags)
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err == nil {
+			err = flags.Set(f.Name, flag.Lookup(f.Name).Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := values.apply(flags, commandLine); err != nil {
+		return nil, err
+	}
+	return &mountDefinition{source: source, mountpoint: mountpoint, options: options}, nil
+}
+
+// commandLineFlags returns the set of flags that were set on the command line.
+// It must be called before loadMounts, as the configuration file also sets flags.
+func commandLineFlags() map[string]bool {
+	commandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	return commandLine
+}
+
+// loadMounts returns the list of mounts to serve, merging the configuration
+// file (if any) with the command-line flags and arguments.
+// commandLine is the set of flags that were set on the command line.
+func loadMounts(configPath string, args []string, commandLine map[string]bool) ([]*mountDefinition, error) {
+	config := &configFile{}
+	if configPath != "" {
+		var err error
+		if config, err = readConfigFile(configPath); err != nil {
+			return nil, err
+		}
+		if err := config.Options.apply(flag.CommandLine, commandLine); err != nil {
+			return nil, fmt.Errorf("%q: %v", configPath, err)
+		}
+	}
+	mountFlags := mountOptionNames()
+	var mounts []*mountDefinition
+	for i, m := range config.Mounts {
+		if m.Source == "" || m.Mountpoint == "" {
+			return nil, fmt.Errorf("%q: mount #%d must have both a source and a mountpoint", configPath, i+1)
+		}
+		for name := range m.Options {
+			if !mountFlags[name] {
+				return nil, fmt.Errorf("%q: mount #%d: %q is not a per-mount option", configPath, i+1, name)
+			}
+		}
+		mount, err := resolveMount(m.Source, m.Mountpoint, m.Options, commandLine)
+		if err != nil {
+			return nil, fmt.Errorf("%q: mount #%d: %v", configPath, i+1, err)
+		}
+		mounts = append(mounts, mount)
+	}
+	switch len(args) {
+	case 0:
+	case 2:
+		mount, err := resolveMount(args[0], args[1], nil, commandLine)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	default:
+		return nil, fmt.Errorf("expected a source directory and a target mountpoint, got %d arguments", len(args))
+	}
+	if len(mounts) == 0 {
+		return nil, fmt.Errorf("no mounts specified")
+	}
+	return mounts, nil
+}
+
+// setReloaded records the settings of the given options that a reload
+// applied to the mount: those that (*split.FS).Reload changes.
+func (m *mountDefinition) setReloaded(reloaded *mountOptions) {
+	m.optionsMu.Lock()
+	defer m.optionsMu.Unlock()
+	options := *m.options
+	options.excludeRegexp = reloaded.excludeRegexp
+	options.includeRegexp = reloaded.includeRegexp
+	options.attrCacheTTL = reloaded.attrCacheTTL
+	m.options = &options
+}
+
+// configJSON returns the effective configuration of the mount, in the
+// format of a configuration file, including the settings changed by
+// reloads since it was mounted.
+func (m *mountDefinition) configJSON() []byte {
+	m.optionsMu.Lock()
+	options := m.options
+	m.optionsMu.Unlock()
+	data, err := json.MarshalIndent(&configFile{Mounts: []configMount{{m.source, m.mountpoint, options.values()}}}, "", "  ")
+	if err != nil {
+		return []byte(err.Error())
+	}
+	return append(data, '\n')
+}
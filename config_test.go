@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigJSONAfterReload(t *testing.T) {
+	options := &mountOptions{}
+	options.register(flag.NewFlagSet("", flag.ContinueOnError))
+	m := &mountDefinition{source: "/source", mountpoint: "/mnt", options: options}
+	reloaded := *options
+	reloaded.excludeRegexp = `\.iso$`
+	reloaded.attrCacheTTL = time.Second
+	// Reloads never change the chunk size.
+	reloaded.chunkSize = "1GiB"
+	m.setReloaded(&reloaded)
+	config := &configFile{}
+	if err := json.Unmarshal(m.configJSON(), config); err != nil {
+		t.Fatalf("cannot parse configuration: %v", err)
+	}
+	if len(config.Mounts) != 1 {
+		t.Fatalf("got %d mounts, want 1", len(config.Mounts))
+	}
+	got := config.Mounts[0]
+	if got.Source != "/source" || got.Mountpoint != "/mnt" {
+		t.Errorf("got source %q and mountpoint %q, want %q and %q", got.Source, got.Mountpoint, "/source", "/mnt")
+	}
+	for name, want := range map[string]string{
+		"exclude_regexp": `\.iso$`,
+		"attr_cache_ttl": "1s",
+		"chunk_size":     "32MiB",
+	} {
+		if value := got.Options[name]; value != want {
+			t.Errorf("option %q = %v, want %q", name, value, want)
+		}
+	}
+	if options.excludeRegexp != "" {
+		t.Errorf("reload modified the options in place")
+	}
+}
+
+// sampleConfig is the sample configuration file of the README.
+const sampleConfig = `{
+  "options": {"chunk_size": "32MiB", "filename_hash": "sha256-b32"},
+  "mounts": [
+    {"source": "/data", "mountpoint": "/mnt/data"},
+    {"source": "/media", "mountpoint": "/mnt/media", "options": {"chunk_size": "1GiB", "exclude_regexp": "\\.txt$"}}
+  ]
+}`
+
+func TestLoadMounts(t *testing.T) {
+	registerCommandLine(t)
+	configPath := writeFile(t, t.TempDir(), "splitfs.json", sampleConfig)
+	mounts, err := loadMounts(configPath, nil, setOnCommandLine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("got %d mounts, want 2", len(mounts))
+	}
+	for i, want := range []struct {
+		source, mountpoint, chunkSize, excludeRegexp string
+	}{
+		{"/data", "/mnt/data", "32MiB", ""},
+		{"/media", "/mnt/media", "1GiB", `\.txt$`},
+	} {
+		got := mounts[i]
+		if got.source != want.source || got.mountpoint != want.mountpoint {
+			t.Errorf("mount #%d: got source %q and mountpoint %q, want %q and %q", i+1, got.source, got.mountpoint, want.source, want.mountpoint)
+		}
+		if got.options.chunkSize != want.chunkSize || got.options.excludeRegexp != want.excludeRegexp {
+			t.Errorf("mount #%d: got chunk_size %q and exclude_regexp %q, want %q and %q", i+1, got.options.chunkSize, got.options.excludeRegexp, want.chunkSize, want.excludeRegexp)
+		}
+		if got.options.filenameHash != "sha256-b32" || got.options.attrCacheTTL != time.Minute {
+			t.Errorf("mount #%d: got filename_hash %q and attr_cache_ttl %v, want the top-level and default values", i+1, got.options.filenameHash, got.options.attrCacheTTL)
+		}
+	}
+}
+
+func TestLoadMountsCommandLineOverrides(t *testing.T) {
+	registerCommandLine(t)
+	configPath := writeFile(t, t.TempDir(), "splitfs.json", sampleConfig)
+	if err := flag.Set("chunk_size", "4MiB"); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := loadMounts(configPath, []string{"/extra", "/mnt/extra"}, setOnCommandLine("chunk_size"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 {
+		t.Fatalf("got %d mounts, want 3", len(mounts))
+	}
+	for _, mount := range mounts {
+		if mount.options.chunkSize != "4MiB" {
+			t.Errorf("%s: chunk_size = %q, want the command-line value 4MiB", mount.mountpoint, mount.options.chunkSize)
+		}
+	}
+	if got := mounts[1].options.excludeRegexp; got != `\.txt$` {
+		t.Errorf("/mnt/media: exclude_regexp = %q, want the value from the file", got)
+	}
+}
+
+func TestLoadMountsRejections(t *testing.T) {
+	registerCommandLine(t)
+	for _, test := range []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"unknown top-level key", `{"option": {}, "mounts": []}`, "unknown field"},
+		{"unknown mount key", `{"mounts": [{"source": "/data", "mountpoint": "/mnt", "mount_point": "/mnt"}]}`, "unknown field"},
+		{"unknown option", `{"options": {"chunksize": "1MiB"}, "mounts": [{"source": "/data", "mountpoint": "/mnt"}]}`, "unknown option"},
+		{"unknown per-mount option", `{"mounts": [{"source": "/data", "mountpoint": "/mnt", "options": {"chunksize": "1MiB"}}]}`, "not a per-mount option"},
+		{"global flag per mount", `{"mounts": [{"source": "/data", "mountpoint": "/mnt", "options": {"config": "other.json"}}]}`, "not a per-mount option"},
+		{"invalid value", `{"mounts": [{"source": "/data", "mountpoint": "/mnt", "options": {"ro": "maybe"}}]}`, "invalid value"},
+		{"mount without mountpoint", `{"mounts": [{"source": "/data"}]}`, "must have both"},
+		{"no mounts", `{}`, "no mounts"},
+	} {
+		configPath := writeFile(t, t.TempDir(), "splitfs.json", test.config)
+		_, err := loadMounts(configPath, nil, setOnCommandLine())
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: loadMounts = %v, want an error about %q", test.name, err, test.want)
+		}
+	}
+}
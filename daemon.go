@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv is set in the environment of the background process started by
+// daemonize, so that it knows not to daemonize again.
+const daemonEnv = "_SPLITFS_DAEMON"
+
+// daemonReadyFD is the file descriptor on which the background process
+// reports whether its mounts succeeded.
+const daemonReadyFD = 3
+
+// daemonReadyMessage is sent by the background process once all of its
+// mounts are ready. Anything else is an error message.
+const daemonReadyMessage = "ready"
+
+// daemonize re-executes the current program in the background, detached
+// from the controlling terminal. The foreground process waits until the
+// background process reports that its mounts are ready, then exits with a
+// status reflecting whether they succeeded. This is what mount(8) expects
+// from its helpers.
+//
+// daemonize only returns in the background process. The returned function
+// must be called exactly once, with the result of mounting everything.
+func daemonize() func(error) {
+	if os.Getenv(daemonEnv) != "" {
+		readyFile := os.NewFile(daemonReadyFD, "daemon-ready")
+		return func(err error) {
+			message := daemonReadyMessage
+			if err != nil {
+				message = err.Error()
+			}
+			readyFile.Write([]byte(message))
+			readyFile.Close()
+			// From now on, errors can only go to the log.
+			if devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0); err == nil {
+				syscall.Dup3(int(devNull.Fd()), int(os.Stdout.Fd()), 0)
+				syscall.Dup3(int(devNull.Fd()), int(os.Stderr.Fd()), 0)
+				devNull.Close()
+			}
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Cannot find own executable: %v", err)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("Cannot create pipe: %v", err)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Cannot start background process: %v", err)
+	}
+	readyWriter.Close()
+	message, err := ioutil.ReadAll(readyReader)
+	if err != nil {
+		log.Fatalf("Cannot read from background process: %v", err)
+	}
+	switch strings.TrimSpace(string(message)) {
+	case daemonReadyMessage:
+		os.Exit(0)
+	case "":
+		log.Fatalf("Background process exited before mounting: %v", cmd.Wait())
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %s\n", progName, message)
+		os.Exit(1)
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"perot.me/splitfs/hashes"
+	"perot.me/splitfs/split"
+)
+
+// decryptChunkNames prints the source path of each of the given chunk
+// files, whose names were encrypted according to the given options.
+func decryptChunkNames(options *mountOptions, chunkPaths []string) error {
+	if options.filenameHash != hashes.EncryptedName {
+		return fmt.Errorf("decrypting chunk names requires --filename_hash=%s", hashes.EncryptedName)
+	}
+	key, err := options.filenameHashKey()
+	if err != nil {
+		return err
+	}
+	for _, chunkPath := range chunkPaths {
+		hash, err := split.HashFromChunkPath(chunkPath, options.template())
+		if err != nil {
+			return err
+		}
+		sourcePath, err := hashes.DecryptName(hash, key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", chunkPath, err)
+		}
+		fmt.Printf("%s\t%s\n", chunkPath, sourcePath)
+	}
+	return nil
+}
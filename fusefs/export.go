@@ -0,0 +1,459 @@
+package fusefs
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// ExportSupport returns a mount option that tells the kernel that the
+// filesystem can be exported over NFS; see split.NFSExport. bazil.org/fuse
+// has no option for the corresponding init flag, so it is set by reflection
+// on the mount configuration; ExportSupport fails if that configuration is
+// not laid out as expected.
+func ExportSupport() (fuse.MountOption, error) {
+	optionType := reflect.TypeOf(fuse.MountOption(nil))
+	if optionType.NumIn() != 1 || optionType.In(0).Kind() != reflect.Ptr || optionType.In(0).Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot set export support: unexpected mount option type %v", optionType)
+	}
+	field, ok := optionType.In(0).Elem().FieldByName("initFlags")
+	if !ok || field.Type != reflect.TypeOf(fuse.InitExportSupport) {
+		return nil, fmt.Errorf("cannot set export support: %v has no initFlags field of type %T", optionType.In(0).Elem(), fuse.InitExportSupport)
+	}
+	return reflect.MakeFunc(optionType, func(args []reflect.Value) []reflect.Value {
+		flags := args[0].Elem().FieldByIndex(field.Index)
+		flags = reflect.NewAt(flags.Type(), unsafe.Pointer(flags.UnsafeAddr())).Elem()
+		flags.SetUint(flags.Uint() | uint64(fuse.InitExportSupport))
+		return []reflect.Value{reflect.Zero(optionType.Out(0))}
+	}).Interface().(fuse.MountOption), nil
+}
+
+// exportServer serves the filesystem on a FUSE connection, like fs.Server,
+// but with node IDs that do not depend on the order in which nodes are
+// looked up. The node ID of a node is its inode number, except for the root,
+// whose node ID must be 1; the node whose inode number is 1, if any, takes
+// the inode number of the root as its node ID.
+type exportServer struct {
+	fs        *FS
+	conn      *fuse.Conn
+	rootInode uint64
+
+	mu sync.Mutex
+	// nodes are the nodes that the kernel knows about.
+	nodes      map[fuse.NodeID]*exportNode
+	handles    map[fuse.HandleID]fs.Handle
+	nextHandle fuse.HandleID
+	// cancels cancels the requests being served, by request ID.
+	cancels map[fuse.RequestID]context.CancelFunc
+}
+
+type exportNode struct {
+	node       fs.Node
+	generation uint64
+	// refs is the number of lookups the kernel has not forgotten yet.
+	refs uint64
+}
+
+// pathNode is implemented by the nodes of the filesystem.
+type pathNode interface {
+	fs.Node
+	nodePath() string
+}
+
+func newExportServer(f *FS, conn *fuse.Conn) (*exportServer, error) {
+	s := &exportServer{
+		fs:      f,
+		conn:    conn,
+		nodes:   map[fuse.NodeID]*exportNode{1: {node: f.root, refs: 1}},
+		handles: make(map[fuse.HandleID]fs.Handle),
+		cancels: make(map[fuse.RequestID]context.CancelFunc),
+	}
+	attr := fuse.Attr{}
+	if err := s.attr(context.Background(), f.root, &attr); err != nil {
+		return nil, err
+	}
+	s.rootInode = attr.Inode
+	return s, nil
+}
+
+// serve serves requests until the filesystem is unmounted.
+func (s *exportServer) serve() error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		req, err := s.conn.ReadRequest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveRequest(req)
+		}()
+	}
+}
+
+func (s *exportServer) serveRequest(req fuse.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	id := req.Hdr().ID
+	s.mu.Lock()
+	s.cancels[id] = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.cancels, id)
+		s.mu.Unlock()
+	}()
+	if err := s.handleRequest(ctx, req); err != nil {
+		req.RespondError(err)
+	}
+}
+
+// nodeID returns the node ID of the node with the given inode number.
+func (s *exportServer) nodeID(inode uint64) fuse.NodeID {
+	switch inode {
+	case s.rootInode:
+		return 1
+	case 1:
+		return fuse.NodeID(s.rootInode)
+	}
+	return fuse.NodeID(inode)
+}
+
+// inode returns the inode number of the node with the given node ID.
+func (s *exportServer) inode(id fuse.NodeID) uint64 {
+	switch uint64(id) {
+	case 1:
+		return s.rootInode
+	case s.rootInode:
+		return 1
+	}
+	return uint64(id)
+}
+
+func (s *exportServer) attr(ctx context.Context, n fs.Node, attr *fuse.Attr) error {
+	attr.Nlink = 1
+	return n.Attr(ctx, attr)
+}
+
+// lookupResponse fills in the response to a lookup of the given node, and
+// records that the kernel knows about it.
+func (s *exportServer) lookupResponse(ctx context.Context, n fs.Node, resp *fuse.LookupResponse) error {
+	if err := s.attr(ctx, n, &resp.Attr); err != nil {
+		return err
+	}
+	id := s.nodeID(resp.Attr.Inode)
+	resp.Node = id
+	resp.EntryValid = resp.Attr.Valid
+	s.mu.Lock()
+	known, ok := s.nodes[id]
+	s.mu.Unlock()
+	if !ok {
+		generation, err := s.fs.splitFS.Generation(n.(pathNode).nodePath())
+		if err != nil {
+			return fuseErr(err)
+		}
+		s.mu.Lock()
+		if known, ok = s.nodes[id]; !ok {
+			known = &exportNode{node: n, generation: generation}
+			s.nodes[id] = known
+		}
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	known.refs++
+	resp.Generation = known.generation
+	s.mu.Unlock()
+	return nil
+}
+
+// node returns the node with the given node ID, finding it again if the
+// kernel forgot about it.
+func (s *exportServer) node(ctx context.Context, id fuse.NodeID) (fs.Node, error) {
+	s.mu.Lock()
+	known, ok := s.nodes[id]
+	s.mu.Unlock()
+	if ok {
+		return known.node, nil
+	}
+	inode := s.inode(id)
+	rootRelativePath, err := s.fs.splitFS.InodePath(inode)
+	if err != nil {
+		return nil, fuse.Errno(syscall.ESTALE)
+	}
+	n, err := s.nodeAt(ctx, rootRelativePath)
+	if err != nil {
+		return nil, fuse.Errno(syscall.ESTALE)
+	}
+	attr := fuse.Attr{}
+	if err := s.attr(ctx, n, &attr); err != nil || attr.Inode != inode {
+		return nil, fuse.Errno(syscall.ESTALE)
+	}
+	return n, nil
+}
+
+// nodeAt returns the node at the given root-relative path, looking up each
+// of its components.
+func (s *exportServer) nodeAt(ctx context.Context, rootRelativePath string) (fs.Node, error) {
+	var n fs.Node = s.fs.root
+	if rootRelativePath == "" {
+		return n, nil
+	}
+	for _, name := range strings.Split(rootRelativePath, "/") {
+		d, ok := n.(*dir)
+		if !ok {
+			return nil, fuse.Errno(syscall.ENOTDIR)
+		}
+		var err error
+		if n, err = d.Lookup(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// parent returns the parent of the given directory.
+func (s *exportServer) parent(ctx context.Context, n fs.Node) (fs.Node, error) {
+	d, ok := n.(*dir)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	parentPath := path.Dir(d.path)
+	if parentPath == "." {
+		parentPath = ""
+	}
+	return s.nodeAt(ctx, parentPath)
+}
+
+func (s *exportServer) forget(id fuse.NodeID, n uint64) {
+	s.mu.Lock()
+	known, ok := s.nodes[id]
+	if !ok || id == 1 {
+		s.mu.Unlock()
+		return
+	}
+	if known.refs > n {
+		known.refs -= n
+		s.mu.Unlock()
+		return
+	}
+	delete(s.nodes, id)
+	s.mu.Unlock()
+	if forgetter, ok := known.node.(fs.NodeForgetter); ok {
+		forgetter.Forget()
+	}
+}
+
+func (s *exportServer) handle(id fuse.HandleID) (fs.Handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.handles[id]
+	if !ok {
+		return nil, fuse.Errno(syscall.ESTALE)
+	}
+	return h, nil
+}
+
+func (s *exportServer) handleRequest(ctx context.Context, req fuse.Request) error {
+	switch r := req.(type) {
+	case *fuse.ForgetRequest:
+		s.forget(r.Node, r.N)
+		r.Respond()
+		return nil
+	case *fuse.InterruptRequest:
+		s.mu.Lock()
+		if cancel, ok := s.cancels[r.IntrID]; ok {
+			cancel()
+		}
+		s.mu.Unlock()
+		r.Respond()
+		return nil
+	case *fuse.StatfsRequest:
+		r.Respond(&fuse.StatfsResponse{})
+		return nil
+	case *fuse.DestroyRequest:
+		r.Respond()
+		return nil
+	}
+
+	n, err := s.node(ctx, req.Hdr().Node)
+	if err != nil {
+		return err
+	}
+	switch r := req.(type) {
+	case *fuse.LookupRequest:
+		target := n
+		switch r.Name {
+		case ".":
+		case "..":
+			if target, err = s.parent(ctx, n); err != nil {
+				return err
+			}
+		default:
+			lookuper, ok := n.(fs.NodeStringLookuper)
+			if !ok {
+				return fuse.ENOENT
+			}
+			if target, err = lookuper.Lookup(ctx, r.Name); err != nil {
+				return err
+			}
+		}
+		resp := &fuse.LookupResponse{}
+		if err := s.lookupResponse(ctx, target, resp); err != nil {
+			return err
+		}
+		r.Respond(resp)
+
+	case *fuse.GetattrRequest:
+		resp := &fuse.GetattrResponse{}
+		if err := s.attr(ctx, n, &resp.Attr); err != nil {
+			return err
+		}
+		r.Respond(resp)
+
+	case *fuse.SetattrRequest:
+		resp := &fuse.SetattrResponse{}
+		setattrer, ok := n.(fs.NodeSetattrer)
+		if !ok {
+			return fuse.Errno(syscall.EROFS)
+		}
+		if err := setattrer.Setattr(ctx, r, resp); err != nil {
+			return err
+		}
+		if err := s.attr(ctx, n, &resp.Attr); err != nil {
+			return err
+		}
+		r.Respond(resp)
+
+	case *fuse.AccessRequest:
+		r.Respond()
+
+	case *fuse.ReadlinkRequest:
+		readlinker, ok := n.(fs.NodeReadlinker)
+		if !ok {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		target, err := readlinker.Readlink(ctx, r)
+		if err != nil {
+			return err
+		}
+		r.Respond(target)
+
+	case *fuse.GetxattrRequest, *fuse.ListxattrRequest:
+		return fuse.Errno(syscall.ENOTSUP)
+
+	case *fuse.CreateRequest, *fuse.MkdirRequest, *fuse.MknodRequest, *fuse.SymlinkRequest, *fuse.LinkRequest,
+		*fuse.RenameRequest, *fuse.RemoveRequest, *fuse.SetxattrRequest, *fuse.RemovexattrRequest:
+		return fuse.Errno(syscall.EROFS)
+
+	case *fuse.OpenRequest:
+		resp := &fuse.OpenResponse{}
+		var handle fs.Handle = n
+		if opener, ok := n.(fs.NodeOpener); ok {
+			if handle, err = opener.Open(ctx, r, resp); err != nil {
+				return err
+			}
+		}
+		s.mu.Lock()
+		s.nextHandle++
+		resp.Handle = s.nextHandle
+		s.handles[resp.Handle] = handle
+		s.mu.Unlock()
+		r.Respond(resp)
+
+	case *fuse.ReadRequest:
+		h, err := s.handle(r.Handle)
+		if err != nil {
+			return err
+		}
+		reader, ok := h.(fs.HandleReader)
+		if !ok {
+			return fuse.Errno(syscall.EIO)
+		}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, r.Size)}
+		if err := reader.Read(ctx, r, resp); err != nil {
+			return err
+		}
+		r.Respond(resp)
+
+	case *fuse.WriteRequest:
+		h, err := s.handle(r.Handle)
+		if err != nil {
+			return err
+		}
+		writer, ok := h.(fs.HandleWriter)
+		if !ok {
+			return fuse.Errno(syscall.EIO)
+		}
+		resp := &fuse.WriteResponse{}
+		if err := writer.Write(ctx, r, resp); err != nil {
+			return err
+		}
+		r.Respond(resp)
+
+	case *fuse.FlushRequest:
+		r.Respond()
+
+	case *fuse.ReleaseRequest:
+		h, err := s.handle(r.Handle)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		delete(s.handles, r.Handle)
+		s.mu.Unlock()
+		if releaser, ok := h.(fs.HandleReleaser); ok {
+			if err := releaser.Release(ctx, r); err != nil {
+				return err
+			}
+		}
+		r.Respond()
+
+	default:
+		return fuse.ENOSYS
+	}
+	return nil
+}
+
+// knownNodeID returns the node ID of the given node, if the kernel knows
+// about it.
+func (s *exportServer) knownNodeID(n fs.Node) (fuse.NodeID, bool) {
+	attr := fuse.Attr{}
+	if err := n.Attr(context.Background(), &attr); err != nil {
+		return 0, false
+	}
+	id := s.nodeID(attr.Inode)
+	s.mu.Lock()
+	_, ok := s.nodes[id]
+	s.mu.Unlock()
+	return id, ok
+}
+
+func (s *exportServer) InvalidateNodeData(n fs.Node) error {
+	id, ok := s.knownNodeID(n)
+	if !ok {
+		return fuse.ErrNotCached
+	}
+	return s.conn.InvalidateNode(id, 0, -1)
+}
+
+func (s *exportServer) InvalidateEntry(parent fs.Node, name string) error {
+	id, ok := s.knownNodeID(parent)
+	if !ok {
+		return fuse.ErrNotCached
+	}
+	return s.conn.InvalidateEntry(id, name)
+}
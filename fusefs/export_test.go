@@ -0,0 +1,225 @@
+package fusefs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"perot.me/splitfs/split"
+)
+
+// TestExportSupport checks the layout of the mount configuration of
+// bazil.org/fuse that ExportSupport relies on, so that an update of
+// bazil.org/fuse that changes it fails here rather than at mount time: the
+// configuration must have an initFlags field of type fuse.InitFlags, which
+// fuse.AsyncRead sets its flag in. ExportSupport must then set the export
+// support flag in it, and leave the others as they are.
+func TestExportSupport(t *testing.T) {
+	optionType := reflect.TypeOf(fuse.MountOption(nil))
+	configType := optionType.In(0).Elem()
+	field, ok := configType.FieldByName("initFlags")
+	if !ok || field.Type != reflect.TypeOf(fuse.InitFlags(0)) {
+		t.Fatalf("%v has no initFlags field of type fuse.InitFlags", configType)
+	}
+	// apply applies the options to a new mount configuration, and returns
+	// its init flags.
+	apply := func(options ...fuse.MountOption) fuse.InitFlags {
+		t.Helper()
+		config := reflect.New(configType)
+		for _, option := range options {
+			if out := reflect.ValueOf(option).Call([]reflect.Value{config}); !out[0].IsNil() {
+				t.Fatalf("applying an option failed: %v", out[0])
+			}
+		}
+		return fuse.InitFlags(config.Elem().FieldByIndex(field.Index).Uint())
+	}
+	if flags := apply(fuse.AsyncRead()); flags != fuse.InitAsyncRead {
+		t.Fatalf("fuse.AsyncRead sets init flags %v, want %v: initFlags no longer holds the init flags", flags, fuse.InitAsyncRead)
+	}
+	option, err := ExportSupport()
+	if err != nil {
+		t.Fatalf("ExportSupport() = %v", err)
+	}
+	if flags := apply(option); flags != fuse.InitExportSupport {
+		t.Errorf("init flags are %v, want %v", flags, fuse.InitExportSupport)
+	}
+	if flags, want := apply(fuse.AsyncRead(), option), fuse.InitAsyncRead|fuse.InitExportSupport; flags != want {
+		t.Errorf("init flags are %v after fuse.AsyncRead, want %v", flags, want)
+	}
+}
+
+// exportSource returns the filesystem of the given source directory, to be
+// exported over NFS, and its export server, which is not connected to the
+// kernel.
+func exportSource(t *testing.T, source string, options ...split.Option) (*split.FS, *exportServer) {
+	t.Helper()
+	options = append([]split.Option{split.NFSExport(true), split.DedupHardLinks(true), split.Symlinks(split.SymlinksRewrite)}, options...)
+	f, err := split.NewFS(source, 1, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newExportServer(New(f), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+// exportLookup looks up the node at the given root-relative path as the
+// kernel does, a component at a time, and returns its node ID.
+func exportLookup(t *testing.T, s *exportServer, rootRelativePath string) fuse.NodeID {
+	t.Helper()
+	ctx := context.Background()
+	id := fuse.NodeID(1)
+	for _, name := range strings.Split(rootRelativePath, "/") {
+		parent, err := s.node(ctx, id)
+		if err != nil {
+			t.Fatalf("finding the parent of %s: %v", name, err)
+		}
+		n, err := parent.(fs.NodeStringLookuper).Lookup(ctx, name)
+		if err != nil {
+			t.Fatalf("looking up %s: %v", name, err)
+		}
+		resp := &fuse.LookupResponse{}
+		if err := s.lookupResponse(ctx, n, resp); err != nil {
+			t.Fatal(err)
+		}
+		id = resp.Node
+	}
+	return id
+}
+
+// nodeInode returns the inode number of the node with the given node ID.
+func nodeInode(t *testing.T, s *exportServer, id fuse.NodeID) uint64 {
+	t.Helper()
+	n, err := s.node(context.Background(), id)
+	if err != nil {
+		t.Fatalf("finding node %d: %v", id, err)
+	}
+	attr := fuse.Attr{}
+	if err := s.attr(context.Background(), n, &attr); err != nil {
+		t.Fatal(err)
+	}
+	return attr.Inode
+}
+
+// TestExportForgottenNodes finds nodes again from their node ID, as NFS
+// clients do with their handles, after the kernel forgot them.
+func TestExportForgottenNodes(t *testing.T) {
+	source := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"dir/a.bin": "abc", "gone.bin": "x"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(source, "dir/a.bin"), filepath.Join(source, "dir/b.bin")); err != nil {
+		t.Fatal(err)
+	}
+	f, s := exportSource(t, source)
+	chunks, err := f.IOFS().ReadDir("dir/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"dir", "dir/a.bin", path.Join("dir/a.bin", chunks[1].Name()), "dir/b.bin"} {
+		id := exportLookup(t, s, p)
+		inode := nodeInode(t, s, id)
+		s.forget(id, 1)
+		if _, ok := s.nodes[id]; ok {
+			t.Fatalf("%s is still known after it was forgotten", p)
+		}
+		if got := nodeInode(t, s, id); got != inode {
+			t.Errorf("%s was found again with inode %d, want %d", p, got, inode)
+		}
+	}
+
+	id := exportLookup(t, s, "gone.bin")
+	s.forget(id, 1)
+	if err := os.Remove(filepath.Join(source, "gone.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.node(context.Background(), id); err != fuse.Errno(syscall.ESTALE) {
+		t.Errorf("finding a removed file = %v, want ESTALE", err)
+	}
+}
+
+// TestExportFanOutParents looks up the parents of the fan-out directories of
+// a split file, as NFS servers do to reconnect directory handles.
+func TestExportFanOutParents(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "big.bin"), make([]byte, 5), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, s := exportSource(t, source, split.ChunkFanOut(2))
+	view := f.IOFS()
+	top, err := view.ReadDir("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	level := path.Join("big.bin", top[0].Name())
+	nested, err := view.ReadDir(level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"big.bin", level, path.Join(level, nested[0].Name())} {
+		id := exportLookup(t, s, p)
+		s.forget(id, 1)
+		n, err := s.node(context.Background(), id)
+		if err != nil {
+			t.Fatalf("finding %s: %v", p, err)
+		}
+		parent, err := s.parent(context.Background(), n)
+		if err != nil {
+			t.Fatalf("looking up the parent of %s: %v", p, err)
+		}
+		attr := fuse.Attr{}
+		if err := s.attr(context.Background(), parent, &attr); err != nil {
+			t.Fatal(err)
+		}
+		want := s.rootInode
+		if parentPath := path.Dir(p); parentPath != "." {
+			want = nodeInode(t, s, exportLookup(t, s, parentPath))
+		}
+		if attr.Inode != want {
+			t.Errorf("the parent of %s has inode %d, want %d", p, attr.Inode, want)
+		}
+	}
+}
+
+// TestExportReadOnly checks that the export server replies EROFS to requests
+// that would change the filesystem, like the fs.Server nodes do.
+func TestExportReadOnly(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "a.bin"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, s := exportSource(t, source)
+	id := exportLookup(t, s, "a.bin")
+	root := fuse.Header{Node: 1}
+	for _, req := range []fuse.Request{
+		&fuse.SetattrRequest{Header: fuse.Header{Node: id}, Valid: fuse.SetattrMode, Mode: 0600},
+		&fuse.SetattrRequest{Header: fuse.Header{Node: id}, Valid: fuse.SetattrSize},
+		&fuse.CreateRequest{Header: root, Name: "b.bin"},
+		&fuse.MkdirRequest{Header: root, Name: "b"},
+		&fuse.MknodRequest{Header: root, Name: "b"},
+		&fuse.SymlinkRequest{Header: root, NewName: "b", Target: "a.bin"},
+		&fuse.LinkRequest{Header: root, OldNode: id, NewName: "b"},
+		&fuse.RenameRequest{Header: root, OldName: "a.bin", NewName: "b.bin", NewDir: 1},
+		&fuse.RemoveRequest{Header: root, Name: "a.bin"},
+		&fuse.SetxattrRequest{Header: fuse.Header{Node: id}, Name: "user.a"},
+		&fuse.RemovexattrRequest{Header: fuse.Header{Node: id}, Name: "user.a"},
+	} {
+		if err := s.handleRequest(context.Background(), req); err != fuse.Errno(syscall.EROFS) {
+			t.Errorf("%T = %v, want EROFS", req, err)
+		}
+	}
+}
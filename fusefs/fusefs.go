@@ -0,0 +1,575 @@
+// Package fusefs serves the chunked view of package split over FUSE, with
+// bazil.org/fuse. It is built on the io/fs view of the filesystem,
+// split.IOFS: nodes are names in the views of their parent directories, so
+// the mountpoint presents the same names and bytes as the other frontends.
+package fusefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"perot.me/splitfs/split"
+)
+
+// FS is the FUSE filesystem of a split.FS.
+type FS struct {
+	splitFS *split.FS
+	root    *dir
+
+	// mu protects server and directories.
+	mu     sync.Mutex
+	server invalidator
+	// directories holds the directory nodes known to the kernel, keyed by
+	// their root-relative path, so that they are reused, and so that their
+	// kernel cache entries can be invalidated.
+	directories map[string]*dir
+}
+
+var _ fs.FS = (*FS)(nil)
+var _ split.Invalidator = (*FS)(nil)
+
+// New returns the FUSE filesystem of the given filesystem.
+func New(f *split.FS) *FS {
+	fsys := &FS{splitFS: f, directories: make(map[string]*dir)}
+	fsys.root = &dir{node: node{fs: fsys}, view: f.IOFS()}
+	fsys.directories[""] = fsys.root
+	return fsys
+}
+
+// Serve serves the given filesystem on the given FUSE connection until it
+// is unmounted. Filesystems that are to be exported over NFS are served
+// with stable node IDs; see split.NFSExport.
+func Serve(f *split.FS, conn *fuse.Conn) error {
+	fsys := New(f)
+	if f.NFSExported() {
+		server, err := newExportServer(fsys, conn)
+		if err != nil {
+			return err
+		}
+		fsys.setServer(server)
+		return server.serve()
+	}
+	server := fs.New(conn, nil)
+	fsys.setServer(server)
+	return server.Serve(fsys)
+}
+
+// setServer sets the server whose kernel caches are invalidated when the
+// filesystem changes.
+func (f *FS) setServer(server invalidator) {
+	f.mu.Lock()
+	f.server = server
+	f.mu.Unlock()
+	f.splitFS.SetInvalidator(f)
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return f.root, nil
+}
+
+// invalidator drops entries from the kernel's caches.
+type invalidator interface {
+	InvalidateNodeData(node fs.Node) error
+	InvalidateEntry(parent fs.Node, name string) error
+}
+
+var _ invalidator = (*fs.Server)(nil)
+var _ invalidator = (*exportServer)(nil)
+
+// knownDirectory returns the server and the node of the directory with the
+// given root-relative path, if the kernel knows about it.
+func (f *FS) knownDirectory(dirPath string) (invalidator, *dir, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.directories[dirPath]
+	if f.server == nil || !ok {
+		return nil, nil, fuse.ErrNotCached
+	}
+	return f.server, d, nil
+}
+
+func (f *FS) Directories() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	directories := make([]string, 0, len(f.directories))
+	for dirPath := range f.directories {
+		directories = append(directories, dirPath)
+	}
+	return directories
+}
+
+func (f *FS) InvalidateEntry(dirPath, name string) error {
+	server, d, err := f.knownDirectory(dirPath)
+	if err != nil {
+		return err
+	}
+	return server.InvalidateEntry(d, name)
+}
+
+func (f *FS) InvalidateDirectory(dirPath string) error {
+	server, d, err := f.knownDirectory(dirPath)
+	if err != nil {
+		return err
+	}
+	return server.InvalidateNodeData(d)
+}
+
+// fuseErr converts an error of the io/fs view into one that is replied with
+// its errno, rather than EIO.
+func fuseErr(err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return fuse.Errno(errno)
+	}
+	return err
+}
+
+// node is a node of the filesystem: the entry with the given name of the
+// view of its parent directory. The root has no parent.
+type node struct {
+	fs     *FS
+	parent *split.IOFS
+	name   string
+	// path is the root-relative path of the node.
+	path string
+
+	mu sync.Mutex
+	// info is the information the node was looked up with, if it was not
+	// used yet: the kernel gets the attributes of a node right after it
+	// looked it up.
+	info iofs.FileInfo
+}
+
+// nodePath returns the root-relative path of the node.
+func (n *node) nodePath() string {
+	return n.path
+}
+
+// stat returns information about the node, without following it.
+func (n *node) stat() (iofs.FileInfo, error) {
+	n.mu.Lock()
+	info := n.info
+	n.info = nil
+	n.mu.Unlock()
+	if info != nil {
+		return info, nil
+	}
+	return n.parent.Lstat(n.name)
+}
+
+func (n *node) attr(info iofs.FileInfo, attr *fuse.Attr) {
+	a := info.Sys().(*split.Attr)
+	// Fields that nodes leave unset keep the defaults of the server.
+	if a.Valid != 0 {
+		attr.Valid = a.Valid
+	}
+	if a.Nlink != 0 {
+		attr.Nlink = a.Nlink
+	}
+	for _, t := range []struct {
+		dst *time.Time
+		src time.Time
+	}{{&attr.Atime, a.Atime}, {&attr.Mtime, a.Mtime}, {&attr.Ctime, a.Ctime}, {&attr.Crtime, a.Crtime}} {
+		if !t.src.IsZero() {
+			*t.dst = t.src
+		}
+	}
+	attr.Inode = a.Inode
+	attr.Size = a.Size
+	attr.Blocks = a.Blocks
+	attr.Mode = a.Mode
+	attr.Uid = a.Uid
+	attr.Gid = a.Gid
+	attr.Rdev = a.Rdev
+	attr.BlockSize = a.BlockSize
+}
+
+func (n *node) Attr(_ context.Context, attr *fuse.Attr) error {
+	info, err := n.stat()
+	if err != nil {
+		return fuseErr(err)
+	}
+	n.attr(info, attr)
+	return nil
+}
+
+// Setattr fails with EROFS, except for truncating a control file that can
+// be written to, as opening it with O_TRUNC does: each write to it is a
+// command of its own, so there is nothing to truncate. Changes of
+// timestamps that come along with the truncation are ignored.
+func (n *node) Setattr(_ context.Context, req *fuse.SetattrRequest, _ *fuse.SetattrResponse) error {
+	if !req.Valid.Size() || req.Size != 0 || req.Valid.Mode() || req.Valid.Uid() || req.Valid.Gid() || n.parent == nil {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if req.Uid != 0 && req.Uid != uint32(os.Getuid()) {
+		return fuse.EPERM
+	}
+	info, err := n.parent.Lstat(n.name)
+	if err != nil {
+		return fuseErr(err)
+	}
+	if !info.Mode().IsRegular() {
+		return fuse.Errno(syscall.EROFS)
+	}
+	opened, err := n.parent.OpenFile(n.name, os.O_WRONLY)
+	if err != nil {
+		return fuseErr(err)
+	}
+	return fuseErr(opened.Close())
+}
+
+func (n *node) Setxattr(context.Context, *fuse.SetxattrRequest) error {
+	return fuse.Errno(syscall.EROFS)
+}
+
+func (n *node) Removexattr(context.Context, *fuse.RemovexattrRequest) error {
+	return fuse.Errno(syscall.EROFS)
+}
+
+// newNode returns the node of the entry with the given name of the given
+// directory, which was looked up with the given information.
+func (f *FS) newNode(parent *dir, name string, info iofs.FileInfo) (fs.Node, error) {
+	nodePath := path.Join(parent.path, name)
+	switch {
+	case info.IsDir():
+		return f.directory(parent, name, nodePath, info)
+	case info.Mode()&os.ModeSymlink != 0:
+		return &symlink{node: node{fs: f, parent: parent.view, name: name, path: nodePath, info: info}}, nil
+	}
+	return &file{node: node{fs: f, parent: parent.view, name: name, path: nodePath, info: info}}, nil
+}
+
+// directory returns the node of the directory with the given name of the
+// given directory, reusing the existing one if the kernel already knows
+// about it, and it is still the same directory.
+func (f *FS) directory(parent *dir, name, nodePath string, info iofs.FileInfo) (*dir, error) {
+	inode := info.Sys().(*split.Attr).Inode
+	f.mu.Lock()
+	d, ok := f.directories[nodePath]
+	f.mu.Unlock()
+	if ok && d.inode == inode {
+		f.splitFS.RecordDirectoryCacheLookup(true)
+		d.mu.Lock()
+		d.info = info
+		d.mu.Unlock()
+		return d, nil
+	}
+	f.splitFS.RecordDirectoryCacheLookup(false)
+	view, err := parent.view.Sub(name)
+	if err != nil {
+		return nil, fuseErr(err)
+	}
+	d = &dir{
+		node:  node{fs: f, parent: parent.view, name: name, path: nodePath, info: info},
+		view:  view.(*split.IOFS),
+		inode: inode,
+	}
+	f.mu.Lock()
+	f.directories[nodePath] = d
+	f.mu.Unlock()
+	return d, nil
+}
+
+// dir is a directory, whose entries are looked up in its own view.
+type dir struct {
+	node
+	view  *split.IOFS
+	inode uint64
+}
+
+var _ fs.Node = (*dir)(nil)
+var _ fs.NodeStringLookuper = (*dir)(nil)
+var _ fs.NodeOpener = (*dir)(nil)
+var _ fs.NodeForgetter = (*dir)(nil)
+var _ fs.NodeSetattrer = (*dir)(nil)
+var _ fs.NodeSetxattrer = (*dir)(nil)
+var _ fs.NodeRemovexattrer = (*dir)(nil)
+var _ fs.NodeCreater = (*dir)(nil)
+var _ fs.NodeMkdirer = (*dir)(nil)
+var _ fs.NodeMknoder = (*dir)(nil)
+var _ fs.NodeSymlinker = (*dir)(nil)
+var _ fs.NodeLinker = (*dir)(nil)
+var _ fs.NodeRenamer = (*dir)(nil)
+var _ fs.NodeRemover = (*dir)(nil)
+
+func (d *dir) Attr(_ context.Context, attr *fuse.Attr) error {
+	d.mu.Lock()
+	info := d.info
+	d.info = nil
+	d.mu.Unlock()
+	if info == nil {
+		var err error
+		if info, err = d.view.Stat("."); err != nil {
+			return fuseErr(err)
+		}
+	}
+	d.attr(info, attr)
+	return nil
+}
+
+func (d *dir) Lookup(_ context.Context, name string) (fs.Node, error) {
+	info, err := d.view.Lstat(name)
+	if err != nil {
+		return nil, fuseErr(err)
+	}
+	return d.fs.newNode(d, name, info)
+}
+
+// Create, Mkdir, Mknod, Symlink, Link, Rename and Remove fail with EROFS,
+// rather than the errors fs.Server replies with for operations that nodes
+// do not implement.
+
+func (d *dir) Create(context.Context, *fuse.CreateRequest, *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return nil, nil, fuse.Errno(syscall.EROFS)
+}
+
+func (d *dir) Mkdir(context.Context, *fuse.MkdirRequest) (fs.Node, error) {
+	return nil, fuse.Errno(syscall.EROFS)
+}
+
+func (d *dir) Mknod(context.Context, *fuse.MknodRequest) (fs.Node, error) {
+	return nil, fuse.Errno(syscall.EROFS)
+}
+
+func (d *dir) Symlink(context.Context, *fuse.SymlinkRequest) (fs.Node, error) {
+	return nil, fuse.Errno(syscall.EROFS)
+}
+
+func (d *dir) Link(context.Context, *fuse.LinkRequest, fs.Node) (fs.Node, error) {
+	return nil, fuse.Errno(syscall.EROFS)
+}
+
+func (d *dir) Rename(context.Context, *fuse.RenameRequest, fs.Node) error {
+	return fuse.Errno(syscall.EROFS)
+}
+
+func (d *dir) Remove(context.Context, *fuse.RemoveRequest) error {
+	return fuse.Errno(syscall.EROFS)
+}
+
+func (d *dir) Forget() {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	if d.fs.directories[d.path] == d && d != d.fs.root {
+		delete(d.fs.directories, d.path)
+	}
+}
+
+// dirFile is a directory opened through the io/fs view.
+type dirFile interface {
+	iofs.ReadDirFile
+	io.Seeker
+}
+
+// dirEntry is an entry of a directory opened through the io/fs view.
+type dirEntry interface {
+	iofs.DirEntry
+	Inode() uint64
+	Offset() int64
+}
+
+func (d *dir) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	file, err := d.view.Open(".")
+	if err != nil {
+		return nil, fuseErr(err)
+	}
+	directory, ok := file.(dirFile)
+	if !ok {
+		file.Close()
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	return &dirHandle{dir: directory}, nil
+}
+
+// dirHandle streams the entries of a directory to the kernel, a batch at a
+// time, so that memory use does not grow with the size of the directory.
+// The offsets given to the kernel are those of the entries in the view.
+type dirHandle struct {
+	mu  sync.Mutex
+	dir dirFile
+	// offset is the offset of the next entry.
+	offset int64
+}
+
+var _ fs.Handle = (*dirHandle)(nil)
+var _ fs.HandleReader = (*dirHandle)(nil)
+var _ fs.HandleReleaser = (*dirHandle)(nil)
+
+// direntSizeEstimate is the size that entries are assumed to take in the
+// replies to the kernel, to read about as many as fit at once.
+const direntSizeEstimate = 64
+
+// direntOffsetPosition is the position of the offset field in the entries
+// encoded by fuse.AppendDirent.
+const direntOffsetPosition = 8
+
+// setDirentOffset sets the offset of the entry after the one encoded at the
+// given position of data by fuse.AppendDirent, which sets it to the byte
+// position of the next entry in data. That is only meaningful if the whole
+// listing is in data. The field is in the byte order of the kernel.
+func setDirentOffset(data []byte, start int, offset uint64) {
+	binary.NativeEndian.PutUint64(data[start+direntOffsetPosition:], offset)
+}
+
+// direntType returns the type of directory entries with the given mode.
+func direntType(mode os.FileMode) fuse.DirentType {
+	switch {
+	case mode.IsDir():
+		return fuse.DT_Dir
+	case mode.IsRegular():
+		return fuse.DT_File
+	case mode&os.ModeSymlink != 0:
+		return fuse.DT_Link
+	case mode&os.ModeSocket != 0:
+		return fuse.DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return fuse.DT_Char
+	case mode&os.ModeDevice != 0:
+		return fuse.DT_Block
+	case mode&os.ModeNamedPipe != 0:
+		return fuse.DT_FIFO
+	}
+	return fuse.DT_Unknown
+}
+
+func (h *dirHandle) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if req.Offset != h.offset {
+		if _, err := h.dir.Seek(req.Offset, io.SeekStart); err != nil {
+			return fuseErr(err)
+		}
+		h.offset = req.Offset
+	}
+	for {
+		entries, err := h.dir.ReadDir(req.Size/direntSizeEstimate + 1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fuseErr(err)
+		}
+		for _, entry := range entries {
+			e := entry.(dirEntry)
+			start := len(resp.Data)
+			data := fuse.AppendDirent(resp.Data, fuse.Dirent{
+				Inode: e.Inode(),
+				Type:  direntType(e.Type()),
+				Name:  e.Name(),
+			})
+			if len(data) > req.Size {
+				// The entry is read again by the next read.
+				if _, err := h.dir.Seek(h.offset, io.SeekStart); err != nil {
+					return fuseErr(err)
+				}
+				return nil
+			}
+			setDirentOffset(data, start, uint64(e.Offset()))
+			resp.Data = data
+			h.offset = e.Offset()
+		}
+	}
+}
+
+func (h *dirHandle) Release(context.Context, *fuse.ReleaseRequest) error {
+	return fuseErr(h.dir.Close())
+}
+
+// file is a file other than a directory or a symlink.
+type file struct {
+	node
+}
+
+var _ fs.Node = (*file)(nil)
+var _ fs.NodeOpener = (*file)(nil)
+var _ fs.NodeSetattrer = (*file)(nil)
+
+func (f *file) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	opened, err := f.parent.OpenFile(f.name, int(req.Flags&fuse.OpenAccessModeMask))
+	if err != nil {
+		return nil, fuseErr(err)
+	}
+	info, err := opened.Stat()
+	if err != nil {
+		opened.Close()
+		return nil, fuseErr(err)
+	}
+	if info.Sys().(*split.Attr).Volatile {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	return &fileHandle{file: opened}, nil
+}
+
+// fileHandle is a file opened through the io/fs view.
+type fileHandle struct {
+	file iofs.File
+}
+
+var _ fs.Handle = (*fileHandle)(nil)
+var _ fs.HandleReader = (*fileHandle)(nil)
+var _ fs.HandleWriter = (*fileHandle)(nil)
+var _ fs.HandleReleaser = (*fileHandle)(nil)
+
+func (h *fileHandle) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	reader, ok := h.file.(io.ReaderAt)
+	if !ok {
+		return fuse.Errno(syscall.EBADF)
+	}
+	data := make([]byte, req.Size)
+	read, err := reader.ReadAt(data, req.Offset)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fuseErr(err)
+	}
+	resp.Data = data[:read]
+	return nil
+}
+
+// Write writes to a control file. Only the owner of the filesystem, or
+// root, may do so.
+func (h *fileHandle) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	writer, ok := h.file.(io.Writer)
+	if !ok {
+		return fuse.Errno(syscall.EBADF)
+	}
+	if req.Uid != 0 && req.Uid != uint32(os.Getuid()) {
+		return fuse.EPERM
+	}
+	written, err := writer.Write(req.Data)
+	if err != nil {
+		return fuseErr(err)
+	}
+	resp.Size = written
+	return nil
+}
+
+func (h *fileHandle) Release(context.Context, *fuse.ReleaseRequest) error {
+	return fuseErr(h.file.Close())
+}
+
+// symlink is a symlink, which the kernel resolves relative to the
+// mountpoint.
+type symlink struct {
+	node
+}
+
+var _ fs.Node = (*symlink)(nil)
+var _ fs.NodeReadlinker = (*symlink)(nil)
+var _ fs.NodeSetattrer = (*symlink)(nil)
+
+func (s *symlink) Readlink(context.Context, *fuse.ReadlinkRequest) (string, error) {
+	target, err := s.parent.ReadLink(s.name)
+	if err != nil {
+		return "", fuseErr(err)
+	}
+	return target, nil
+}
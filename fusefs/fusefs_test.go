@@ -0,0 +1,275 @@
+package fusefs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"perot.me/splitfs/split"
+)
+
+// listedEntry is an entry replied to a directory read, with the offset to
+// read the entries after it from.
+type listedEntry struct {
+	name   string
+	offset int64
+}
+
+// parseDirents parses the entries encoded by fuse.AppendDirent.
+func parseDirents(t *testing.T, data []byte) []listedEntry {
+	t.Helper()
+	var entries []listedEntry
+	for len(data) > 0 {
+		if len(data) < 24 {
+			t.Fatalf("truncated entry: %q", data)
+		}
+		offset := binary.NativeEndian.Uint64(data[8:])
+		nameLength := int(binary.NativeEndian.Uint32(data[16:]))
+		entries = append(entries, listedEntry{name: string(data[24 : 24+nameLength]), offset: int64(offset)})
+		size := (24 + nameLength + 7) &^ 7
+		if size > len(data) {
+			size = len(data)
+		}
+		data = data[size:]
+	}
+	return entries
+}
+
+// readDirents reads the entries of the directory handle from the given
+// offset, with a read of the given size, as the kernel does.
+func readDirents(t *testing.T, h fs.Handle, offset int64, size int) []listedEntry {
+	t.Helper()
+	resp := &fuse.ReadResponse{}
+	req := &fuse.ReadRequest{Dir: true, Offset: offset, Size: size}
+	if err := h.(fs.HandleReader).Read(context.Background(), req, resp); err != nil {
+		t.Fatalf("reading at offset %d: %v", offset, err)
+	}
+	if len(resp.Data) > size {
+		t.Fatalf("read %d bytes at offset %d, more than the %d asked for", len(resp.Data), offset, size)
+	}
+	return parseDirents(t, resp.Data)
+}
+
+// maxListed is the number of entries after which listDir gives up.
+const maxListed = 100000
+
+// listDir lists the directory node with reads of the given size, calling
+// between after each read.
+func listDir(t *testing.T, n fs.Node, size int, between func()) []listedEntry {
+	t.Helper()
+	h, err := n.(fs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.(fs.HandleReleaser).Release(context.Background(), &fuse.ReleaseRequest{})
+	var entries []listedEntry
+	offset := int64(0)
+	for {
+		read := readDirents(t, h, offset, size)
+		if len(read) == 0 {
+			return entries
+		}
+		entries = append(entries, read...)
+		if len(entries) > maxListed {
+			t.Fatalf("listed more than %d entries, the listing does not end", maxListed)
+		}
+		offset = read[len(read)-1].offset
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func lookup(t *testing.T, d fs.Node, name string) fs.Node {
+	t.Helper()
+	n, err := d.(fs.NodeStringLookuper).Lookup(context.Background(), name)
+	if err != nil {
+		t.Fatalf("looking up %s: %v", name, err)
+	}
+	return n
+}
+
+// TestListFanOutLevel lists a level of chunks that takes many reads, and
+// reads it again from the middle, as after a seekdir.
+func TestListFanOutLevel(t *testing.T) {
+	source := t.TempDir()
+	const chunks = 300
+	if err := os.WriteFile(filepath.Join(source, "big.bin"), make([]byte, chunks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := split.NewFS(source, 1, split.ChunkFanOut(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := New(f)
+	big := lookup(t, fsys.root, "big.bin")
+	entries := listDir(t, big, 512, nil)
+	want, err := f.IOFS().ReadDir("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != chunks {
+		t.Fatalf("the view lists %d chunks, want %d", len(want), chunks)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("listed %d entries, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.name != want[i].Name() {
+			t.Fatalf("entry %d is %s, want %s", i, entry.name, want[i].Name())
+		}
+	}
+
+	h, err := big.(fs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.(fs.HandleReleaser).Release(context.Background(), &fuse.ReleaseRequest{})
+	const from = 200
+	read := readDirents(t, h, entries[from-1].offset, 512)
+	if len(read) == 0 || read[0].name != entries[from].name {
+		t.Errorf("reading from the offset of entry %d gave %v, want entries from %s", from-1, read, entries[from].name)
+	}
+}
+
+// TestListChangingDirectory lists a source directory larger than the buffer
+// that it is read with, while entries are removed from and added to it.
+// Entries that are neither must be listed once.
+func TestListChangingDirectory(t *testing.T) {
+	source := t.TempDir()
+	const files = 1000
+	name := func(prefix string, i int) string {
+		return fmt.Sprintf("%s-%04d-%s", prefix, i, strings.Repeat("x", 50))
+	}
+	for i := 0; i < files; i++ {
+		if err := os.WriteFile(filepath.Join(source, name("file", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := split.NewFS(source, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := New(f)
+	removed := make(map[string]bool)
+	added := make(map[string]bool)
+	reads := 0
+	entries := listDir(t, fsys.root, 4096, func() {
+		reads++
+		if reads != 2 {
+			return
+		}
+		for i := 0; i < files; i += 10 {
+			removed[name("file", i)] = true
+			if err := os.Remove(filepath.Join(source, name("file", i))); err != nil {
+				t.Fatal(err)
+			}
+			added[name("added", i)] = true
+			if err := os.WriteFile(filepath.Join(source, name("added", i)), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if reads < 20 {
+		t.Fatalf("listed the directory in %d reads, want more to exceed the read buffer", reads)
+	}
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		if listed[entry.name] {
+			t.Errorf("%s was listed twice", entry.name)
+		}
+		listed[entry.name] = true
+		if !strings.HasPrefix(entry.name, "file-") && !added[entry.name] {
+			t.Errorf("%s was listed, but never existed", entry.name)
+		}
+	}
+	var missing []string
+	for i := 0; i < files; i++ {
+		if n := name("file", i); !removed[n] && !listed[n] {
+			missing = append(missing, n)
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Errorf("%d entries were not listed, such as %s", len(missing), missing[0])
+	}
+}
+
+// TestReadOnly checks that operations that would change the filesystem fail
+// with EROFS, except for the truncation of writable control files that
+// opening them with O_TRUNC makes.
+func TestReadOnly(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "a.bin"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := split.NewFS(source, 1, split.ControlDirectory(split.ControlHooks{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := New(f)
+	ctx := context.Background()
+	root := fsys.root
+	truncate := &fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrMtimeNow | fuse.SetattrHandle}
+	erofs := fuse.Errno(syscall.EROFS)
+	file := lookup(t, root, "a.bin").(fs.NodeSetattrer)
+	control := lookup(t, root, ".splitfs")
+	chunks, err := f.IOFS().ReadDir("a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := lookup(t, lookup(t, root, "a.bin"), chunks[0].Name()).(fs.NodeSetattrer)
+	for _, test := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"truncate of a directory", root.Setattr(ctx, truncate, &fuse.SetattrResponse{}), erofs},
+		{"truncate of a split file", file.Setattr(ctx, truncate, &fuse.SetattrResponse{}), erofs},
+		{"truncate of a chunk", chunk.Setattr(ctx, truncate, &fuse.SetattrResponse{}), erofs},
+		{"chmod", file.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0600}, &fuse.SetattrResponse{}), erofs},
+		// Stats cannot be written to, so they cannot be truncated either.
+		{"truncate of stats", lookup(t, control, "stats").(fs.NodeSetattrer).Setattr(ctx, truncate, &fuse.SetattrResponse{}), fuse.Errno(syscall.EACCES)},
+		{"setxattr", root.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.a"}), erofs},
+		{"removexattr", root.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.a"}), erofs},
+		{"remove", root.Remove(ctx, &fuse.RemoveRequest{Name: "a.bin"}), erofs},
+		{"rename", root.Rename(ctx, &fuse.RenameRequest{OldName: "a.bin", NewName: "b.bin"}, root), erofs},
+	} {
+		if test.err != test.want {
+			t.Errorf("%s = %v, want %v", test.name, test.err, test.want)
+		}
+	}
+	for name, create := range map[string]func() (fs.Node, error){
+		"create": func() (fs.Node, error) {
+			n, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "b.bin"}, &fuse.CreateResponse{})
+			return n, err
+		},
+		"mkdir":   func() (fs.Node, error) { return root.Mkdir(ctx, &fuse.MkdirRequest{Name: "b"}) },
+		"mknod":   func() (fs.Node, error) { return root.Mknod(ctx, &fuse.MknodRequest{Name: "b"}) },
+		"symlink": func() (fs.Node, error) { return root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "b", Target: "a.bin"}) },
+		"link":    func() (fs.Node, error) { return root.Link(ctx, &fuse.LinkRequest{NewName: "b"}, root) },
+	} {
+		if _, err := create(); err != erofs {
+			t.Errorf("%s = %v, want EROFS", name, err)
+		}
+	}
+
+	reload := lookup(t, control, "reload").(fs.NodeSetattrer)
+	if err := reload.Setattr(ctx, truncate, &fuse.SetattrResponse{}); err != nil {
+		t.Errorf("truncate of reload = %v, want success", err)
+	}
+	if err := reload.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 1}, &fuse.SetattrResponse{}); err != erofs {
+		t.Errorf("extending reload = %v, want EROFS", err)
+	}
+	if entries, err := os.ReadDir(source); err != nil || len(entries) != 1 {
+		t.Errorf("the source holds %v, %v, want a.bin alone", entries, err)
+	}
+}
@@ -1,6 +1,7 @@
 package hashes
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base32"
@@ -10,6 +11,9 @@ import (
 	"hash"
 	"hash/fnv"
 	"sort"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
 )
 
 // Hash is a size-agnostic version of the hash.Hash interface.
@@ -63,17 +67,104 @@ var hashFuncs = map[string]HashFunc{
 	"sha512-b64":  func() Hash { return hashBase64{sha512.New()} },
 }
 
+// KeyedHashFunc returns a HashFunc that uses the given secret key, or an
+// error if the key cannot be used.
+type KeyedHashFunc func(key []byte) (HashFunc, error)
+
+// hmacHashFunc returns a KeyedHashFunc computing the HMAC of the given hash,
+// with its digest encoded by encode.
+func hmacHashFunc(newHash func() hash.Hash, encode func(hash.Hash) Hash) KeyedHashFunc {
+	return func(key []byte) (HashFunc, error) {
+		return func() Hash { return encode(hmac.New(newHash, key)) }, nil
+	}
+}
+
+// blake2HashFunc returns a KeyedHashFunc computing the given BLAKE2 hash in
+// its keyed mode, which needs no HMAC construction, with its digest encoded by
+// encode. BLAKE2 keys are at most maxKeySize bytes long.
+func blake2HashFunc(newHash func(key []byte) (hash.Hash, error), maxKeySize int, encode func(hash.Hash) Hash) KeyedHashFunc {
+	return func(key []byte) (HashFunc, error) {
+		if len(key) > maxKeySize {
+			return nil, fmt.Errorf("key is %d bytes long, but must be at most %d bytes long", len(key), maxKeySize)
+		}
+		if _, err := newHash(key); err != nil {
+			return nil, err
+		}
+		return func() Hash {
+			h, _ := newHash(key) // The key was checked above.
+			return encode(h)
+		}, nil
+	}
+}
+
+var (
+	b32 = func(h hash.Hash) Hash { return hashBase32{h} }
+	b64 = func(h hash.Hash) Hash { return hashBase64{h} }
+)
+
+// keyedHashFuncs are the HMAC variants of the SHA-2 hashFuncs, keyed BLAKE2b
+// and BLAKE2s, and EncryptedName. Without the key, chunk names do not allow
+// confirming guesses about the paths they come from. FNV has no HMAC variant:
+// it is not a cryptographic hash, so keying it would not prevent that.
+var keyedHashFuncs = map[string]KeyedHashFunc{
+	EncryptedName:     encryptedBase32Func,
+	"blake2b-256-b32": blake2HashFunc(blake2b.New256, blake2b.Size, b32),
+	"blake2b-256-b64": blake2HashFunc(blake2b.New256, blake2b.Size, b64),
+	"blake2b-512-b32": blake2HashFunc(blake2b.New512, blake2b.Size, b32),
+	"blake2b-512-b64": blake2HashFunc(blake2b.New512, blake2b.Size, b64),
+	"blake2s-256-b32": blake2HashFunc(blake2s.New256, blake2s.Size, b32),
+	"blake2s-256-b64": blake2HashFunc(blake2s.New256, blake2s.Size, b64),
+	"hmac-sha224-b32": hmacHashFunc(sha256.New224, b32),
+	"hmac-sha224-b64": hmacHashFunc(sha256.New224, b64),
+	"hmac-sha256-b32": hmacHashFunc(sha256.New, b32),
+	"hmac-sha256-b64": hmacHashFunc(sha256.New, b64),
+	"hmac-sha384-b32": hmacHashFunc(sha512.New384, b32),
+	"hmac-sha384-b64": hmacHashFunc(sha512.New384, b64),
+	"hmac-sha512-b32": hmacHashFunc(sha512.New, b32),
+	"hmac-sha512-b64": hmacHashFunc(sha512.New, b64),
+}
+
+// MinKeySize is the minimum size of the key of keyed hash functions, in bytes.
+const MinKeySize = 16
+
 // List of all hash functions.
 var HashNames []string
 
+// List of all keyed hash functions.
+var KeyedHashNames []string
+
 func GetHashFunc(name string) HashFunc {
 	return hashFuncs[name]
 }
 
+// IsKeyed reports whether name is the name of a keyed hash function.
+func IsKeyed(name string) bool {
+	_, ok := keyedHashFuncs[name]
+	return ok
+}
+
+// GetKeyedHashFunc returns the keyed hash function with the given name,
+// using the given key.
+func GetKeyedHashFunc(name string, key []byte) (HashFunc, error) {
+	keyedHashFunc, ok := keyedHashFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyed hash function %q", name)
+	}
+	if len(key) < MinKeySize {
+		return nil, fmt.Errorf("key is %d bytes long, but must be at least %d bytes long", len(key), MinKeySize)
+	}
+	return keyedHashFunc(key)
+}
+
 func init() {
 	HashNames = make([]string, 0, len(hashFuncs))
 	for hashName := range hashFuncs {
 		HashNames = append(HashNames, hashName)
 	}
 	sort.Strings(HashNames)
+	KeyedHashNames = make([]string, 0, len(keyedHashFuncs))
+	for hashName := range keyedHashFuncs {
+		KeyedHashNames = append(KeyedHashNames, hashName)
+	}
+	sort.Strings(KeyedHashNames)
 }
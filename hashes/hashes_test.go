@@ -0,0 +1,95 @@
+package hashes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// sequentialKey returns a key of the given size made of the bytes 0, 1, 2...
+// as in the BLAKE2 test vectors.
+func sequentialKey(size int) []byte {
+	key := make([]byte, size)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+// TestKeyedHashes checks keyed hashes against known answers: test case 1 of
+// RFC 4231 for HMAC-SHA256, and the first keyed test vectors of the BLAKE2
+// reference implementation.
+func TestKeyedHashes(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		key     []byte
+		message string
+		sum     string
+	}{
+		{"hmac-sha256-b32", bytes.Repeat([]byte{0x0b}, 20), "Hi There", "b0344c61 d8db3853 5ca8afce af0bf12b 881dc200 c9833da7 26e9376c 2e32cff7"},
+		{"hmac-sha256-b64", bytes.Repeat([]byte{0x0b}, 20), "Hi There", "b0344c61 d8db3853 5ca8afce af0bf12b 881dc200 c9833da7 26e9376c 2e32cff7"},
+		{"blake2b-512-b32", sequentialKey(64), "", "10ebb677 00b1868e fb441798 7acf4690 ae9d972f b7a590c2 f0287179 9aaa4786 b5e996e8 f0f4eb98 1fc214b0 05f42d2f f4233499 391653df 7aefcbc1 3fc51568"},
+		{"blake2s-256-b64", sequentialKey(32), "", "48a8997d a407876b 3d79c0d9 2325ad3b 89cbb754 d86ab71a ee047ad3 45fd2c49"},
+	} {
+		hashFunc, err := GetKeyedHashFunc(test.name, test.key)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		h := hashFunc()
+		h.Write([]byte(test.message))
+		sum := unhex(t, test.sum)
+		want := base32Encoding.EncodeToString(sum)
+		if strings.HasSuffix(test.name, "-b64") {
+			want = base64Encoding.EncodeToString(sum)
+		}
+		digest, inode := h.Digest()
+		if digest != want {
+			t.Errorf("%s digest = %s, want %s", test.name, digest, want)
+		}
+		if wantInode := binary.LittleEndian.Uint64(sum); inode != wantInode {
+			t.Errorf("%s inode hash = %#x, want %#x", test.name, inode, wantInode)
+		}
+	}
+}
+
+func TestKeyedHashesRejectKeys(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		keySize int
+	}{
+		{"hmac-sha256-b32", MinKeySize - 1},
+		{EncryptedName, MinKeySize - 1},
+		{"blake2b-256-b32", MinKeySize - 1},
+		{"blake2b-256-b32", 65},
+		{"blake2s-256-b32", 33},
+	} {
+		if _, err := GetKeyedHashFunc(test.name, make([]byte, test.keySize)); err == nil {
+			t.Errorf("%s accepted a %d-byte key", test.name, test.keySize)
+		}
+	}
+	if _, err := GetKeyedHashFunc("sha256-b32", make([]byte, MinKeySize)); err == nil {
+		t.Error("unkeyed sha256-b32 was returned as a keyed hash function")
+	}
+}
+
+func TestKeyedHashesDependOnKey(t *testing.T) {
+	for _, name := range KeyedHashNames {
+		var digests []string
+		for _, key := range [][]byte{sequentialKey(MinKeySize), sequentialKey(MinKeySize + 1), make([]byte, MinKeySize)} {
+			hashFunc, err := GetKeyedHashFunc(name, key)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			h := hashFunc()
+			h.Write([]byte("dir/file.bin"))
+			digest, _ := h.Digest()
+			for _, other := range digests {
+				if digest == other {
+					t.Errorf("%s gives the same name %s with different keys", name, digest)
+				}
+			}
+			digests = append(digests, digest)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package hashes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// EncryptedName is the name of the keyed "hash" function that encrypts
+// names instead of hashing them, so that they can be decrypted with the key.
+const EncryptedName = "aes-siv-b32"
+
+// sivKeys derives the two AES-256 keys of AES-SIV from a key of any length.
+func sivKeys(key []byte) (macKey, ctrKey []byte) {
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(label))
+		return h.Sum(nil)
+	}
+	return derive("splitfs aes-siv mac"), derive("splitfs aes-siv ctr")
+}
+
+// xorBytes sets dst[i] = a[i] ^ b[i] for all i < len(b).
+func xorBytes(dst, a, b []byte) {
+	for i := range b {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+// dbl doubles a block in GF(2^128), as defined in RFC 4493.
+func dbl(block []byte) []byte {
+	doubled := make([]byte, len(block))
+	carry := byte(0)
+	for i := len(block) - 1; i >= 0; i-- {
+		doubled[i] = block[i]<<1 | carry
+		carry = block[i] >> 7
+	}
+	if carry != 0 {
+		doubled[len(block)-1] ^= 0x87
+	}
+	return doubled
+}
+
+// cmac computes the AES-CMAC of the message, as defined in RFC 4493.
+func cmac(c cipher.Block, message []byte) []byte {
+	l := make([]byte, aes.BlockSize)
+	c.Encrypt(l, l)
+	k1 := dbl(l)
+	k2 := dbl(k1)
+	n := (len(message) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(message)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, aes.BlockSize)
+	copy(last, message[(n-1)*aes.BlockSize:])
+	if complete {
+		xorBytes(last, last, k1)
+	} else {
+		last[len(message)-(n-1)*aes.BlockSize] = 0x80
+		xorBytes(last, last, k2)
+	}
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		xorBytes(x, x, message[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		c.Encrypt(x, x)
+	}
+	xorBytes(x, x, last)
+	c.Encrypt(x, x)
+	return x
+}
+
+// s2v computes the synthetic IV of the plaintext and associated data, as
+// defined in RFC 5297. Names are encrypted without associated data.
+func s2v(c cipher.Block, plaintext []byte, associatedData ...[]byte) []byte {
+	d := cmac(c, make([]byte, aes.BlockSize))
+	for _, data := range associatedData {
+		d = dbl(d)
+		xorBytes(d, d, cmac(c, data))
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = append([]byte(nil), plaintext...)
+		xorBytes(t[len(t)-aes.BlockSize:], t[len(t)-aes.BlockSize:], d)
+	} else {
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		xorBytes(t, t, dbl(d))
+	}
+	return cmac(c, t)
+}
+
+// sivCTR encrypts or decrypts data in counter mode, starting from the
+// synthetic IV with the bits cleared as required by RFC 5297.
+func sivCTR(c cipher.Block, iv, data []byte) []byte {
+	q := append([]byte(nil), iv...)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	out := make([]byte, len(data))
+	cipher.NewCTR(c, q).XORKeyStream(out, data)
+	return out
+}
+
+// sivCipher encrypts names deterministically with AES-SIV.
+type sivCipher struct {
+	mac, ctr cipher.Block
+}
+
+func newSIVCipher(key []byte) *sivCipher {
+	macKey, ctrKey := sivKeys(key)
+	mac, _ := aes.NewCipher(macKey)
+	ctr, _ := aes.NewCipher(ctrKey)
+	return &sivCipher{mac, ctr}
+}
+
+func (s *sivCipher) seal(plaintext []byte) []byte {
+	iv := s2v(s.mac, plaintext)
+	return append(iv, sivCTR(s.ctr, iv, plaintext)...)
+}
+
+func (s *sivCipher) open(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	iv := ciphertext[:aes.BlockSize]
+	plaintext := sivCTR(s.ctr, iv, ciphertext[aes.BlockSize:])
+	if !hmac.Equal(s2v(s.mac, plaintext), iv) {
+		return nil, errors.New("authentication failed; wrong key?")
+	}
+	return plaintext, nil
+}
+
+// encryptedBase32 encrypts everything written to it, and returns the
+// ciphertext as its digest. Unlike hashes, the digest grows with the input.
+type encryptedBase32 struct {
+	cipher *sivCipher
+	buf    bytes.Buffer
+}
+
+func (e *encryptedBase32) Write(p []byte) (int, error) {
+	return e.buf.Write(p)
+}
+
+func (e *encryptedBase32) Digest() (string, uint64) {
+	ciphertext := e.cipher.seal(e.buf.Bytes())
+	return base32Encoding.EncodeToString(ciphertext), binary.LittleEndian.Uint64(ciphertext)
+}
+
+func encryptedBase32Func(key []byte) (HashFunc, error) {
+	c := newSIVCipher(key)
+	return func() Hash { return &encryptedBase32{cipher: c} }, nil
+}
+
+// DecryptName returns the name that was encrypted into the given digest by
+// the EncryptedName function with the given key.
+func DecryptName(digest string, key []byte) (string, error) {
+	if len(key) < MinKeySize {
+		return "", fmt.Errorf("key is %d bytes long, but must be at least %d bytes long", len(key), MinKeySize)
+	}
+	ciphertext, err := base32Encoding.DecodeString(digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted name: %v", err)
+	}
+	plaintext, err := newSIVCipher(key).open(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt name: %v", err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,169 @@
+package hashes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// unhex decodes hexadecimal test vectors, ignoring spaces.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestCMAC checks cmac against the test vectors of RFC 4493, section 4.
+func TestCMAC(t *testing.T) {
+	c, err := aes.NewCipher(unhex(t, "2b7e1516 28aed2a6 abf71588 09cf4f3c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := make([]byte, aes.BlockSize)
+	c.Encrypt(l, l)
+	if k1, want := dbl(l), unhex(t, "fbeed618 35713366 7c85e08f 7236a8de"); !bytes.Equal(k1, want) {
+		t.Errorf("K1 = %x, want %x", k1, want)
+	}
+	if k2, want := dbl(dbl(l)), unhex(t, "f7ddac30 6ae266cc f90bc11e e46d513b"); !bytes.Equal(k2, want) {
+		t.Errorf("K2 = %x, want %x", k2, want)
+	}
+	message := unhex(t, "6bc1bee2 2e409f96 e93d7e11 7393172a"+
+		"ae2d8a57 1e03ac9c 9eb76fac 45af8e51"+
+		"30c81c46 a35ce411 e5fbc119 1a0a52ef"+
+		"f69f2445 df4f9b17 ad2b417b e66c3710")
+	for _, test := range []struct {
+		length int
+		want   string
+	}{
+		{0, "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{16, "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{40, "dfa66747 de9ae630 30ca3261 1497c827"},
+		{64, "51f0bebf 7e3b9d92 fc497417 79363cfe"},
+	} {
+		if got, want := cmac(c, message[:test.length]), unhex(t, test.want); !bytes.Equal(got, want) {
+			t.Errorf("AES-CMAC of %d bytes = %x, want %x", test.length, got, want)
+		}
+	}
+}
+
+// TestSIV checks s2v and sivCTR against the test vectors of RFC 5297,
+// appendix A.
+func TestSIV(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		key            string
+		associatedData []string
+		plaintext      string
+		iv, ciphertext string
+	}{
+		{
+			name: "deterministic authenticated encryption",
+			key: "fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0" +
+				"f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff",
+			associatedData: []string{
+				"10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627",
+			},
+			plaintext:  "11223344 55667788 99aabbcc ddee",
+			iv:         "85632d07 c6e8f37f 950acd32 0a2ecc93",
+			ciphertext: "40c02b96 90c4dc04 daef7f6a fe5c",
+		},
+		{
+			name: "nonce-based authenticated encryption",
+			key: "7f7e7d7c 7b7a7978 77767574 73727170" +
+				"40414243 44454647 48494a4b 4c4d4e4f",
+			associatedData: []string{
+				"00112233 44556677 8899aabb ccddeeff deaddada deaddada ffeeddcc bbaa9988 77665544 33221100",
+				"10203040 50607080 90a0",
+				// The nonce is the last component of associated data.
+				"09f91102 9d74e35b d84156c5 635688c0",
+			},
+			plaintext: "74686973 20697320 736f6d65 20706c61 696e7465 78742074" +
+				"6f20656e 63727970 74207573 696e6720 5349562d 414553",
+			iv: "7bdb6e3b 432667eb 06f4d14b ff2fbd0f",
+			ciphertext: "cb900f2f ddbe4043 26601965 c889bf17 dba77ceb 094fa663" +
+				"b7a3f748 ba8af829 ea64ad54 4a272e9c 485b62a3 fd5c0d",
+		},
+	} {
+		key := unhex(t, test.key)
+		mac, err := aes.NewCipher(key[:len(key)/2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctr, err := aes.NewCipher(key[len(key)/2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var associatedData [][]byte
+		for _, data := range test.associatedData {
+			associatedData = append(associatedData, unhex(t, data))
+		}
+		plaintext := unhex(t, test.plaintext)
+		iv := s2v(mac, plaintext, associatedData...)
+		if want := unhex(t, test.iv); !bytes.Equal(iv, want) {
+			t.Errorf("%s: S2V = %x, want %x", test.name, iv, want)
+		}
+		if got, want := sivCTR(ctr, iv, plaintext), unhex(t, test.ciphertext); !bytes.Equal(got, want) {
+			t.Errorf("%s: ciphertext = %x, want %x", test.name, got, want)
+		}
+	}
+}
+
+func TestSIVRoundTrip(t *testing.T) {
+	c := newSIVCipher([]byte("0123456789abcdef"))
+	for _, plaintext := range []string{"", "a", "exactly 16 bytes", "some/directory/a file name longer than a block"} {
+		ciphertext := c.seal([]byte(plaintext))
+		if len(ciphertext) != aes.BlockSize+len(plaintext) {
+			t.Errorf("seal(%q) is %d bytes long, want %d", plaintext, len(ciphertext), aes.BlockSize+len(plaintext))
+		}
+		if again := c.seal([]byte(plaintext)); !bytes.Equal(again, ciphertext) {
+			t.Errorf("seal(%q) is not deterministic", plaintext)
+		}
+		opened, err := c.open(ciphertext)
+		if err != nil {
+			t.Errorf("open(seal(%q)) = %v", plaintext, err)
+		} else if string(opened) != plaintext {
+			t.Errorf("open(seal(%q)) = %q", plaintext, opened)
+		}
+		tampered := append([]byte(nil), ciphertext...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := c.open(tampered); err == nil {
+			t.Errorf("open of tampered seal(%q) succeeded", plaintext)
+		}
+	}
+	if _, err := c.open(make([]byte, aes.BlockSize-1)); err == nil {
+		t.Error("open of a short ciphertext succeeded")
+	}
+}
+
+func TestDecryptName(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	hashFunc, err := GetKeyedHashFunc(EncryptedName, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name = "photos/2018/IMG_0001.jpg"
+	h := hashFunc()
+	h.Write([]byte(name))
+	digest, _ := h.Digest()
+	decrypted, err := DecryptName(digest, key)
+	if err != nil {
+		t.Fatalf("DecryptName(%q) = %v", digest, err)
+	}
+	if decrypted != name {
+		t.Errorf("DecryptName(%q) = %q, want %q", digest, decrypted, name)
+	}
+	if _, err := DecryptName(digest, []byte("fedcba9876543210")); err == nil {
+		t.Error("DecryptName with the wrong key succeeded")
+	}
+	if _, err := DecryptName(digest, key[:MinKeySize-1]); err == nil {
+		t.Error("DecryptName with a short key succeeded")
+	}
+	if _, err := DecryptName("not base32!", key); err == nil {
+		t.Error("DecryptName of an invalid digest succeeded")
+	}
+}
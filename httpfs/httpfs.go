@@ -0,0 +1,177 @@
+// Package httpfs serves the chunked view of package split over HTTP, for
+// consumers that cannot mount FUSE filesystems. It is built on the io/fs
+// view of the filesystem, split.IOFS, so it serves the same tree as the
+// mountpoint.
+package httpfs
+
+import (
+	"encoding/json"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"perot.me/splitfs/split"
+)
+
+// entry describes a node in JSON directory listings.
+type entry struct {
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Size   uint64    `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	Target string    `json:"target,omitempty"`
+}
+
+// nodeType returns the type of a node, as reported to clients.
+func nodeType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode.IsRegular():
+		return "file"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "other"
+}
+
+// handler serves a filesystem over HTTP.
+type handler struct {
+	view *split.IOFS
+}
+
+// Handler returns a handler that serves the given view over HTTP,
+// read-only. GET and HEAD requests for regular files, such as chunks, serve
+// their content, and support ranges and conditional requests; the entity
+// tag and the last modification time are those of the source file.
+// Directories are listed as a JSON array of objects with the name, type,
+// size, mtime and, for symlinks, target of each entry. Symlinks are
+// described by such an object themselves, rather than followed.
+func Handler(view *split.IOFS) http.Handler {
+	return &handler{view: view}
+}
+
+// newEntry describes the node with the given name, and the given
+// information, for JSON responses.
+func (h *handler) newEntry(name string, info iofs.FileInfo) (*entry, error) {
+	attr := info.Sys().(*split.Attr)
+	e := &entry{
+		Name:  info.Name(),
+		Type:  nodeType(attr.Mode),
+		Size:  attr.Size,
+		Mtime: attr.Mtime,
+	}
+	if attr.Mode&os.ModeSymlink != 0 {
+		var err error
+		if e.Target, err = h.view.ReadLink(name); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "read-only filesystem", http.StatusMethodNotAllowed)
+		return
+	}
+	name := split.CleanPath(r.URL.Path)
+	info, err := h.view.Lstat(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// The name is escaped, and prefixed with "./" if it looks like
+			// a scheme.
+			target := &url.URL{Path: path.Base(r.URL.Path) + "/", RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+		h.serveDirectory(w, name, info)
+	case mode.IsRegular():
+		h.serveFile(w, r, name, info)
+	case mode&os.ModeSymlink != 0:
+		e, err := h.newEntry(name, info)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		writeJSON(w, e)
+	default:
+		http.Error(w, "not a regular file", http.StatusForbidden)
+	}
+}
+
+// serveDirectory lists the directory with the given name.
+func (h *handler) serveDirectory(w http.ResponseWriter, name string, info iofs.FileInfo) {
+	dirEntries, err := h.view.ReadDir(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	entries := make([]*entry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		// Entries that disappear while the directory is read are left out.
+		entryInfo, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		e, err := h.newEntry(path.Join(name, dirEntry.Name()), entryInfo)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	writeJSON(w, entries)
+}
+
+// serveFile serves the content of the regular file with the given name.
+func (h *handler) serveFile(w http.ResponseWriter, r *http.Request, name string, info iofs.FileInfo) {
+	file, err := h.view.Open(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("ETag", info.Sys().(*split.Attr).ETag())
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file.(io.ReadSeeker))
+}
+
+// writeJSON writes the given value as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// httpStatus returns the HTTP status code for an error returned by
+// split.IOFS.
+func httpStatus(err error) int {
+	switch split.Errno(err) {
+	case syscall.ENOENT, syscall.ENOTDIR:
+		return http.StatusNotFound
+	case syscall.EACCES, syscall.EPERM, syscall.EISDIR:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// httpError replies to the request with the status code for the given error.
+func httpError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), httpStatus(err))
+}
@@ -0,0 +1,43 @@
+package httpfs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"perot.me/splitfs/split"
+)
+
+func TestHTTPDirectoryRedirect(t *testing.T) {
+	source := t.TempDir()
+	names := []string{"plain", "a b", "what?", "50%", "#hash", "c:d"}
+	for _, name := range names {
+		if err := os.Mkdir(filepath.Join(source, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := split.NewFS(source, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		requestURL := &url.URL{Path: "/" + name}
+		w := httptest.NewRecorder()
+		Handler(f.IOFS()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, requestURL.String(), nil))
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("GET %s: status %d, want %d", requestURL, w.Code, http.StatusMovedPermanently)
+			continue
+		}
+		location, err := requestURL.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Errorf("GET %s: invalid Location %q: %v", requestURL, w.Header().Get("Location"), err)
+			continue
+		}
+		if location.Path != "/"+name+"/" || location.RawQuery != "" || location.Fragment != "" {
+			t.Errorf("GET %s: redirected to %q, which resolves to %q", requestURL, w.Header().Get("Location"), location)
+		}
+	}
+}
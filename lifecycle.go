@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// unmountPollInterval is how often unmount checks whether open handles
+// have been released.
+const unmountPollInterval = 100 * time.Millisecond
+
+// wait blocks until the filesystem stops being served, and returns the
+// error that stopped it, if any.
+func (m *mountedFS) wait() error {
+	<-m.done
+	return m.err
+}
+
+// isServing reports whether the filesystem is still being served.
+func (m *mountedFS) isServing() bool {
+	select {
+	case <-m.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// unmount unmounts the filesystem. Open handles are given until timeout to
+// be released. After that, the filesystem is lazily detached: processes
+// that still hold handles on it will see errors, but the mountpoint is
+// usable again.
+func (m *mountedFS) unmount(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for m.isServing() {
+		if m.splitFS.OpenHandles() == 0 {
+			if err := fuse.Unmount(m.mountpoint); err == nil {
+				return m.wait()
+			}
+		}
+		if time.Now().After(deadline) {
+			log.Printf("%s: %d handles still open after %v; detaching", m.mountpoint, m.splitFS.OpenHandles(), timeout)
+			err := lazyUnmount(m.mountpoint)
+			m.conn.Close()
+			return err
+		}
+		time.Sleep(unmountPollInterval)
+	}
+	return m.wait()
+}
+
+// lazyUnmount detaches the filesystem at the given mountpoint, even if it
+// is busy. It uses fusermount3 or fusermount, whichever is installed, and
+// falls back to detaching it directly, which only works as root.
+func lazyUnmount(mountpoint string) error {
+	var errs []string
+	for _, command := range []string{"fusermount3", "fusermount"} {
+		commandPath, err := exec.LookPath(command)
+		if err != nil {
+			continue
+		}
+		output, err := exec.Command(commandPath, "-u", "-z", mountpoint).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v: %s", command, err, bytes.TrimSpace(output)))
+	}
+	if err := syscall.Unmount(mountpoint, syscall.MNT_DETACH); err != nil {
+		errs = append(errs, fmt.Sprintf("umount2: %v", err))
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// unmountAll unmounts all the given filesystems concurrently.
+func unmountAll(mounted []*mountedFS, timeout time.Duration) {
+	errs := make(chan error, len(mounted))
+	for _, m := range mounted {
+		go func(m *mountedFS) {
+			if err := m.unmount(timeout); err != nil {
+				errs <- fmt.Errorf("%s: cannot unmount: %v", m.mountpoint, err)
+				return
+			}
+			errs <- nil
+		}(m)
+	}
+	for range mounted {
+		if err := <-errs; err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// writePidfile writes the current process ID to the given file.
+func writePidfile(path string) error {
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel is the verbosity of the log. It implements flag.Value.
+// It must be accessed atomically, as it can change on reload.
+type logLevel int32
+
+const (
+	levelError logLevel = iota
+	levelInfo
+	levelDebug
+)
+
+var logLevelNames = []string{"error", "info", "debug"}
+
+// currentLogLevel is the verbosity set by the --log_level flag.
+var currentLogLevel = levelInfo
+
+func (l *logLevel) get() logLevel {
+	return logLevel(atomic.LoadInt32((*int32)(l)))
+}
+
+func (l *logLevel) String() string {
+	return logLevelNames[l.get()]
+}
+
+func (l *logLevel) Set(value string) error {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(value, name) {
+			atomic.StoreInt32((*int32)(l), int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q; must be one of %v", value, logLevelNames)
+}
+
+// infof logs an informational message.
+func infof(format string, v ...interface{}) {
+	if currentLogLevel.get() >= levelInfo {
+		log.Printf(format, v...)
+	}
+}
+
+// debugf logs a debugging message.
+func debugf(format string, v ...interface{}) {
+	if currentLogLevel.get() >= levelDebug {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"perot.me/splitfs/split"
+)
+
+// metricsHandler serves the metrics of the given mounts in the Prometheus
+// text exposition format.
+func metricsHandler(mounted []*mountedFS) http.Handler {
+	filesystems := make(map[string]*split.FS, len(mounted))
+	for _, m := range mounted {
+		filesystems[m.mountpoint] = m.splitFS
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		split.WritePrometheusMetrics(w, filesystems)
+	})
+}
+
+// serveMetrics exports the metrics of the given mounts on /metrics.
+// If hostPort is the same as the pprof one, the pprof listener is reused.
+func serveMetrics(hostPort, pprofHostPort string, mounted []*mountedFS) error {
+	if hostPort == pprofHostPort {
+		http.Handle("/metrics", metricsHandler(mounted))
+		return nil
+	}
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(mounted))
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mountHelperIgnoredOptions are mount(8) options that are meaningful to
+// mount(8), fstab or systemd but not to splitfs itself.
+// "dev" and "suid" are dropped too: fusermount always mounts with nodev and
+// nosuid unless given them, so that device nodes and setuid executables
+// mirrored from the source directory are inert.
+var mountHelperIgnoredOptions = map[string]bool{
+	"auto":     true,
+	"defaults": true,
+	"dev":      true,
+	"exec":     true,
+	"noauto":   true,
+	"nodev":    true,
+	"noexec":   true,
+	"nofail":   true,
+	"nosuid":   true,
+	"nouser":   true,
+	"rw":       true,
+	"suid":     true,
+	"user":     true,
+	"users":    true,
+	"_netdev":  true,
+}
+
+// mountHelperIgnoredPrefixes are prefixes of mount(8) options that are
+// ignored, such as systemd-specific ones.
+var mountHelperIgnoredPrefixes = []string{"x-", "comment=", "subtype=", "fsname="}
+
+// isMountHelper reports whether the program was invoked as a mount(8) helper,
+// either directly as "mount.splitfs" or by mount.fuse as "splitfs".
+// mount(8) calls helpers as: <helper> <source> <mountpoint> [-sfnv] [-o options].
+func isMountHelper(args []string) bool {
+	if strings.HasPrefix(progName, "mount.") {
+		return true
+	}
+	if len(args) < 3 || strings.HasPrefix(args[0], "-") || strings.HasPrefix(args[1], "-") {
+		return false
+	}
+	for _, arg := range args[2:] {
+		if arg == "-o" || strings.HasPrefix(arg, "-o") {
+			return true
+		}
+	}
+	return false
+}
+
+// mountHelperArgs converts mount(8) helper arguments into regular
+// command-line arguments for the flag package.
+// Each -o option must be the name of a flag, optionally followed by "=value";
+// boolean flags may omit the value. If fake is true, mount(8) asked us to do
+// everything except actually mounting.
+func mountHelperArgs(args []string, isFlag func(name string) bool) (flagArgs []string, fake bool, err error) {
+	var positional []string
+	var options []string
+	sloppy := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o":
+			if i+1 >= len(args) {
+				return nil, false, fmt.Errorf("-o requires an argument")
+			}
+			i++
+			options = append(options, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(arg, "-o"):
+			options = append(options, strings.Split(strings.TrimPrefix(arg, "-o"), ",")...)
+		case arg == "-t" || arg == "-N":
+			// Filesystem type and namespace; the type is implied, and
+			// namespaces are handled by mount(8) before calling us.
+			i++
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for _, c := range arg[1:] {
+				switch c {
+				case 's':
+					sloppy = true
+				case 'f':
+					fake = true
+				case 'n', 'v':
+				default:
+					return nil, false, fmt.Errorf("unsupported mount helper flag -%c", c)
+				}
+			}
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, false, fmt.Errorf("expected a source directory and a target mountpoint, got %d arguments", len(positional))
+	}
+	for _, option := range options {
+		if option == "" || mountHelperIgnoredOptions[option] {
+			continue
+		}
+		ignored := false
+		for _, prefix := range mountHelperIgnoredPrefixes {
+			if strings.HasPrefix(option, prefix) {
+				ignored = true
+				break
+			}
+		}
+		if ignored {
+			continue
+		}
+		name := option
+		if equals := strings.Index(option, "="); equals != -1 {
+			name = option[:equals]
+		}
+		if !isFlag(name) {
+			if sloppy {
+				continue
+			}
+			return nil, false, fmt.Errorf("unknown mount option %q", name)
+		}
+		flagArgs = append(flagArgs, "--"+option)
+	}
+	return append(flagArgs, positional...), fake, nil
+}
+
+// parseMountHelperArgs parses the arguments of a mount(8) helper invocation
+// into the global flags. If mount(8) asked for a fake mount, it exits
+// successfully without mounting anything.
+func parseMountHelperArgs() {
+	flagArgs, fake, err := mountHelperArgs(os.Args[1:], func(name string) bool {
+		return flag.Lookup(name) != nil
+	})
+	if err == nil {
+		err = flag.CommandLine.Parse(flagArgs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", progName, err)
+		os.Exit(1)
+	}
+	if fake {
+		os.Exit(0)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMountHelperArgsDropsDevAndSuid(t *testing.T) {
+	isFlag := func(name string) bool { return name == "chunk_size" }
+	args := []string{"/source", "/mnt", "-o", "rw,dev,suid,chunk_size=1MiB"}
+	flagArgs, fake, err := mountHelperArgs(args, isFlag)
+	if err != nil {
+		t.Fatalf("mountHelperArgs(%q) = %v", args, err)
+	}
+	if fake {
+		t.Errorf("mountHelperArgs(%q) reported a fake mount", args)
+	}
+	if want := []string{"--chunk_size=1MiB", "/source", "/mnt"}; !reflect.DeepEqual(flagArgs, want) {
+		t.Errorf("mountHelperArgs(%q) = %q, want %q", args, flagArgs, want)
+	}
+}
+
+func TestMountHelperArgs(t *testing.T) {
+	flags := map[string]bool{"chunk_size": true, "filename_hash": true, "ro": true, "allow_other": true, "hide_special_files": true}
+	isFlag := func(name string) bool { return flags[name] }
+	for _, test := range []struct {
+		name string
+		args []string
+		want []string
+		fake bool
+		// err is part of the expected error, if any.
+		err string
+	}{
+		{
+			name: "values and boolean flags",
+			args: []string{"/source", "/mnt", "-o", "chunk_size=10MiB,hide_special_files,filename_hash=sha256-b32"},
+			want: []string{"--chunk_size=10MiB", "--hide_special_files", "--filename_hash=sha256-b32", "/source", "/mnt"},
+		},
+		{
+			name: "attached -o and several -o",
+			args: []string{"/source", "/mnt", "-ochunk_size=1MiB", "-o", "ro"},
+			want: []string{"--chunk_size=1MiB", "--ro", "/source", "/mnt"},
+		},
+		{
+			name: "ro and allow_other pass through",
+			args: []string{"/source", "/mnt", "-o", "ro,allow_other"},
+			want: []string{"--ro", "--allow_other", "/source", "/mnt"},
+		},
+		{
+			name: "options ignored for mount(8) and systemd",
+			args: []string{"/source", "/mnt", "-o", "defaults,noauto,nofail,_netdev,x-systemd.automount,comment=x,,ro"},
+			want: []string{"--ro", "/source", "/mnt"},
+		},
+		{
+			name: "type and verbose flags",
+			args: []string{"/source", "/mnt", "-t", "fuse.splitfs", "-nv", "-o", "ro"},
+			want: []string{"--ro", "/source", "/mnt"},
+		},
+		{
+			name: "fake mount",
+			args: []string{"/source", "/mnt", "-f", "-o", "ro"},
+			want: []string{"--ro", "/source", "/mnt"},
+			fake: true,
+		},
+		{
+			name: "sloppy mount skips unknown options",
+			args: []string{"/source", "/mnt", "-s", "-o", "mode=0755,ro"},
+			want: []string{"--ro", "/source", "/mnt"},
+		},
+		{
+			name: "sloppy fake mount",
+			args: []string{"/source", "/mnt", "-sf", "-o", "mode=0755"},
+			want: []string{"/source", "/mnt"},
+			fake: true,
+		},
+		{
+			name: "unknown option",
+			args: []string{"/source", "/mnt", "-o", "ro,mode=0755"},
+			err:  `unknown mount option "mode"`,
+		},
+		{
+			name: "unknown helper flag",
+			args: []string{"/source", "/mnt", "-w"},
+			err:  "unsupported mount helper flag -w",
+		},
+		{
+			name: "missing -o argument",
+			args: []string{"/source", "/mnt", "-o"},
+			err:  "-o requires an argument",
+		},
+		{
+			name: "missing mountpoint",
+			args: []string{"/source", "-o", "ro"},
+			err:  "got 1 arguments",
+		},
+	} {
+		flagArgs, fake, err := mountHelperArgs(test.args, isFlag)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: mountHelperArgs(%q) = %v, want an error about %q", test.name, test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: mountHelperArgs(%q) = %v", test.name, test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(flagArgs, test.want) || fake != test.fake {
+			t.Errorf("%s: mountHelperArgs(%q) = %q, fake %v, want %q, fake %v", test.name, test.args, flagArgs, fake, test.want, test.fake)
+		}
+	}
+}
+
+func TestIsMountHelper(t *testing.T) {
+	defer func(name string) { progName = name }(progName)
+	for _, test := range []struct {
+		progName string
+		args     []string
+		want     bool
+	}{
+		{"mount.splitfs", []string{"/source", "/mnt"}, true},
+		{"splitfs", []string{"/source", "/mnt", "-o", "ro"}, true},
+		{"splitfs", []string{"/source", "/mnt", "-oro"}, true},
+		{"splitfs", []string{"/source", "/mnt", "-n", "-o", "ro"}, true},
+		{"splitfs", []string{"/source", "/mnt"}, false},
+		{"splitfs", []string{"--chunk_size=1MiB", "/source", "/mnt"}, false},
+		{"splitfs", []string{"-o", "ro", "/source", "/mnt"}, false},
+		{"splitfs", []string{"/source", "--ro", "/mnt"}, false},
+	} {
+		progName = test.progName
+		if got := isMountHelper(test.args); got != test.want {
+			t.Errorf("isMountHelper(%q) as %s = %v, want %v", test.args, test.progName, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+// Package ninepfs serves the chunked view of package split over the
+// 9P2000.L protocol, read-only, for virtual machines and containers that
+// mount it with the Linux v9fs client. It is built on the io/fs view of the
+// filesystem, split.IOFS, so it serves the same tree as the mountpoint.
+package ninepfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"perot.me/splitfs/split"
+)
+
+// Message types of the 9P2000.L protocol, as described in the diod
+// protocol documentation and the Linux v9fs client.
+const (
+	p9Rlerror     = 7
+	p9Tstatfs     = 8
+	p9Rstatfs     = 9
+	p9Tlopen      = 12
+	p9Rlopen      = 13
+	p9Tlcreate    = 14
+	p9Tsymlink    = 16
+	p9Tmknod      = 18
+	p9Trename     = 20
+	p9Treadlink   = 22
+	p9Rreadlink   = 23
+	p9Tgetattr    = 24
+	p9Rgetattr    = 25
+	p9Tsetattr    = 26
+	p9Txattrwalk  = 30
+	p9Txattrcreat = 32
+	p9Treaddir    = 40
+	p9Rreaddir    = 41
+	p9Tfsync      = 50
+	p9Rfsync      = 51
+	p9Tmkdir      = 72
+	p9Trenameat   = 74
+	p9Tunlinkat   = 76
+	p9Tlink       = 70
+	p9Tversion    = 100
+	p9Rversion    = 101
+	p9Tauth       = 102
+	p9Tattach     = 104
+	p9Rattach     = 105
+	p9Tflush      = 108
+	p9Rflush      = 109
+	p9Twalk       = 110
+	p9Rwalk       = 111
+	p9Tread       = 116
+	p9Rread       = 117
+	p9Twrite      = 118
+	p9Tclunk      = 120
+	p9Rclunk      = 121
+	p9Tremove     = 122
+)
+
+const (
+	// p9Version is the only version of the protocol that is supported.
+	p9Version = "9P2000.L"
+	// p9MaxMessageSize and p9MinMessageSize bound the size of messages
+	// that clients may negotiate.
+	p9MaxMessageSize = 1 << 20
+	p9MinMessageSize = 4096
+	// p9IOHeaderSize is the size of the header of Rread messages, which
+	// leaves the rest of a message for data.
+	p9IOHeaderSize = 24
+	// p9GetattrBasic are the fields of Rgetattr messages that are set.
+	p9GetattrBasic = 0x7ff
+	// p9MaxWalk is the maximum number of names walked at once.
+	p9MaxWalk = 16
+
+	p9QidDirectory = 0x80
+	p9QidSymlink   = 0x02
+	p9QidFile      = 0x00
+)
+
+// errP9BadMessage is returned for malformed messages.
+var errP9BadMessage = errors.New("malformed 9P message")
+
+// p9Message parses the fields of a message.
+type p9Message []byte
+
+func (m *p9Message) uint8() (uint8, error) {
+	if len(*m) < 1 {
+		return 0, errP9BadMessage
+	}
+	v := (*m)[0]
+	*m = (*m)[1:]
+	return v, nil
+}
+
+func (m *p9Message) uint16() (uint16, error) {
+	if len(*m) < 2 {
+		return 0, errP9BadMessage
+	}
+	v := binary.LittleEndian.Uint16(*m)
+	*m = (*m)[2:]
+	return v, nil
+}
+
+func (m *p9Message) uint32() (uint32, error) {
+	if len(*m) < 4 {
+		return 0, errP9BadMessage
+	}
+	v := binary.LittleEndian.Uint32(*m)
+	*m = (*m)[4:]
+	return v, nil
+}
+
+func (m *p9Message) uint64() (uint64, error) {
+	if len(*m) < 8 {
+		return 0, errP9BadMessage
+	}
+	v := binary.LittleEndian.Uint64(*m)
+	*m = (*m)[8:]
+	return v, nil
+}
+
+func (m *p9Message) string() (string, error) {
+	n, err := m.uint16()
+	if err != nil || len(*m) < int(n) {
+		return "", errP9BadMessage
+	}
+	v := string((*m)[:n])
+	*m = (*m)[n:]
+	return v, nil
+}
+
+// p9Response builds a message to send.
+type p9Response []byte
+
+func newP9Response(messageType uint8, tag uint16) *p9Response {
+	r := p9Response{0, 0, 0, 0, messageType}
+	r.uint16(tag)
+	return &r
+}
+
+func (r *p9Response) uint8(v uint8) {
+	*r = append(*r, v)
+}
+
+func (r *p9Response) uint16(v uint16) {
+	*r = binary.LittleEndian.AppendUint16(*r, v)
+}
+
+func (r *p9Response) uint32(v uint32) {
+	*r = binary.LittleEndian.AppendUint32(*r, v)
+}
+
+func (r *p9Response) uint64(v uint64) {
+	*r = binary.LittleEndian.AppendUint64(*r, v)
+}
+
+func (r *p9Response) string(v string) {
+	r.uint16(uint16(len(v)))
+	*r = append(*r, v...)
+}
+
+// qid appends the unique identifier of a node: its type, version and inode
+// number.
+func (r *p9Response) qid(info iofs.FileInfo) {
+	attr := info.Sys().(*split.Attr)
+	switch {
+	case attr.Mode.IsDir():
+		r.uint8(p9QidDirectory)
+	case attr.Mode&os.ModeSymlink != 0:
+		r.uint8(p9QidSymlink)
+	default:
+		r.uint8(p9QidFile)
+	}
+	r.uint32(uint32(attr.Mtime.Unix()))
+	r.uint64(attr.Inode)
+}
+
+// bytes returns the message, with its size.
+func (r *p9Response) bytes() []byte {
+	binary.LittleEndian.PutUint32(*r, uint32(len(*r)))
+	return *r
+}
+
+// fileReader is a regular file opened through split.IOFS.
+type fileReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// p9Fid is a node that a 9P client refers to by a number of its choice.
+type p9Fid struct {
+	// name is the name in the view that the node was walked to.
+	name string
+	info iofs.FileInfo
+	// reader reads regular files once they are opened.
+	reader fileReader
+	// entries are the entries of directories, as of the first read at
+	// offset 0. Entry offsets are their index plus one.
+	entries []iofs.FileInfo
+}
+
+// p9Server serves a filesystem to a 9P client, read-only.
+type p9Server struct {
+	view        *split.IOFS
+	messageSize uint32
+	fids        map[uint32]*p9Fid
+}
+
+// Serve serves the given view over the 9P2000.L protocol on the given
+// connection, until the client closes it. Clients attach to the root of the
+// view, whatever the name they give, and are not authenticated. Only
+// reading is supported: requests that would modify the filesystem fail with
+// EROFS. Attributes are those of split.Attr, and the path of qids is the
+// inode number of nodes, which makes them unique and stable.
+func Serve(view *split.IOFS, conn io.ReadWriter) error {
+	s := &p9Server{
+		view:        view,
+		messageSize: p9MaxMessageSize,
+		fids:        make(map[uint32]*p9Fid),
+	}
+	defer s.clunkAll()
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := binary.LittleEndian.Uint32(header)
+		if size < 7 || size > s.messageSize {
+			return fmt.Errorf("invalid 9P message size %d", size)
+		}
+		message := make([]byte, size-4)
+		if _, err := io.ReadFull(conn, message); err != nil {
+			return err
+		}
+		messageType, tag := message[0], binary.LittleEndian.Uint16(message[1:])
+		r, err := s.handle(messageType, tag, p9Message(message[3:]))
+		if err != nil {
+			r = newP9Response(p9Rlerror, tag)
+			r.uint32(uint32(split.Errno(err)))
+		}
+		if _, err := conn.Write(r.bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// clunkAll forgets all fids.
+func (s *p9Server) clunkAll() {
+	for fid, f := range s.fids {
+		if f.reader != nil {
+			f.reader.Close()
+		}
+		delete(s.fids, fid)
+	}
+}
+
+// fid returns the node that a message refers to.
+func (s *p9Server) fid(m *p9Message) (*p9Fid, error) {
+	fid, err := m.uint32()
+	if err != nil {
+		return nil, err
+	}
+	f, ok := s.fids[fid]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return f, nil
+}
+
+// handle returns the response to a message with the given tag.
+func (s *p9Server) handle(messageType uint8, tag uint16, m p9Message) (*p9Response, error) {
+	switch messageType {
+	case p9Tversion:
+		messageSize, err := m.uint32()
+		if err != nil {
+			return nil, err
+		}
+		version, err := m.string()
+		if err != nil {
+			return nil, err
+		}
+		if messageSize < p9MinMessageSize {
+			return nil, syscall.EINVAL
+		}
+		// A new version starts a new session.
+		s.clunkAll()
+		if messageSize < s.messageSize {
+			s.messageSize = messageSize
+		}
+		if version != p9Version {
+			version = "unknown"
+		}
+		r := newP9Response(p9Rversion, tag)
+		r.uint32(s.messageSize)
+		r.string(version)
+		return r, nil
+	case p9Tauth:
+		return nil, syscall.EOPNOTSUPP
+	case p9Tattach:
+		fid, err := m.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.fids[fid]; ok {
+			return nil, syscall.EBADF
+		}
+		info, err := s.view.Lstat(".")
+		if err != nil {
+			return nil, err
+		}
+		s.fids[fid] = &p9Fid{name: ".", info: info}
+		r := newP9Response(p9Rattach, tag)
+		r.qid(info)
+		return r, nil
+	case p9Tflush:
+		// Messages are handled one at a time, so the flushed one was
+		// already responded to.
+		return newP9Response(p9Rflush, tag), nil
+	case p9Twalk:
+		return s.walk(tag, m)
+	case p9Tlopen:
+		f, err := s.fid(&m)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := m.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+			return nil, syscall.EROFS
+		}
+		switch {
+		case f.info.IsDir():
+			f.entries = nil
+		case f.reader != nil:
+			return nil, syscall.EBADF
+		case f.info.Mode()&os.ModeSymlink != 0:
+			// The view would open the target of the symlink.
+			return nil, syscall.EACCES
+		default:
+			file, err := s.view.Open(f.name)
+			if err != nil {
+				return nil, err
+			}
+			f.reader = file.(fileReader)
+		}
+		r := newP9Response(p9Rlopen, tag)
+		r.qid(f.info)
+		r.uint32(s.messageSize - p9IOHeaderSize)
+		return r, nil
+	case p9Tread:
+		f, err := s.fid(&m)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := m.uint64()
+		if err != nil {
+			return nil, err
+		}
+		count, err := m.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if f.reader == nil {
+			return nil, syscall.EBADF
+		}
+		if count > s.messageSize-p9IOHeaderSize {
+			count = s.messageSize - p9IOHeaderSize
+		}
+		data := make([]byte, count)
+		n, err := f.reader.ReadAt(data, int64(offset))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		r := newP9Response(p9Rread, tag)
+		r.uint32(uint32(n))
+		*r = append(*r, data[:n]...)
+		return r, nil
+	case p9Treaddir:
+		return s.readdir(tag, m)
+	case p9Tgetattr:
+		f, err := s.fid(&m)
+		if err != nil {
+			return nil, err
+		}
+		// Attributes are looked up again, as fids can be kept for long.
+		info, err := s.view.Lstat(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.info = info
+		attr := info.Sys().(*split.Attr)
+		r := newP9Response(p9Rgetattr, tag)
+		r.uint64(p9GetattrBasic)
+		r.qid(info)
+		r.uint32(split.UnixMode(attr.Mode))
+		r.uint32(attr.Uid)
+		r.uint32(attr.Gid)
+		r.uint64(uint64(attr.Nlink))
+		r.uint64(uint64(attr.Rdev))
+		r.uint64(attr.Size)
+		r.uint64(uint64(attr.BlockSize))
+		r.uint64(attr.Blocks)
+		for _, t := range []int64{attr.Atime.Unix(), int64(attr.Atime.Nanosecond()), attr.Mtime.Unix(), int64(attr.Mtime.Nanosecond()), attr.Ctime.Unix(), int64(attr.Ctime.Nanosecond()), attr.Crtime.Unix(), int64(attr.Crtime.Nanosecond())} {
+			r.uint64(uint64(t))
+		}
+		// Generation and data version.
+		r.uint64(0)
+		r.uint64(0)
+		return r, nil
+	case p9Treadlink:
+		f, err := s.fid(&m)
+		if err != nil {
+			return nil, err
+		}
+		target, err := s.view.ReadLink(f.name)
+		if err != nil {
+			return nil, err
+		}
+		r := newP9Response(p9Rreadlink, tag)
+		r.string(target)
+		return r, nil
+	case p9Tstatfs:
+		if _, err := s.fid(&m); err != nil {
+			return nil, err
+		}
+		r := newP9Response(p9Rstatfs, tag)
+		// The type is that of v9fs, and the blocks and files are unknown.
+		r.uint32(0x01021997)
+		r.uint32(4096)
+		for i := 0; i < 6; i++ {
+			r.uint64(0)
+		}
+		r.uint32(255)
+		return r, nil
+	case p9Tfsync:
+		if _, err := s.fid(&m); err != nil {
+			return nil, err
+		}
+		return newP9Response(p9Rfsync, tag), nil
+	case p9Tclunk:
+		fid, err := m.uint32()
+		if err != nil {
+			return nil, err
+		}
+		f, ok := s.fids[fid]
+		if !ok {
+			return nil, syscall.EBADF
+		}
+		delete(s.fids, fid)
+		if f.reader != nil {
+			if err := f.reader.Close(); err != nil {
+				return nil, err
+			}
+		}
+		return newP9Response(p9Rclunk, tag), nil
+	case p9Tlcreate, p9Tsymlink, p9Tmknod, p9Trename, p9Tsetattr, p9Txattrcreat, p9Tmkdir, p9Trenameat, p9Tunlinkat, p9Tlink, p9Twrite, p9Tremove:
+		return nil, syscall.EROFS
+	}
+	// Extended attributes and locks are not supported either.
+	return nil, syscall.EOPNOTSUPP
+}
+
+// walk walks from a node to another, one name at a time, and returns the
+// qids of the nodes on the way. If a name cannot be walked to, the new fid
+// is not created, and only the qids up to that name are returned.
+func (s *p9Server) walk(tag uint16, m p9Message) (*p9Response, error) {
+	fid, err := m.uint32()
+	if err != nil {
+		return nil, err
+	}
+	f, ok := s.fids[fid]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	newFid, err := m.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.fids[newFid]; ok && newFid != fid {
+		return nil, syscall.EBADF
+	}
+	count, err := m.uint16()
+	if err != nil {
+		return nil, err
+	}
+	if count > p9MaxWalk {
+		return nil, errP9BadMessage
+	}
+	walked, info := f.name, f.info
+	var infos []iofs.FileInfo
+	for i := uint16(0); i < count; i++ {
+		name, err := m.string()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case name == "" || name == "." || strings.Contains(name, "/"):
+			err = syscall.ENOENT
+		case name == "..":
+			walked = path.Dir(walked)
+			info, err = s.view.Lstat(walked)
+		case !info.IsDir():
+			err = syscall.ENOTDIR
+		default:
+			walked = path.Join(walked, name)
+			info, err = s.view.Lstat(walked)
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		infos = append(infos, info)
+	}
+	if len(infos) == int(count) {
+		if newFid == fid && f.reader != nil {
+			return nil, syscall.EBADF
+		}
+		s.fids[newFid] = &p9Fid{name: walked, info: info}
+	}
+	r := newP9Response(p9Rwalk, tag)
+	r.uint16(uint16(len(infos)))
+	for _, info := range infos {
+		r.qid(info)
+	}
+	return r, nil
+}
+
+// readdir lists the entries of a directory after the given offset.
+func (s *p9Server) readdir(tag uint16, m p9Message) (*p9Response, error) {
+	f, err := s.fid(&m)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := m.uint64()
+	if err != nil {
+		return nil, err
+	}
+	count, err := m.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if !f.info.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	if offset == 0 || f.entries == nil {
+		dirEntries, err := s.view.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = make([]iofs.FileInfo, 0, len(dirEntries))
+		for _, dirEntry := range dirEntries {
+			// Entries that disappear while the directory is read are left
+			// out.
+			if info, err := dirEntry.Info(); err == nil {
+				f.entries = append(f.entries, info)
+			}
+		}
+	}
+	if count > s.messageSize-p9IOHeaderSize {
+		count = s.messageSize - p9IOHeaderSize
+	}
+	r := newP9Response(p9Rreaddir, tag)
+	r.uint32(0)
+	start := len(*r)
+	for i := offset; i < uint64(len(f.entries)); i++ {
+		info := f.entries[i]
+		// Entries are made of a qid, an offset, a type and a name.
+		if uint32(len(*r)-start+13+8+1+2+len(info.Name())) > count {
+			break
+		}
+		r.qid(info)
+		r.uint64(i + 1)
+		// The type of entries is the file type bits of their mode, as in
+		// struct dirent.
+		r.uint8(uint8(split.UnixMode(info.Mode()) >> 12))
+		r.string(info.Name())
+	}
+	binary.LittleEndian.PutUint32((*r)[start-4:], uint32(len(*r)-start))
+	return r, nil
+}
@@ -0,0 +1,275 @@
+package ninepfs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"perot.me/splitfs/split"
+)
+
+// p9Client sends messages to Serve, over a pipe.
+type p9Client struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+func newP9Client(t *testing.T, view *split.IOFS) *p9Client {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(view, server)
+		server.Close()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		if err := <-done; err != nil && err != io.ErrClosedPipe {
+			t.Errorf("Serve = %v", err)
+		}
+	})
+	return &p9Client{t: t, conn: client}
+}
+
+// newMessage returns a message of the given type, with a new tag.
+func (c *p9Client) newMessage(messageType uint8) *p9Response {
+	c.tag++
+	return newP9Response(messageType, c.tag)
+}
+
+// roundTrip sends a message, and returns the type and content of the
+// response, after its tag.
+func (c *p9Client) roundTrip(m *p9Response) (uint8, p9Message) {
+	c.t.Helper()
+	if _, err := c.conn.Write(m.bytes()); err != nil {
+		c.t.Fatalf("cannot send message: %v", err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatalf("cannot read response: %v", err)
+	}
+	response := make([]byte, binary.LittleEndian.Uint32(header)-4)
+	if _, err := io.ReadFull(c.conn, response); err != nil {
+		c.t.Fatalf("cannot read response: %v", err)
+	}
+	if tag := binary.LittleEndian.Uint16(response[1:]); tag != c.tag {
+		c.t.Fatalf("response has tag %d, want %d", tag, c.tag)
+	}
+	return response[0], p9Message(response[3:])
+}
+
+// expect sends a message, and fails unless the response has the given type.
+func (c *p9Client) expect(m *p9Response, want uint8) p9Message {
+	c.t.Helper()
+	messageType, response := c.roundTrip(m)
+	if messageType != want {
+		errno, _ := response.uint32()
+		c.t.Fatalf("got message %d (errno %v), want %d", messageType, syscall.Errno(errno), want)
+	}
+	return response
+}
+
+// expectError sends a message, and fails unless the response is the given
+// error.
+func (c *p9Client) expectError(m *p9Response, want syscall.Errno) {
+	c.t.Helper()
+	messageType, response := c.roundTrip(m)
+	errno, _ := response.uint32()
+	if messageType != p9Rlerror || syscall.Errno(errno) != want {
+		c.t.Errorf("got message %d (errno %v), want error %v", messageType, syscall.Errno(errno), want)
+	}
+}
+
+// walk walks from a fid to a new one.
+func (c *p9Client) walk(fid, newFid uint32, names ...string) *p9Response {
+	m := c.newMessage(p9Twalk)
+	m.uint32(fid)
+	m.uint32(newFid)
+	m.uint16(uint16(len(names)))
+	for _, name := range names {
+		m.string(name)
+	}
+	return m
+}
+
+// lopen opens a fid with the given flags.
+func (c *p9Client) lopen(fid, flags uint32) *p9Response {
+	m := c.newMessage(p9Tlopen)
+	m.uint32(fid)
+	m.uint32(flags)
+	return m
+}
+
+// fidMessage returns a message about a fid.
+func (c *p9Client) fidMessage(messageType uint8, fid uint32) *p9Response {
+	m := c.newMessage(messageType)
+	m.uint32(fid)
+	return m
+}
+
+// qidType returns the type of the qid at the start of a message.
+func qidType(m *p9Message) uint8 {
+	qid, _ := m.uint8()
+	m.uint32()
+	m.uint64()
+	return qid
+}
+
+func TestServe(t *testing.T) {
+	source := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "dir", "many"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("0123456789", 1000)
+	if err := os.WriteFile(filepath.Join(source, "dir", "file.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < 200; i++ {
+		name := strings.Repeat("x", i%50+1) + strings.Repeat("y", i/50) + ".txt"
+		want = append(want, name)
+		if err := os.WriteFile(filepath.Join(source, "dir", "many", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(want)
+	if err := os.Symlink("dir/file.txt", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := split.NewFS(source, 1, split.ExcludeRegexp(`\.txt$`), split.Symlinks(split.SymlinksRewrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newP9Client(t, f.IOFS())
+
+	version := c.newMessage(p9Tversion)
+	version.uint32(p9MinMessageSize)
+	version.string(p9Version)
+	r := c.expect(version, p9Rversion)
+	if messageSize, _ := r.uint32(); messageSize != p9MinMessageSize {
+		t.Errorf("Rversion: message size %d, want %d", messageSize, p9MinMessageSize)
+	}
+	if got, _ := r.string(); got != p9Version {
+		t.Errorf("Rversion: version %q, want %q", got, p9Version)
+	}
+
+	attach := c.newMessage(p9Tattach)
+	attach.uint32(0)
+	attach.uint32(^uint32(0))
+	attach.string("user")
+	attach.string("")
+	attach.uint32(0)
+	r = c.expect(attach, p9Rattach)
+	if qid := qidType(&r); qid != p9QidDirectory {
+		t.Errorf("Rattach: qid type %#x, want a directory", qid)
+	}
+
+	// Walks return the qids of every component.
+	r = c.expect(c.walk(0, 1, "dir", "file.txt"), p9Rwalk)
+	if n, _ := r.uint16(); n != 2 || qidType(&r) != p9QidDirectory || qidType(&r) != p9QidFile {
+		t.Errorf("Rwalk to dir/file.txt: %d qids", n)
+	}
+	// A walk that fails after the first name returns the qids up to it,
+	// and does not create the fid.
+	r = c.expect(c.walk(0, 2, "dir", "missing"), p9Rwalk)
+	if n, _ := r.uint16(); n != 1 {
+		t.Errorf("Rwalk to dir/missing: %d qids, want 1", n)
+	}
+	c.expectError(c.fidMessage(p9Tgetattr, 2), syscall.EBADF)
+	c.expectError(c.walk(0, 2, "missing"), syscall.ENOENT)
+	c.expect(c.walk(1, 2, "..", "many"), p9Rwalk)
+	c.expect(c.walk(0, 3, "link"), p9Rwalk)
+
+	// Files are read in pieces.
+	c.expectError(c.lopen(1, syscall.O_RDWR), syscall.EROFS)
+	r = c.expect(c.lopen(1, syscall.O_RDONLY), p9Rlopen)
+	qidType(&r)
+	if iounit, _ := r.uint32(); iounit != p9MinMessageSize-p9IOHeaderSize {
+		t.Errorf("Rlopen: iounit %d, want %d", iounit, p9MinMessageSize-p9IOHeaderSize)
+	}
+	var read strings.Builder
+	for {
+		m := c.fidMessage(p9Tread, 1)
+		m.uint64(uint64(read.Len()))
+		m.uint32(3000)
+		r = c.expect(m, p9Rread)
+		n, _ := r.uint32()
+		if n == 0 {
+			break
+		}
+		if n > 3000 || int(n) != len(r) {
+			t.Fatalf("Rread: %d bytes, with %d bytes of data", n, len(r))
+		}
+		read.Write(r)
+	}
+	if read.String() != content {
+		t.Errorf("read %d bytes, want %d", read.Len(), len(content))
+	}
+	r = c.expect(c.fidMessage(p9Tgetattr, 1), p9Rgetattr)
+	r.uint64()
+	qidType(&r)
+	mode, _ := r.uint32()
+	r.uint32()
+	r.uint32()
+	r.uint64()
+	r.uint64()
+	if size, _ := r.uint64(); mode&syscall.S_IFMT != syscall.S_IFREG || size != uint64(len(content)) {
+		t.Errorf("Rgetattr: mode %o, size %d", mode, size)
+	}
+
+	// Directories are read in pieces too, from the offset of the last
+	// entry read.
+	c.expect(c.lopen(2, syscall.O_RDONLY), p9Rlopen)
+	var names []string
+	offset := uint64(0)
+	for reads := 0; ; reads++ {
+		m := c.fidMessage(p9Treaddir, 2)
+		m.uint64(offset)
+		m.uint32(512)
+		r = c.expect(m, p9Rreaddir)
+		n, _ := r.uint32()
+		if n == 0 {
+			if reads < 2 {
+				t.Errorf("listed the directory in %d reads", reads)
+			}
+			break
+		}
+		if n > 512 {
+			t.Fatalf("Rreaddir: %d bytes, more than asked", n)
+		}
+		for len(r) > 0 {
+			qidType(&r)
+			offset, _ = r.uint64()
+			r.uint8()
+			name, err := r.string()
+			if err != nil {
+				t.Fatalf("Rreaddir: %v", err)
+			}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %d entries %q, want %d", len(names), names, len(want))
+	}
+
+	r = c.expect(c.fidMessage(p9Treadlink, 3), p9Rreadlink)
+	if target, _ := r.string(); target != "dir/file.txt" {
+		t.Errorf("Rreadlink: target %q", target)
+	}
+	c.expectError(c.fidMessage(p9Treadlink, 1), syscall.EINVAL)
+
+	for fid := uint32(1); fid <= 3; fid++ {
+		c.expect(c.fidMessage(p9Tclunk, fid), p9Rclunk)
+	}
+	c.expectError(c.fidMessage(p9Tclunk, 1), syscall.EBADF)
+	c.expectError(c.fidMessage(p9Tremove, 0), syscall.EROFS)
+	c.expectError(c.fidMessage(p9Tauth, 0), syscall.EOPNOTSUPP)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+)
+
+// reloader re-reads the configuration of running mounts.
+type reloader struct {
+	configPath  string
+	args        []string
+	commandLine map[string]bool
+	// mu serializes reloads, and protects mounted.
+	mu      sync.Mutex
+	mounted []*mountedFS
+}
+
+// setMounted sets the mounts to reload.
+func (r *reloader) setMounted(mounted []*mountedFS) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mounted = mounted
+}
+
+// resetFlags resets all flags that were not set on the command line back
+// to their default value, so that removing an option from the
+// configuration file has an effect.
+func (r *reloader) resetFlags() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err == nil && !r.commandLine[f.Name] {
+			err = f.Value.Set(f.DefValue)
+		}
+	})
+	return err
+}
+
+// reload re-reads the configuration file and applies the settings that can
+// change without remounting. Changes to other settings are logged and
+// ignored. Mounts whose new settings would change existing chunk names are
+// not reloaded at all; this is logged rather than returned as an error.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.resetFlags(); err != nil {
+		return err
+	}
+	mounts, err := loadMounts(r.configPath, r.args, r.commandLine)
+	if err != nil {
+		return err
+	}
+	byMountpoint := make(map[string]*mountDefinition, len(mounts))
+	for _, mount := range mounts {
+		byMountpoint[mount.mountpoint] = mount
+	}
+	for _, m := range r.mounted {
+		mount, ok := byMountpoint[m.mountpoint]
+		if !ok {
+			log.Printf("%s: mount removed from the configuration; restart to unmount it", m.mountpoint)
+			continue
+		}
+		delete(byMountpoint, m.mountpoint)
+		if mount.source != m.source || !mount.options.sameFuseMountOptions(m.options) {
+			log.Printf("%s: source directory and FUSE mount options cannot change without a restart; ignoring them", m.mountpoint)
+		}
+		chunkSize, options, err := mount.options.splitOptions()
+		if err == nil {
+			err = m.splitFS.Reload(chunkSize, options...)
+		}
+		if err != nil {
+			log.Printf("%s: not reloading: %v", m.mountpoint, err)
+			continue
+		}
+		m.setReloaded(mount.options)
+		infof("%s: reloaded", m.mountpoint)
+	}
+	for mountpoint := range byMountpoint {
+		log.Printf("%s: mount added to the configuration; restart to mount it", mountpoint)
+	}
+	return nil
+}
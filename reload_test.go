@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"perot.me/splitfs/split"
+)
+
+var registerOnce sync.Once
+
+// registerCommandLine registers the mount options as command-line flags, as
+// main does, and resets them to their defaults once the test is done.
+func registerCommandLine(t *testing.T) {
+	registerOnce.Do(func() { (&mountOptions{}).register(flag.CommandLine) })
+	t.Cleanup(func() {
+		for name := range mountOptionNames() {
+			flag.Set(name, flag.Lookup(name).DefValue)
+		}
+	})
+}
+
+// setOnCommandLine returns the given flags as set on the command line,
+// along with the flags of the test binary, which are left alone.
+func setOnCommandLine(names ...string) map[string]bool {
+	mountFlags := mountOptionNames()
+	commandLine := make(map[string]bool)
+	flag.VisitAll(func(f *flag.Flag) {
+		commandLine[f.Name] = !mountFlags[f.Name]
+	})
+	for _, name := range names {
+		commandLine[name] = true
+	}
+	return commandLine
+}
+
+// writeFile writes a file in the given directory, and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReload(t *testing.T) {
+	registerCommandLine(t)
+	source, dir := t.TempDir(), t.TempDir()
+	configPath := writeFile(t, dir, "config.json", `{
+		"options": {"chunk_size": "4B", "exclude_regexp": "\\.iso$"},
+		"mounts": [{"source": "`+source+`", "mountpoint": "/mnt"}]
+	}`)
+	if err := flag.Set("chunk_size", "1MiB"); err != nil {
+		t.Fatal(err)
+	}
+	commandLine := setOnCommandLine("chunk_size")
+	mounts, err := loadMounts(configPath, nil, commandLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkSize, options, err := mounts[0].options.splitOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	splitFS, err := split.NewFS(source, chunkSize, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounted := &mountedFS{mountDefinition: mounts[0], splitFS: splitFS}
+	r := &reloader{configPath: configPath, commandLine: commandLine}
+	r.setMounted([]*mountedFS{mounted})
+	checkOptions := func(excludeRegexp string, attrCacheTTL time.Duration) {
+		t.Helper()
+		if got := mounted.options.excludeRegexp; got != excludeRegexp {
+			t.Errorf("exclude_regexp = %q, want %q", got, excludeRegexp)
+		}
+		if got := mounted.options.attrCacheTTL; got != attrCacheTTL {
+			t.Errorf("attr_cache_ttl = %v, want %v", got, attrCacheTTL)
+		}
+	}
+	checkOptions(`\.iso$`, time.Minute)
+
+	// Options removed from the file go back to their defaults, but flags set
+	// on the command line keep their value.
+	writeFile(t, dir, "config.json", `{
+		"options": {"chunk_size": "4B", "attr_cache_ttl": "1s"},
+		"mounts": [{"source": "`+source+`", "mountpoint": "/mnt"}]
+	}`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := flag.Lookup("chunk_size").Value.String(); got != "1MiB" {
+		t.Errorf("reload changed the chunk size set on the command line to %s", got)
+	}
+	if got := flag.Lookup("exclude_regexp").Value.String(); got != "" {
+		t.Errorf("exclude_regexp removed from the file is still %q", got)
+	}
+	checkOptions("", time.Second)
+
+	// Changes to chunk names are refused as a whole.
+	writeFile(t, dir, "config.json", `{
+		"options": {"filename_hash": "fnv64a-hex", "exclude_regexp": "\\.txt$"},
+		"mounts": [{"source": "`+source+`", "mountpoint": "/mnt"}]
+	}`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	checkOptions("", time.Second)
+	if splitFS.IsExcluded(filepath.Join(source, "a.txt")) {
+		t.Error("refused reload changed the exclusion rules")
+	}
+}
+
+func TestResetFlags(t *testing.T) {
+	registerCommandLine(t)
+	for name, value := range map[string]string{"chunk_size": "1MiB", "exclude_regexp": `\.iso$`, "ro": "true"} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &reloader{commandLine: setOnCommandLine("chunk_size", "ro")}
+	if err := r.resetFlags(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"chunk_size": "1MiB", "exclude_regexp": "", "ro": "true"} {
+		if got := flag.Lookup(name).Value.String(); got != want {
+			t.Errorf("%s = %q after reset, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Package s3fs serves the chunked view of package split as the buckets of a
+// minimal S3-compatible API, for backup tools that speak S3. It is built on
+// the io/fs view of the filesystem, split.IOFS, so it serves the same tree
+// as the mountpoint.
+package s3fs
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"perot.me/splitfs/split"
+)
+
+// s3Namespace is the XML namespace of S3 responses.
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3MaxKeys is the default and maximum number of keys listed at once.
+const s3MaxKeys = 1000
+
+// s3TimeFormat is the format of times in S3 responses.
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         uint64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+	status   int
+}
+
+var (
+	s3NoSuchBucket     = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist.", status: http.StatusNotFound}
+	s3NoSuchKey        = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist.", status: http.StatusNotFound}
+	s3MethodNotAllowed = &s3Error{Code: "MethodNotAllowed", Message: "The buckets are read-only.", status: http.StatusMethodNotAllowed}
+	s3NotImplemented   = &s3Error{Code: "NotImplemented", Message: "Only ListObjectsV2 is implemented for listing objects.", status: http.StatusNotImplemented}
+	s3InvalidArgument  = &s3Error{Code: "InvalidArgument", Message: "Invalid argument.", status: http.StatusBadRequest}
+)
+
+// handler serves filesystems as the buckets of a read-only S3-compatible
+// API.
+type handler struct {
+	buckets map[string]*split.IOFS
+}
+
+// Handler returns a handler that serves each of the given views as a bucket of a minimal S3-compatible API, read-only. Requests must be
+// path-style, and are not authenticated. Object keys are the paths of
+// regular files, such as chunks, in the filesystem; directories only show up
+// as common prefixes. It implements ListBuckets, GetBucketLocation,
+// HeadBucket, ListObjectsV2 with prefixes and delimiters, and HeadObject and
+// GetObject with ranges and conditional requests. The entity tag and the
+// last modification time of objects are those of the source file; entity
+// tags are not MD5 sums, and are formatted so that clients cannot take them
+// for one.
+func Handler(buckets map[string]*split.IOFS) http.Handler {
+	return &handler{buckets: buckets}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeS3Error(w, r, s3MethodNotAllowed)
+		return
+	}
+	bucket, key := strings.TrimPrefix(r.URL.Path, "/"), ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+	if bucket == "" {
+		h.listBuckets(w, r)
+		return
+	}
+	view, ok := h.buckets[bucket]
+	if !ok {
+		writeS3Error(w, r, s3NoSuchBucket)
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case key != "":
+		h.serveObject(w, r, view, key)
+	case r.Method == http.MethodHead:
+	case query["location"] != nil:
+		writeXML(w, http.StatusOK, &s3LocationConstraint{Xmlns: s3Namespace})
+	case query.Get("list-type") == "2":
+		h.listObjects(w, r, bucket, view)
+	default:
+		writeS3Error(w, r, s3NotImplemented)
+	}
+}
+
+// listBuckets lists the buckets, with the modification time of their root
+// directory as their creation date.
+func (h *handler) listBuckets(w http.ResponseWriter, r *http.Request) {
+	result := &s3ListAllMyBucketsResult{Xmlns: s3Namespace, Buckets: []s3Bucket{}}
+	for name, view := range h.buckets {
+		bucket := s3Bucket{Name: name}
+		if info, err := view.Stat("."); err == nil {
+			bucket.CreationDate = info.ModTime().UTC().Format(s3TimeFormat)
+		}
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		return result.Buckets[i].Name < result.Buckets[j].Name
+	})
+	writeXML(w, http.StatusOK, result)
+}
+
+// serveObject serves the object with the given key.
+func (h *handler) serveObject(w http.ResponseWriter, r *http.Request, view *split.IOFS, key string) {
+	// Keys that are not canonical paths, such as those with a trailing
+	// slash, do not exist.
+	if split.CleanPath(key) != key {
+		writeS3Error(w, r, s3NoSuchKey)
+		return
+	}
+	info, err := view.Lstat(key)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFor(err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		writeS3Error(w, r, s3NoSuchKey)
+		return
+	}
+	file, err := view.Open(key)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFor(err))
+		return
+	}
+	defer file.Close()
+	w.Header().Set("ETag", info.Sys().(*split.Attr).ETag())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file.(io.ReadSeeker))
+}
+
+// errListingFull stops walking the filesystem once a listing is full.
+var errListingFull = errors.New("listing full")
+
+// s3Listing lists the keys of a bucket, in lexicographical order.
+type s3Listing struct {
+	prefix    string
+	delimiter string
+	// after is the key or common prefix after which the listing starts.
+	after  string
+	result *s3ListBucketResult
+	// last is the last key or common prefix listed.
+	last string
+}
+
+// add adds a key or common prefix to the listing.
+func (l *s3Listing) add(key string, info iofs.FileInfo) error {
+	if key <= l.after || key == l.last {
+		return nil
+	}
+	if l.result.KeyCount == l.result.MaxKeys {
+		l.result.IsTruncated = true
+		return errListingFull
+	}
+	l.result.KeyCount++
+	l.last = key
+	if info == nil {
+		l.result.CommonPrefixes = append(l.result.CommonPrefixes, s3CommonPrefix{Prefix: key})
+		return nil
+	}
+	attr := info.Sys().(*split.Attr)
+	l.result.Contents = append(l.result.Contents, s3Object{
+		Key:          key,
+		LastModified: attr.Mtime.UTC().Format(s3TimeFormat),
+		ETag:         attr.ETag(),
+		Size:         attr.Size,
+		StorageClass: "STANDARD",
+	})
+	return nil
+}
+
+// s3Entry is an entry of a directory, with its key: its path, followed by a
+// slash for directories.
+type s3Entry struct {
+	key   string
+	entry iofs.DirEntry
+	isDir bool
+}
+
+// walk lists the keys in the directory of the given view, whose key is
+// given. Entries are sorted by key, rather than by name, so that the keys
+// of a directory come in the same order as they would among the keys of
+// its siblings. Their type comes from the directory listing, so that
+// entries are only looked up once they are listed or walked into:
+// directories and keys that come before the start of the listing, that do
+// not match the prefix, or that are summarized as a common prefix are
+// neither stat'ed nor read.
+func (l *s3Listing) walk(view *split.IOFS, directoryKey string) error {
+	dirEntries, err := view.ReadDir(".")
+	if err != nil {
+		return err
+	}
+	entries := make([]s3Entry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		entry := s3Entry{entry: dirEntry}
+		switch dirEntry.Type() {
+		case iofs.ModeDir:
+			entry.key, entry.isDir = directoryKey+dirEntry.Name()+"/", true
+		case 0:
+			entry.key = directoryKey + dirEntry.Name()
+		default:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.key, l.prefix) && !(entry.isDir && strings.HasPrefix(l.prefix, entry.key)) {
+			continue
+		}
+		if entry.key <= l.after && !(entry.isDir && strings.HasPrefix(l.after, entry.key)) {
+			continue
+		}
+		if l.delimiter != "" && strings.HasPrefix(entry.key, l.prefix) {
+			rest := entry.key[len(l.prefix):]
+			if i := strings.Index(rest, l.delimiter); i >= 0 && (!entry.isDir || i+len(l.delimiter) <= len(rest)) {
+				if err := l.add(l.prefix+rest[:i+len(l.delimiter)], nil); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		info, err := entry.entry.Info()
+		if err != nil {
+			// The entry disappeared since the directory was read.
+			continue
+		}
+		if info.IsDir() != entry.isDir || !(info.IsDir() || info.Mode().IsRegular()) {
+			continue
+		}
+		if !entry.isDir {
+			if err := l.add(entry.key, info); err != nil {
+				return err
+			}
+			continue
+		}
+		sub, err := view.Sub(entry.entry.Name())
+		if err != nil {
+			continue
+		}
+		if err := l.walk(sub.(*split.IOFS), entry.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listObjects lists the objects of a bucket, as ListObjectsV2 does.
+func (h *handler) listObjects(w http.ResponseWriter, r *http.Request, bucket string, view *split.IOFS) {
+	query := r.URL.Query()
+	result := &s3ListBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType:      query.Get("encoding-type"),
+		MaxKeys:           s3MaxKeys,
+	}
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, s3InvalidArgument)
+			return
+		}
+		if n < s3MaxKeys {
+			result.MaxKeys = n
+		}
+	}
+	if result.EncodingType != "" && result.EncodingType != "url" {
+		writeS3Error(w, r, s3InvalidArgument)
+		return
+	}
+	l := &s3Listing{
+		prefix:    result.Prefix,
+		delimiter: result.Delimiter,
+		after:     result.StartAfter,
+		result:    result,
+	}
+	if result.ContinuationToken != "" {
+		after, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			writeS3Error(w, r, s3InvalidArgument)
+			return
+		}
+		l.after = string(after)
+	}
+	if err := l.walk(view, ""); err != nil && err != errListingFull {
+		writeS3Error(w, r, s3ErrorFor(err))
+		return
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.last))
+	}
+	if result.EncodingType == "url" {
+		result.Prefix = url.QueryEscape(result.Prefix)
+		result.Delimiter = url.QueryEscape(result.Delimiter)
+		result.StartAfter = url.QueryEscape(result.StartAfter)
+		for i := range result.Contents {
+			result.Contents[i].Key = url.QueryEscape(result.Contents[i].Key)
+		}
+		for i := range result.CommonPrefixes {
+			result.CommonPrefixes[i].Prefix = url.QueryEscape(result.CommonPrefixes[i].Prefix)
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// s3ErrorFor returns the S3 error for an error returned by split.IOFS.
+func s3ErrorFor(err error) *s3Error {
+	switch split.Errno(err) {
+	case syscall.ENOENT, syscall.ENOTDIR:
+		return s3NoSuchKey
+	case syscall.EACCES, syscall.EPERM, syscall.EISDIR:
+		return &s3Error{Code: "AccessDenied", Message: err.Error(), status: http.StatusForbidden}
+	default:
+		return &s3Error{Code: "InternalError", Message: err.Error(), status: http.StatusInternalServerError}
+	}
+}
+
+// writeS3Error replies to the request with the given error.
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	response := *e
+	response.Resource = r.URL.Path
+	writeXML(w, e.status, &response)
+}
+
+// writeXML writes the given value as an XML response.
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
@@ -0,0 +1,163 @@
+package s3fs
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"perot.me/splitfs/split"
+)
+
+// s3Source returns a source directory whose .txt files are served as is,
+// and whose other files are split into single-byte chunks.
+func s3Source(t *testing.T, options ...split.Option) *split.IOFS {
+	t.Helper()
+	source := t.TempDir()
+	for name, size := range map[string]int{"a.txt": 1, "b/c.txt": 1, "b/d/e.txt": 1, "b/f.txt": 1, "g.txt": 1, "big.bin": 3} {
+		fullPath := filepath.Join(source, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := split.NewFS(source, 1, append([]split.Option{split.ExcludeRegexp(`\.txt$`)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.IOFS()
+}
+
+// listObjectsV2 sends a ListObjectsV2 request with the given parameters.
+func listObjectsV2(t *testing.T, f *split.IOFS, params url.Values) *s3ListBucketResult {
+	t.Helper()
+	params.Set("list-type", "2")
+	w := httptest.NewRecorder()
+	Handler(map[string]*split.IOFS{"bucket": f}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bucket?"+params.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ListObjectsV2 %v: status %d: %s", params, w.Code, w.Body)
+	}
+	result := &s3ListBucketResult{}
+	if err := xml.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatalf("ListObjectsV2 %v: %v", params, err)
+	}
+	return result
+}
+
+// listAll lists all keys and common prefixes, in pages of the given size.
+func listAll(t *testing.T, f *split.IOFS, params url.Values, maxKeys int) (keys, prefixes []string) {
+	t.Helper()
+	page := url.Values{"max-keys": {strconv.Itoa(maxKeys)}}
+	for name, values := range params {
+		page[name] = values
+	}
+	params = page
+	for {
+		result := listObjectsV2(t, f, params)
+		if result.KeyCount > maxKeys || result.KeyCount != len(result.Contents)+len(result.CommonPrefixes) {
+			t.Fatalf("page of %d keys has %d objects and %d common prefixes", result.KeyCount, len(result.Contents), len(result.CommonPrefixes))
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		for _, prefix := range result.CommonPrefixes {
+			prefixes = append(prefixes, prefix.Prefix)
+		}
+		if !result.IsTruncated {
+			return keys, prefixes
+		}
+		params.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func TestS3ListObjects(t *testing.T) {
+	f := s3Source(t)
+	keys, prefixes := listAll(t, f, url.Values{}, s3MaxKeys)
+	if len(keys) != 8 || len(prefixes) != 0 || !sort.StringsAreSorted(keys) {
+		t.Fatalf("listed %q and prefixes %q, want 8 sorted keys", keys, prefixes)
+	}
+	for i, want := range []string{"a.txt", "b/c.txt", "b/d/e.txt", "b/f.txt"} {
+		if keys[i] != want {
+			t.Errorf("key %d is %q, want %q", i, keys[i], want)
+		}
+	}
+	for _, key := range keys[4:7] {
+		if !strings.HasPrefix(key, "big.bin/") {
+			t.Errorf("key %q is not a chunk of big.bin", key)
+		}
+	}
+	if keys[7] != "g.txt" {
+		t.Errorf("last key is %q, want g.txt", keys[7])
+	}
+	for _, test := range []struct {
+		prefix, delimiter string
+		keys, prefixes    []string
+	}{
+		{"b/", "", []string{"b/c.txt", "b/d/e.txt", "b/f.txt"}, nil},
+		{"b", "", keys[1:7], nil},
+		{"b/d", "", []string{"b/d/e.txt"}, nil},
+		{"", "/", []string{"a.txt", "g.txt"}, []string{"b/", "big.bin/"}},
+		{"b/", "/", []string{"b/c.txt", "b/f.txt"}, []string{"b/d/"}},
+		{"", ".", nil, []string{"a.", "b/c.", "b/d/e.", "b/f.", "big.", "g."}},
+		{"missing/", "", nil, nil},
+	} {
+		params := url.Values{"prefix": {test.prefix}, "delimiter": {test.delimiter}}
+		for _, maxKeys := range []int{1, 2, 3, s3MaxKeys} {
+			gotKeys, gotPrefixes := listAll(t, f, params, maxKeys)
+			if !reflect.DeepEqual(gotKeys, test.keys) || !reflect.DeepEqual(gotPrefixes, test.prefixes) {
+				t.Errorf("prefix %q, delimiter %q, %d keys per page: listed %q and prefixes %q, want %q and %q", test.prefix, test.delimiter, maxKeys, gotKeys, gotPrefixes, test.keys, test.prefixes)
+			}
+		}
+	}
+	// Pages of every size list the same keys.
+	for maxKeys := 1; maxKeys <= len(keys); maxKeys++ {
+		if paged, _ := listAll(t, f, url.Values{}, maxKeys); !reflect.DeepEqual(paged, keys) {
+			t.Errorf("pages of %d keys listed %q, want %q", maxKeys, paged, keys)
+		}
+	}
+	if result := listObjectsV2(t, f, url.Values{"start-after": {"b/d/e.txt"}, "max-keys": {"1"}}); len(result.Contents) != 1 || result.Contents[0].Key != "b/f.txt" {
+		t.Errorf("listing after b/d/e.txt returned %+v, want b/f.txt", result.Contents)
+	}
+}
+
+// TestS3ListObjectsContinuation checks that the next page of a listing does
+// not look up the keys of the previous pages again.
+func TestS3ListObjectsContinuation(t *testing.T) {
+	var mu sync.Mutex
+	var looked []string
+	f := s3Source(t, split.AccessLog(func(entry *split.AccessLogEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		if entry.Op == "Lookup" || entry.Op == "Attr" {
+			looked = append(looked, entry.Path)
+		}
+	}))
+	first := listObjectsV2(t, f, url.Values{"max-keys": {"4"}})
+	if !first.IsTruncated || first.Contents[3].Key != "b/f.txt" {
+		t.Fatalf("first page is %+v, want one ending with b/f.txt", first.Contents)
+	}
+	mu.Lock()
+	looked = nil
+	mu.Unlock()
+	next := listObjectsV2(t, f, url.Values{"max-keys": {"4"}, "continuation-token": {first.NextContinuationToken}})
+	if len(next.Contents) != 4 || next.IsTruncated {
+		t.Errorf("next page is %+v, want the last 4 keys", next.Contents)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range looked {
+		if p == "a.txt" || p == "b/c.txt" || strings.HasPrefix(p, "b/d") || p == "b/f.txt" {
+			t.Errorf("next page looked up %q, from the first page", p)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// sdNotify sends a state notification to the service manager, as described
+// in sd_notify(3). It does nothing if $NOTIFY_SOCKET is not set, i.e. when
+// not running under systemd with Type=notify.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if socketPath[0] == '@' {
+		// Abstract socket namespace.
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
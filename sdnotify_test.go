@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenNotify listens for notifications on a unixgram socket with the given
+// address, and points $NOTIFY_SOCKET at it.
+func listenNotify(t *testing.T, name, notifySocket string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("cannot listen on %q: %v", name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", notifySocket)
+	return conn
+}
+
+// readNotification returns the next notification received on conn.
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("cannot read notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "notify")
+	conn := listenNotify(t, socketPath, socketPath)
+	for _, state := range []string{"READY=1", "RELOADING=1", "STOPPING=1"} {
+		if err := sdNotify(state); err != nil {
+			t.Fatalf("sdNotify(%q) = %v", state, err)
+		}
+		if got := readNotification(t, conn); got != state {
+			t.Errorf("sdNotify(%q) sent %q", state, got)
+		}
+	}
+}
+
+func TestSdNotifyAbstractSocket(t *testing.T) {
+	name := "splitfs-test-" + filepath.Base(t.TempDir())
+	conn := listenNotify(t, "@"+name, "@"+name)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify = %v", err)
+	}
+	if got := readNotification(t, conn); got != "READY=1" {
+		t.Errorf("sdNotify sent %q, want %q", got, "READY=1")
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without $NOTIFY_SOCKET = %v, want nil", err)
+	}
+}
+
+func TestSdNotifyMissingSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Error("sdNotify to a missing socket succeeded")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"perot.me/splitfs/ninepfs"
+	"perot.me/splitfs/split"
+)
+
+// serve9P serves the chunked view of the source directory over 9P2000.L on
+// the given address, instead of mounting it. The address is either a
+// 'host:port'-formatted string, or the path of a Unix socket prefixed with
+// 'unix:'. It only returns on error.
+func serve9P(options *mountOptions, source, address string) error {
+	chunkSize, splitOptions, err := options.splitOptions()
+	if err != nil {
+		return err
+	}
+	view, err := split.NewIOFS(source, chunkSize, splitOptions...)
+	if err != nil {
+		return fmt.Errorf("cannot initialize filesystem: %v", err)
+	}
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		// Remove the socket left behind by a previous run.
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	infof("Serving %s over 9P2000.L on %s", source, address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := ninepfs.Serve(view, conn); err != nil {
+				debugf("9P connection failed: %v", err)
+			}
+		}()
+	}
+}
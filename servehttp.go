@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"perot.me/splitfs/s3fs"
+	"perot.me/splitfs/split"
+)
+
+// serveHTTP serves the chunked view of the source directory on the given
+// address, instead of mounting it, with the handler for the given protocol.
+// It only returns on error.
+func serveHTTP(options *mountOptions, source, hostPort, protocol string, handler func(*split.IOFS) http.Handler) error {
+	chunkSize, splitOptions, err := options.splitOptions()
+	if err != nil {
+		return err
+	}
+	view, err := split.NewIOFS(source, chunkSize, splitOptions...)
+	if err != nil {
+		return fmt.Errorf("cannot initialize filesystem: %v", err)
+	}
+	infof("Serving %s over %s on %s", source, protocol, hostPort)
+	return http.ListenAndServe(hostPort, handler(view))
+}
+
+// serveS3 serves the chunked view of source directories as the buckets of
+// an S3-compatible API on the given address, instead of mounting them. Each
+// bucket is given as <bucket>=<source directory>. It only returns on error.
+func serveS3(options *mountOptions, buckets []string, hostPort string) error {
+	chunkSize, splitOptions, err := options.splitOptions()
+	if err != nil {
+		return err
+	}
+	filesystems := make(map[string]*split.IOFS)
+	for _, bucket := range buckets {
+		parts := strings.SplitN(bucket, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], "/") || parts[1] == "" {
+			return fmt.Errorf("invalid bucket %q: must be <bucket>=<source directory>", bucket)
+		}
+		if _, ok := filesystems[parts[0]]; ok {
+			return fmt.Errorf("bucket %q is specified more than once", parts[0])
+		}
+		view, err := split.NewIOFS(parts[1], chunkSize, splitOptions...)
+		if err != nil {
+			return fmt.Errorf("bucket %q: cannot initialize filesystem: %v", parts[0], err)
+		}
+		filesystems[parts[0]] = view
+		infof("Serving %s as bucket %s", parts[1], parts[0])
+	}
+	infof("Serving S3 API on %s", hostPort)
+	return http.ListenAndServe(hostPort, s3fs.Handler(filesystems))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"perot.me/splitfs/sftpfs"
+	"perot.me/splitfs/split"
+)
+
+// readAuthorizedKeys returns the public keys listed in the given file, in
+// the format of OpenSSH's authorized_keys files. Keys with options, such as
+// from= or command=, are refused rather than granted access without the
+// restrictions they ask for.
+func readAuthorizedKeys(authorizedKeysPath string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(authorizedKeysPath)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for len(data) != 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// Only blank lines and comments are left.
+			break
+		}
+		if len(options) != 0 {
+			return nil, fmt.Errorf("%s: key %q has options %q, which are not supported", authorizedKeysPath, comment, options)
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys", authorizedKeysPath)
+	}
+	return keys, nil
+}
+
+// serveSFTP serves the chunked view of the source directory over SFTP on the
+// given address, instead of mounting it. The SSH server authenticates
+// clients with the public keys of the given authorized_keys file, and
+// identifies itself with the given private host key. It only returns on
+// error.
+func serveSFTP(options *mountOptions, source, hostPort, hostKeyPath, authorizedKeysPath string) error {
+	if hostKeyPath == "" || authorizedKeysPath == "" {
+		return errors.New("serving over SFTP requires --sftp_host_key and --sftp_authorized_keys")
+	}
+	hostKeyData, err := ioutil.ReadFile(hostKeyPath)
+	if err != nil {
+		return fmt.Errorf("cannot read host key: %v", err)
+	}
+	hostKey, err := ssh.ParsePrivateKey(hostKeyData)
+	if err != nil {
+		return fmt.Errorf("cannot parse host key %s: %v", hostKeyPath, err)
+	}
+	authorizedKeys, err := readAuthorizedKeys(authorizedKeysPath)
+	if err != nil {
+		return fmt.Errorf("cannot read authorized keys: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !authorizedKeys[string(key.Marshal())] {
+				return nil, fmt.Errorf("unknown public key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	chunkSize, splitOptions, err := options.splitOptions()
+	if err != nil {
+		return err
+	}
+	view, err := split.NewIOFS(source, chunkSize, splitOptions...)
+	if err != nil {
+		return fmt.Errorf("cannot initialize filesystem: %v", err)
+	}
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return err
+	}
+	infof("Serving %s over SFTP on %s", source, hostPort)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSSHConn(conn, config, view)
+	}
+}
+
+// serveSSHConn serves the sftp subsystem to the sessions of an SSH
+// connection. Shells, commands and port forwarding are refused.
+func serveSSHConn(conn net.Conn, config *ssh.ServerConfig, view *split.IOFS) {
+	defer conn.Close()
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		debugf("SSH handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sshConn.Close()
+	infof("SFTP connection from %s@%s", sshConn.User(), sshConn.RemoteAddr())
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSSHSession(channel, requests, view)
+	}
+}
+
+// serveSSHSession serves a session once it requests the sftp subsystem.
+func serveSSHSession(channel ssh.Channel, requests <-chan *ssh.Request, view *split.IOFS) {
+	defer channel.Close()
+	for request := range requests {
+		// The payload of subsystem requests is the name of the subsystem, as
+		// an SSH string.
+		isSFTP := request.Type == "subsystem" && string(request.Payload) == "\x00\x00\x00\x04sftp"
+		request.Reply(isSFTP, nil)
+		if !isSFTP {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		exitStatus := uint32(0)
+		if err := sftpfs.Serve(view, channel); err != nil {
+			debugf("SFTP session failed: %v", err)
+			exitStatus = 1
+		}
+		channel.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, exitStatus))
+		return
+	}
+}
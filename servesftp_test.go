@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newAuthorizedKey returns a new public key, as a line of an authorized_keys
+// file without its trailing newline.
+func newAuthorizedKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n")
+}
+
+func TestReadAuthorizedKeys(t *testing.T) {
+	first, firstLine := newAuthorizedKey(t)
+	second, secondLine := newAuthorizedKey(t)
+	_, unlisted := newAuthorizedKey(t)
+	for _, test := range []struct {
+		name    string
+		content string
+		want    []ssh.PublicKey
+		err     string
+	}{
+		{"keys and comments", "# comment\n\n" + firstLine + " alice@host\n" + secondLine + "\n# trailing comment\n", []ssh.PublicKey{first, second}, ""},
+		{"only comments", "# comment\n\n", nil, "no public keys"},
+		{"from option", firstLine + "\nfrom=\"10.0.0.1\" " + unlisted + " bob@host\n", nil, "has options"},
+		{"command option", "command=\"/bin/true\",no-pty " + unlisted + "\n", nil, "has options"},
+		{"restrict option", "restrict " + unlisted + "\n", nil, "has options"},
+	} {
+		authorizedKeysPath := filepath.Join(t.TempDir(), "authorized_keys")
+		if err := os.WriteFile(authorizedKeysPath, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := readAuthorizedKeys(authorizedKeysPath)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: readAuthorizedKeys = %v, want an error about %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: readAuthorizedKeys = %v", test.name, err)
+			continue
+		}
+		if len(keys) != len(test.want) {
+			t.Errorf("%s: got %d keys, want %d", test.name, len(keys), len(test.want))
+		}
+		for _, key := range test.want {
+			if !keys[string(key.Marshal())] {
+				t.Errorf("%s: key %s missing", test.name, ssh.FingerprintSHA256(key))
+			}
+		}
+	}
+}
@@ -0,0 +1,507 @@
+// Package sftpfs serves the chunked view of package split over version 3 of
+// the SFTP protocol, read-only, on a channel such as an SSH session. It is
+// built on the io/fs view of the filesystem, split.IOFS, so it serves the
+// same tree as the mountpoint.
+package sftpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"perot.me/splitfs/split"
+)
+
+// Packet types of version 3 of the SFTP protocol, as described in
+// draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpReadlink = 19
+	sftpSymlink  = 20
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+// Status codes of the SFTP protocol.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// Attribute flags and open flags of the SFTP protocol.
+const (
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+
+	sftpOpenRead = 0x1
+)
+
+const (
+	// sftpMaxPacket is the maximum size of the packets that clients send.
+	// Clients are expected to keep them below 34000 bytes.
+	sftpMaxPacket = 256 << 10
+	// sftpMaxRead is the maximum number of bytes read at once.
+	sftpMaxRead = 64 << 10
+	// sftpReaddirBatch is the maximum number of entries listed at once.
+	sftpReaddirBatch = 128
+)
+
+// errSFTPBadMessage is returned for malformed packets.
+var errSFTPBadMessage = errors.New("malformed SFTP packet")
+
+// sftpPacket parses the fields of a packet.
+type sftpPacket []byte
+
+func (p *sftpPacket) uint32() (uint32, error) {
+	if len(*p) < 4 {
+		return 0, errSFTPBadMessage
+	}
+	v := binary.BigEndian.Uint32(*p)
+	*p = (*p)[4:]
+	return v, nil
+}
+
+func (p *sftpPacket) uint64() (uint64, error) {
+	if len(*p) < 8 {
+		return 0, errSFTPBadMessage
+	}
+	v := binary.BigEndian.Uint64(*p)
+	*p = (*p)[8:]
+	return v, nil
+}
+
+func (p *sftpPacket) string() (string, error) {
+	n, err := p.uint32()
+	if err != nil || uint32(len(*p)) < n {
+		return "", errSFTPBadMessage
+	}
+	v := string((*p)[:n])
+	*p = (*p)[n:]
+	return v, nil
+}
+
+// sftpResponse builds a packet to send.
+type sftpResponse []byte
+
+func newSFTPResponse(packetType byte, id uint32) *sftpResponse {
+	r := sftpResponse{0, 0, 0, 0, packetType}
+	r.uint32(id)
+	return &r
+}
+
+func (r *sftpResponse) uint32(v uint32) {
+	*r = binary.BigEndian.AppendUint32(*r, v)
+}
+
+func (r *sftpResponse) uint64(v uint64) {
+	*r = binary.BigEndian.AppendUint64(*r, v)
+}
+
+func (r *sftpResponse) string(v string) {
+	r.uint32(uint32(len(v)))
+	*r = append(*r, v...)
+}
+
+// attrs appends the attributes of a node.
+func (r *sftpResponse) attrs(info iofs.FileInfo) {
+	attr := info.Sys().(*split.Attr)
+	r.uint32(sftpAttrSize | sftpAttrUIDGID | sftpAttrPermissions | sftpAttrACModTime)
+	r.uint64(attr.Size)
+	r.uint32(attr.Uid)
+	r.uint32(attr.Gid)
+	r.uint32(split.UnixMode(attr.Mode))
+	r.uint32(uint32(attr.Atime.Unix()))
+	r.uint32(uint32(attr.Mtime.Unix()))
+}
+
+// bytes returns the packet, with its length.
+func (r *sftpResponse) bytes() []byte {
+	binary.BigEndian.PutUint32(*r, uint32(len(*r)-4))
+	return *r
+}
+
+// longName returns the description of a node that SFTP clients show in
+// long listings, in the format of ls -l.
+func longName(info iofs.FileInfo) string {
+	attr := info.Sys().(*split.Attr)
+	mode := attr.Mode
+	kind := "-"
+	switch {
+	case mode.IsDir():
+		kind = "d"
+	case mode&os.ModeSymlink != 0:
+		kind = "l"
+	case mode&os.ModeNamedPipe != 0:
+		kind = "p"
+	case mode&os.ModeSocket != 0:
+		kind = "s"
+	case mode&os.ModeCharDevice != 0:
+		kind = "c"
+	case mode&os.ModeDevice != 0:
+		kind = "b"
+	}
+	date := attr.Mtime.Format("Jan _2 15:04")
+	if time.Since(attr.Mtime) > 180*24*time.Hour {
+		date = attr.Mtime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s%s %3d %-8d %-8d %8d %s %s", kind, mode.Perm().String()[1:], attr.Nlink, attr.Uid, attr.Gid, attr.Size, date, info.Name())
+}
+
+// fileReader is a regular file opened through split.IOFS.
+type fileReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// sftpOpenFile is a file or directory opened by an SFTP client.
+type sftpOpenFile struct {
+	info iofs.FileInfo
+	// reader reads regular files. It is nil for directories.
+	reader fileReader
+	// dir lists directories, a batch of entries per request, so that
+	// huge directories, such as the chunks of a huge file, are neither
+	// read nor held in memory at once. It is nil for regular files.
+	dir iofs.ReadDirFile
+}
+
+// close closes the file or directory.
+func (h *sftpOpenFile) close() error {
+	if h.dir != nil {
+		return h.dir.Close()
+	}
+	return h.reader.Close()
+}
+
+// sftpServer serves a filesystem to an SFTP client, read-only.
+type sftpServer struct {
+	view       *split.IOFS
+	rw         io.ReadWriter
+	handles    map[string]*sftpOpenFile
+	nextHandle uint64
+}
+
+// Serve serves the given view over the SFTP protocol, version 3, on the
+// given channel, such as an SSH session that requested the sftp subsystem,
+// until the client closes it. The root of the view is presented as /, and
+// is the initial working directory. Only reading is supported: requests
+// that would modify the filesystem are denied.
+func Serve(view *split.IOFS, rw io.ReadWriter) error {
+	s := &sftpServer{
+		view:    view,
+		rw:      rw,
+		handles: make(map[string]*sftpOpenFile),
+	}
+	defer func() {
+		for _, h := range s.handles {
+			h.close()
+		}
+	}()
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(rw, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length == 0 || length > sftpMaxPacket {
+			return fmt.Errorf("invalid SFTP packet length %d", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(rw, packet); err != nil {
+			return err
+		}
+		response, err := s.handle(packet[0], sftpPacket(packet[1:]))
+		if err != nil {
+			return err
+		}
+		if _, err := rw.Write(response.bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// handle returns the response to a packet.
+func (s *sftpServer) handle(packetType byte, p sftpPacket) (*sftpResponse, error) {
+	if packetType == sftpInit {
+		// No extensions are supported.
+		r := sftpResponse{0, 0, 0, 0, sftpVersion}
+		r.uint32(3)
+		return &r, nil
+	}
+	id, err := p.uint32()
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.handleRequest(packetType, id, p)
+	if err == errSFTPBadMessage {
+		return sftpStatusResponse(id, sftpBadMessage, err.Error()), nil
+	}
+	if err != nil {
+		return sftpErrorResponse(id, err), nil
+	}
+	return r, nil
+}
+
+// handleRequest returns the response to a request with the given ID.
+func (s *sftpServer) handleRequest(packetType byte, id uint32, p sftpPacket) (*sftpResponse, error) {
+	switch packetType {
+	case sftpOpen:
+		name, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		flags, err := p.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if flags&^sftpOpenRead != 0 {
+			return nil, syscall.EROFS
+		}
+		file, info, err := s.open(name)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			file.Close()
+			return nil, syscall.EISDIR
+		}
+		return s.newHandle(id, &sftpOpenFile{info: info, reader: file.(fileReader)}), nil
+	case sftpOpendir:
+		name, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		file, info, err := s.open(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			file.Close()
+			return nil, syscall.ENOTDIR
+		}
+		return s.newHandle(id, &sftpOpenFile{info: info, dir: file.(iofs.ReadDirFile)}), nil
+	case sftpClose:
+		handle, h, err := s.openFile(&p)
+		if err != nil {
+			return nil, err
+		}
+		delete(s.handles, handle)
+		if err := h.close(); err != nil {
+			return nil, err
+		}
+		return sftpStatusResponse(id, sftpOK, "Success"), nil
+	case sftpRead:
+		_, h, err := s.openFile(&p)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := p.uint64()
+		if err != nil {
+			return nil, err
+		}
+		length, err := p.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if h.reader == nil {
+			return nil, syscall.EISDIR
+		}
+		if length > sftpMaxRead {
+			length = sftpMaxRead
+		}
+		data := make([]byte, length)
+		n, err := h.reader.ReadAt(data, int64(offset))
+		if n == 0 && (err == io.EOF || err == nil) {
+			return sftpStatusResponse(id, sftpEOF, "End of file"), nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		r := newSFTPResponse(sftpData, id)
+		r.string(string(data[:n]))
+		return r, nil
+	case sftpReaddir:
+		_, h, err := s.openFile(&p)
+		if err != nil {
+			return nil, err
+		}
+		if h.dir == nil {
+			return nil, syscall.ENOTDIR
+		}
+		var entries []iofs.FileInfo
+		for len(entries) == 0 {
+			dirEntries, err := h.dir.ReadDir(sftpReaddirBatch)
+			if err == io.EOF {
+				return sftpStatusResponse(id, sftpEOF, "End of directory"), nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, dirEntry := range dirEntries {
+				// Entries that disappear while the directory is read are
+				// left out.
+				if info, err := dirEntry.Info(); err == nil {
+					entries = append(entries, info)
+				}
+			}
+		}
+		r := newSFTPResponse(sftpName, id)
+		r.uint32(uint32(len(entries)))
+		for _, info := range entries {
+			r.string(info.Name())
+			r.string(longName(info))
+			r.attrs(info)
+		}
+		return r, nil
+	case sftpStat, sftpLstat:
+		name, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		stat := s.view.Lstat
+		if packetType == sftpStat {
+			stat = s.view.Stat
+		}
+		info, err := stat(split.CleanPath(name))
+		if err != nil {
+			return nil, err
+		}
+		r := newSFTPResponse(sftpAttrs, id)
+		r.attrs(info)
+		return r, nil
+	case sftpFstat:
+		_, h, err := s.openFile(&p)
+		if err != nil {
+			return nil, err
+		}
+		r := newSFTPResponse(sftpAttrs, id)
+		r.attrs(h.info)
+		return r, nil
+	case sftpRealpath:
+		name, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		r := newSFTPResponse(sftpName, id)
+		r.uint32(1)
+		r.string(path.Clean("/" + name))
+		r.string(path.Clean("/" + name))
+		r.uint32(0)
+		return r, nil
+	case sftpReadlink:
+		name, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		target, err := s.view.ReadLink(split.CleanPath(name))
+		if err != nil {
+			return nil, err
+		}
+		r := newSFTPResponse(sftpName, id)
+		r.uint32(1)
+		r.string(target)
+		r.string(target)
+		r.uint32(0)
+		return r, nil
+	case sftpWrite, sftpSetstat, sftpFsetstat, sftpRemove, sftpMkdir, sftpRmdir, sftpRename, sftpSymlink:
+		return nil, syscall.EROFS
+	}
+	return sftpStatusResponse(id, sftpOpUnsupported, "Operation unsupported"), nil
+}
+
+// open opens the file or directory at the given path, and returns
+// information about it.
+func (s *sftpServer) open(name string) (iofs.File, iofs.FileInfo, error) {
+	file, err := s.view.Open(split.CleanPath(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// newHandle registers an opened file or directory, and returns the response
+// with its handle.
+func (s *sftpServer) newHandle(id uint32, h *sftpOpenFile) *sftpResponse {
+	s.nextHandle++
+	handle := strconv.FormatUint(s.nextHandle, 10)
+	s.handles[handle] = h
+	r := newSFTPResponse(sftpHandle, id)
+	r.string(handle)
+	return r
+}
+
+// openFile returns the opened file or directory that a request refers to.
+func (s *sftpServer) openFile(p *sftpPacket) (string, *sftpOpenFile, error) {
+	handle, err := p.string()
+	if err != nil {
+		return "", nil, err
+	}
+	h, ok := s.handles[handle]
+	if !ok {
+		return "", nil, syscall.EBADF
+	}
+	return handle, h, nil
+}
+
+// sftpStatusResponse returns a status response.
+func sftpStatusResponse(id, code uint32, message string) *sftpResponse {
+	r := newSFTPResponse(sftpStatus, id)
+	r.uint32(code)
+	r.string(message)
+	r.string("")
+	return r
+}
+
+// sftpErrorResponse returns the status response for an error returned by
+// split.IOFS.
+func sftpErrorResponse(id uint32, err error) *sftpResponse {
+	code := uint32(sftpFailure)
+	switch split.Errno(err) {
+	case syscall.ENOENT, syscall.ENOTDIR:
+		code = sftpNoSuchFile
+	case syscall.EACCES, syscall.EPERM, syscall.EROFS:
+		code = sftpPermissionDenied
+	}
+	return sftpStatusResponse(id, code, err.Error())
+}
@@ -0,0 +1,248 @@
+package sftpfs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"perot.me/splitfs/split"
+)
+
+// sftpClient sends requests to Serve, over a pipe.
+type sftpClient struct {
+	t      *testing.T
+	conn   net.Conn
+	nextID uint32
+}
+
+func newSFTPClient(t *testing.T, view *split.IOFS) *sftpClient {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(view, server)
+		server.Close()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		if err := <-done; err != nil && err != io.ErrClosedPipe {
+			t.Errorf("Serve = %v", err)
+		}
+	})
+	c := &sftpClient{t: t, conn: client}
+	init := sftpResponse{0, 0, 0, 0, sftpInit}
+	init.uint32(3)
+	packetType, p := c.roundTrip(&init)
+	if version, _ := p.uint32(); packetType != sftpVersion || version != 3 {
+		t.Fatalf("SSH_FXP_INIT: got packet %d with version %d, want version 3", packetType, version)
+	}
+	return c
+}
+
+// roundTrip sends a packet, and returns the type and content of the response.
+func (c *sftpClient) roundTrip(request *sftpResponse) (byte, sftpPacket) {
+	c.t.Helper()
+	if _, err := c.conn.Write(request.bytes()); err != nil {
+		c.t.Fatalf("cannot send request: %v", err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatalf("cannot read response: %v", err)
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(c.conn, packet); err != nil {
+		c.t.Fatalf("cannot read response: %v", err)
+	}
+	return packet[0], sftpPacket(packet[1:])
+}
+
+// request sends a request with the given string arguments, and returns the
+// type and content of the response, after its ID.
+func (c *sftpClient) request(packetType byte, args ...string) (byte, sftpPacket) {
+	c.t.Helper()
+	c.nextID++
+	r := newSFTPResponse(packetType, c.nextID)
+	for _, arg := range args {
+		r.string(arg)
+	}
+	return c.send(r)
+}
+
+// send sends a request, and returns the type and content of the response,
+// after its ID.
+func (c *sftpClient) send(r *sftpResponse) (byte, sftpPacket) {
+	c.t.Helper()
+	responseType, p := c.roundTrip(r)
+	if id, err := p.uint32(); err != nil || id != c.nextID {
+		c.t.Fatalf("response has ID %d, want %d", id, c.nextID)
+	}
+	return responseType, p
+}
+
+// status returns the status code of a response, or -1 if it is not a status.
+func status(packetType byte, p sftpPacket) int {
+	if packetType != sftpStatus {
+		return -1
+	}
+	code, _ := p.uint32()
+	return int(code)
+}
+
+// handle returns the handle of a response to an open request.
+func (c *sftpClient) handle(packetType byte, p sftpPacket) string {
+	c.t.Helper()
+	if packetType != sftpHandle {
+		c.t.Fatalf("got packet %d with status %d, want a handle", packetType, status(packetType, p))
+	}
+	handle, _ := p.string()
+	return handle
+}
+
+// readFile reads a whole file, in reads of the given size.
+func (c *sftpClient) readFile(name string, size uint32) string {
+	c.t.Helper()
+	c.nextID++
+	open := newSFTPResponse(sftpOpen, c.nextID)
+	open.string(name)
+	open.uint32(sftpOpenRead)
+	open.uint32(0)
+	handle := c.handle(c.send(open))
+	var content strings.Builder
+	for {
+		c.nextID++
+		read := newSFTPResponse(sftpRead, c.nextID)
+		read.string(handle)
+		read.uint64(uint64(content.Len()))
+		read.uint32(size)
+		packetType, p := c.send(read)
+		if status(packetType, p) == sftpEOF {
+			break
+		}
+		if packetType != sftpData {
+			c.t.Fatalf("read of %s: got packet %d with status %d", name, packetType, status(packetType, p))
+		}
+		data, _ := p.string()
+		content.WriteString(data)
+	}
+	if code := status(c.request(sftpClose, handle)); code != sftpOK {
+		c.t.Errorf("close of %s: status %d", name, code)
+	}
+	return content.String()
+}
+
+// readDir lists a whole directory.
+func (c *sftpClient) readDir(name string) []string {
+	c.t.Helper()
+	handle := c.handle(c.request(sftpOpendir, name))
+	var names []string
+	for {
+		packetType, p := c.request(sftpReaddir, handle)
+		if status(packetType, p) == sftpEOF {
+			break
+		}
+		if packetType != sftpName {
+			c.t.Fatalf("listing of %s: got packet %d with status %d", name, packetType, status(packetType, p))
+		}
+		count, _ := p.uint32()
+		for i := uint32(0); i < count; i++ {
+			entry, _ := p.string()
+			longName, _ := p.string()
+			if !strings.HasSuffix(longName, " "+entry) {
+				c.t.Errorf("long name of %s is %q", entry, longName)
+			}
+			p = p[4+8+4+4+4+4+4:]
+			names = append(names, entry)
+		}
+	}
+	if code := status(c.request(sftpClose, handle)); code != sftpOK {
+		c.t.Errorf("close of %s: status %d", name, code)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestServe(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "file.txt"), []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(source, "many"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < sftpReaddirBatch+10; i++ {
+		name := strings.Repeat("x", i+1) + ".txt"
+		want = append(want, name)
+		if err := os.WriteFile(filepath.Join(source, "many", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(want)
+	if err := os.Symlink("file.txt", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := split.NewFS(source, 5, split.ExcludeRegexp(`\.txt$`), split.Symlinks(split.SymlinksRewrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newSFTPClient(t, f.IOFS())
+
+	if got := c.readFile("/file.txt", 5); got != "hello, world" {
+		t.Errorf("file.txt read as %q", got)
+	}
+	if got := c.readFile("link", sftpMaxRead); got != "hello, world" {
+		t.Errorf("link read as %q", got)
+	}
+	if got := c.readDir("/many"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("many listed as %q, want %q", got, want)
+	}
+	if got := c.readDir("/"); strings.Join(got, ",") != "file.txt,link,many" {
+		t.Errorf("root listed as %q", got)
+	}
+
+	packetType, p := c.request(sftpStat, "/file.txt")
+	if packetType != sftpAttrs {
+		t.Fatalf("stat: got packet %d", packetType)
+	}
+	if flags, _ := p.uint32(); flags&sftpAttrSize == 0 {
+		t.Errorf("stat: attributes without size")
+	}
+	if size, _ := p.uint64(); size != uint64(len("hello, world")) {
+		t.Errorf("stat: size %d", size)
+	}
+	packetType, p = c.request(sftpReadlink, "/link")
+	p.uint32()
+	if target, _ := p.string(); packetType != sftpName || target != "file.txt" {
+		t.Errorf("readlink: got packet %d with target %q", packetType, target)
+	}
+	packetType, p = c.request(sftpRealpath, "many/../file.txt")
+	p.uint32()
+	if name, _ := p.string(); packetType != sftpName || name != "/file.txt" {
+		t.Errorf("realpath: got packet %d with name %q", packetType, name)
+	}
+
+	if code := status(c.request(sftpStat, "/missing")); code != sftpNoSuchFile {
+		t.Errorf("stat of a missing file: status %d, want %d", code, sftpNoSuchFile)
+	}
+	for _, packetType := range []byte{sftpRemove, sftpMkdir, sftpRmdir} {
+		if code := status(c.request(packetType, "/file.txt")); code != sftpPermissionDenied {
+			t.Errorf("request %d: status %d, want %d", packetType, code, sftpPermissionDenied)
+		}
+	}
+	c.nextID++
+	write := newSFTPResponse(sftpOpen, c.nextID)
+	write.string("/file.txt")
+	write.uint32(sftpOpenRead | 0x2)
+	write.uint32(0)
+	if code := status(c.send(write)); code != sftpPermissionDenied {
+		t.Errorf("open for writing: status %d, want %d", code, sftpPermissionDenied)
+	}
+	if code := status(c.request(sftpReaddir, "no such handle")); code != sftpFailure {
+		t.Errorf("readdir of an unknown handle: status %d, want %d", code, sftpFailure)
+	}
+}
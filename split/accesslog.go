@@ -0,0 +1,79 @@
+package split
+
+import "time"
+
+// AccessLogEntry describes a single FUSE operation.
+type AccessLogEntry struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	// Path is relative to the root of the filesystem.
+	Path string `json:"path"`
+	// Chunk is the 0-based index of the chunk the operation was about, if any.
+	Chunk *int64 `json:"chunk,omitempty"`
+	// Errno is the name of the error returned to the kernel, if any.
+	Errno     string  `json:"errno,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	// Reason explains why a lookup was rejected, or holds the underlying
+	// error message.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Failed reports whether the operation returned an error.
+func (e *AccessLogEntry) Failed() bool {
+	return e.Errno != ""
+}
+
+// AccessLog makes the filesystem call log after every FUSE operation.
+// log may be called concurrently.
+func AccessLog(log func(*AccessLogEntry)) Option {
+	return func(f *FS) error {
+		f.accessLog = log
+		return nil
+	}
+}
+
+// opRecord tracks a FUSE operation, to report it in metrics and in the
+// access log once it ends.
+type opRecord struct {
+	splitFS *FS
+	kind    opKind
+	path    string
+	chunk   int64
+	start   time.Time
+}
+
+// startOp starts tracking a FUSE operation on the given root-relative path.
+// The returned record's end method is meant to be deferred.
+func (f *FS) startOp(kind opKind, rootRelativePath string) *opRecord {
+	return &opRecord{f, kind, rootRelativePath, -1, time.Now()}
+}
+
+// setChunk records that the operation is about the given chunk.
+func (r *opRecord) setChunk(chunk int64) {
+	r.chunk = chunk
+}
+
+// end records the outcome of the operation. errp points to the operation's
+// named error result.
+func (r *opRecord) end(errp *error) {
+	latency := time.Since(r.start)
+	r.splitFS.metrics.op(r.kind, latency, *errp)
+	if r.splitFS.accessLog == nil {
+		return
+	}
+	entry := &AccessLogEntry{
+		Time:      r.start,
+		Op:        opNames[r.kind],
+		Path:      r.path,
+		LatencyMS: float64(latency) / float64(time.Millisecond),
+	}
+	if r.chunk >= 0 {
+		chunk := r.chunk
+		entry.Chunk = &chunk
+	}
+	if err := *errp; err != nil {
+		entry.Errno = errnoName(err)
+		entry.Reason = err.Error()
+	}
+	r.splitFS.accessLog(entry)
+}
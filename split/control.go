@@ -0,0 +1,222 @@
+package split
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// controlDirectoryName is the name of the control directory, at the root of
+// the filesystem. It shadows any file of the same name in the source.
+const controlDirectoryName = ".splitfs"
+
+// ControlHooks lets the control directory perform actions that are outside
+// of the filesystem's reach.
+type ControlHooks struct {
+	// Config returns the effective configuration of the mount.
+	Config func() []byte
+	// Reload reloads the configuration of the mount.
+	Reload func() error
+}
+
+// ControlDirectory enables a hidden control directory at the root of the
+// filesystem. It exposes statistics and accepts commands.
+func ControlDirectory(hooks ControlHooks) Option {
+	return func(f *FS) error {
+		f.control = &hooks
+		return nil
+	}
+}
+
+// controlFile is a file in the control directory.
+// Reading it returns the output of read; writing to it calls write with the
+// written data. Frontends that serve several users must only let the owner
+// of the filesystem, or root, write to it.
+type controlFile struct {
+	splitFS *FS
+	name    string
+	read    func() []byte
+	write   func([]byte) error
+}
+
+var _ fsNode = (*controlFile)(nil)
+var _ nodeOpener = (*controlFile)(nil)
+var _ handleReadAller = (*controlFile)(nil)
+var _ handleWriter = (*controlFile)(nil)
+
+func (c *controlFile) Attr(_ context.Context, attr *Attr) error {
+	attr.Inode = internalInode(c.name)
+	attr.Mode = 0444
+	if c.write != nil {
+		attr.Mode = 0200
+	}
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	attr.Nlink = 1
+	attr.Mtime = time.Now()
+	// Statistics change all the time, so they must not be cached.
+	attr.Valid = time.Nanosecond
+	// The size of control files is not known in advance.
+	attr.Volatile = true
+	return nil
+}
+
+func (c *controlFile) Open(_ context.Context, write bool) (fileHandle, error) {
+	if (write && c.write == nil) || (!write && c.read == nil) {
+		return nil, syscall.EACCES
+	}
+	return c, nil
+}
+
+func (c *controlFile) ReadAll(context.Context) ([]byte, error) {
+	if c.read == nil {
+		return nil, syscall.EACCES
+	}
+	return c.read(), nil
+}
+
+func (c *controlFile) Write(_ context.Context, data []byte) error {
+	if c.write == nil {
+		return syscall.EACCES
+	}
+	if err := c.write(data); err != nil {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// controlDirectoryInode is the inode number of the control directory.
+// Source inodes are unlikely to be this high.
+const controlDirectoryInode = ^uint64(0) - 1
+
+// controlDirectory is the hidden directory containing control files.
+type controlDirectory struct {
+	splitFS *FS
+}
+
+var _ fsNode = (*controlDirectory)(nil)
+var _ nodeReadDirAller = (*controlDirectory)(nil)
+var _ nodeLookuper = (*controlDirectory)(nil)
+
+func (c *controlDirectory) Attr(_ context.Context, attr *Attr) error {
+	attr.Inode = controlDirectoryInode
+	attr.Mode = os.ModeDir | 0555
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	attr.Nlink = 2
+	return nil
+}
+
+// files returns the files of the control directory, by name.
+func (c *controlDirectory) files() map[string]*controlFile {
+	f := c.splitFS
+	readString := func(write func(*bytes.Buffer)) func() []byte {
+		return func() []byte {
+			var buf bytes.Buffer
+			write(&buf)
+			return buf.Bytes()
+		}
+	}
+	files := []*controlFile{
+		{name: "config", read: func() []byte {
+			if f.control.Config == nil {
+				return nil
+			}
+			return f.control.Config()
+		}},
+		{name: "stats", read: readString(func(buf *bytes.Buffer) { f.writeStats(buf) })},
+		{name: "errors", read: readString(func(buf *bytes.Buffer) { f.writeErrors(buf) })},
+		{name: "invalidate", write: func(data []byte) error {
+			return f.invalidate(strings.TrimSpace(string(data)))
+		}},
+		{name: "checkpoint", write: func([]byte) error {
+			f.stats.doCheckpoint()
+			return nil
+		}},
+		{name: "reload", write: func([]byte) error {
+			if f.control.Reload == nil {
+				return errors.New("reloading is not supported")
+			}
+			return f.control.Reload()
+		}},
+	}
+	byName := make(map[string]*controlFile, len(files))
+	for _, file := range files {
+		file.splitFS = f
+		byName[file.name] = file
+	}
+	return byName
+}
+
+func (c *controlDirectory) ReadDirAll(context.Context) ([]dirent, error) {
+	var entries []dirent
+	for name := range c.files() {
+		entries = append(entries, dirent{
+			inode: internalInode(name),
+			name:  name,
+		})
+	}
+	return entries, nil
+}
+
+func (c *controlDirectory) Lookup(_ context.Context, name string) (fsNode, error) {
+	if file, ok := c.files()[name]; ok {
+		return file, nil
+	}
+	return nil, syscall.ENOENT
+}
+
+// Invalidator drops entries from the caches of a frontend, such as those of
+// the kernel for a mountpoint. Directories are given by their root-relative
+// path. Errors only mean that the frontend did not have the entry cached.
+type Invalidator interface {
+	// Directories returns the directories whose entries may be cached.
+	Directories() []string
+	// InvalidateEntry drops the cached entry with the given name of the
+	// given directory.
+	InvalidateEntry(dir, name string) error
+	// InvalidateDirectory drops the cached content of the given directory.
+	InvalidateDirectory(dir string) error
+}
+
+// SetInvalidator sets the caches to invalidate when files change, or when
+// asked to through the control directory.
+func (f *FS) SetInvalidator(invalidator Invalidator) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.invalidator = invalidator
+}
+
+// invalidate drops the cached entries for the given root-relative path, or
+// for everything if the path is empty.
+func (f *FS) invalidate(rootRelativePath string) error {
+	f.mu.RLock()
+	invalidator := f.invalidator
+	f.mu.RUnlock()
+	if invalidator == nil {
+		return nil
+	}
+	rootRelativePath = cleanPath(rootRelativePath)
+	if rootRelativePath != "" {
+		invalidator.InvalidateEntry(parentPath(rootRelativePath), path.Base(rootRelativePath))
+		return nil
+	}
+	for _, dir := range invalidator.Directories() {
+		invalidator.InvalidateDirectory(dir)
+		files, err := ioutil.ReadDir(path.Join(f.sourceDirectory, dir))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			invalidator.InvalidateEntry(dir, file.Name())
+		}
+	}
+	return nil
+}
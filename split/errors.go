@@ -0,0 +1,85 @@
+package split
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorNumber is an error that frontends reply to their clients with a
+// specific errno for.
+type errorNumber interface {
+	Errno() syscall.Errno
+}
+
+// sourceError is an error that happened on the source filesystem.
+// It keeps the original error message, while clients see its errno.
+type sourceError struct {
+	errno syscall.Errno
+	err   error
+}
+
+var _ errorNumber = (*sourceError)(nil)
+
+func (e *sourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sourceError) Errno() syscall.Errno {
+	return e.errno
+}
+
+// sourceErr records an error that happened on the node's source file, and
+// converts it into an error that carries its errno.
+func (n *node) sourceErr(err error) error {
+	errnoErr := &sourceError{toErrno(err), err}
+	n.splitFS.stats.recordError(n.rootRelativePath, errnoErr)
+	return errnoErr
+}
+
+// toErrno returns the errno to reply to clients with for an error returned
+// by nodes, or by the os or syscall packages. The original errno is passed
+// through whenever there is one, so that the kernel and applications see
+// the real cause (EACCES, ELOOP, ENAMETOOLONG, ESTALE, ...). Errors that do
+// not carry an errno are reported as EIO.
+func toErrno(err error) syscall.Errno {
+	for {
+		switch e := err.(type) {
+		case errorNumber:
+			return e.Errno()
+		case syscall.Errno:
+			if e == 0 {
+				return syscall.EIO
+			}
+			return e
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			return syscall.EIO
+		}
+	}
+}
+
+// Errno returns the errno of an error returned by IOFS, for the servers of
+// protocols that report errnos or map them to their own errors. Errors that
+// do not carry an errno are reported as EIO.
+func Errno(err error) syscall.Errno {
+	return toErrno(err)
+}
+
+// rejection is an error explaining why a name was not found.
+// Clients see it as ENOENT.
+type rejection string
+
+var _ errorNumber = rejection("")
+
+func (r rejection) Error() string {
+	return string(r)
+}
+
+func (r rejection) Errno() syscall.Errno {
+	return syscall.ENOENT
+}
@@ -0,0 +1,115 @@
+package split
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestToErrno(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want syscall.Errno
+	}{
+		{"ENOENT", syscall.ENOENT, syscall.ENOENT},
+		{"EACCES", syscall.EACCES, syscall.EACCES},
+		{"EPERM", syscall.EPERM, syscall.EPERM},
+		{"ELOOP", syscall.ELOOP, syscall.ELOOP},
+		{"ENAMETOOLONG", syscall.ENAMETOOLONG, syscall.ENAMETOOLONG},
+		{"ESTALE", syscall.ESTALE, syscall.ESTALE},
+		{"EIO", syscall.EIO, syscall.EIO},
+		{"zero errno", syscall.Errno(0), syscall.EIO},
+		{"no errno", errors.New("unsupported file mode"), syscall.EIO},
+		{"PathError", &os.PathError{Op: "lstat", Path: "/source/a", Err: syscall.EACCES}, syscall.EACCES},
+		{"LinkError", &os.LinkError{Op: "readlink", Old: "/source/a", New: "", Err: syscall.ELOOP}, syscall.ELOOP},
+		{"SyscallError", os.NewSyscallError("getdents", syscall.ENAMETOOLONG), syscall.ENAMETOOLONG},
+		{"PathError wrapping SyscallError", &os.PathError{Op: "open", Path: "/source/a", Err: os.NewSyscallError("open", syscall.ESTALE)}, syscall.ESTALE},
+		{"PathError without errno", &os.PathError{Op: "open", Path: "/source/a", Err: errors.New("closed")}, syscall.EIO},
+		{"rejection", rejection("hash mismatch"), syscall.ENOENT},
+		{"sourceError", &sourceError{syscall.EACCES, errors.New("denied")}, syscall.EACCES},
+	} {
+		if got := toErrno(test.err); got != test.want {
+			t.Errorf("%s: toErrno(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestSourceErr(t *testing.T) {
+	f := &FS{}
+	n := &node{splitFS: f, rootRelativePath: "a/b"}
+	err := n.sourceErr(&os.PathError{Op: "lstat", Path: "/source/a/b", Err: syscall.EACCES})
+	errno, ok := err.(errorNumber)
+	if !ok || errno.Errno() != syscall.EACCES {
+		t.Fatalf("sourceErr returned %#v, want an error with errno EACCES", err)
+	}
+	if !strings.Contains(err.Error(), "/source/a/b") {
+		t.Errorf("sourceErr lost the original message: %q", err.Error())
+	}
+	if f.stats.errors != 1 || f.stats.pathErrors["a/b"] == nil {
+		t.Errorf("sourceErr did not record the error on the path")
+	}
+	// Missing files are routine, and not recorded.
+	n.sourceErr(syscall.ENOENT)
+	if f.stats.errors != 1 {
+		t.Errorf("sourceErr recorded ENOENT")
+	}
+}
+
+// TestLookupErrors checks the errnos that lookups on a real source
+// directory reply with.
+func TestLookupErrors(t *testing.T) {
+	source := t.TempDir()
+	if err := os.Symlink("loop", filepath.Join(source, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		options []Option
+		lookup  string
+		want    syscall.Errno
+	}{
+		{"missing file", nil, "missing", syscall.ENOENT},
+		{"name too long", nil, strings.Repeat("a", 300), syscall.ENAMETOOLONG},
+		{"followed symlink loop", []Option{Symlinks(SymlinksFollow)}, "loop", syscall.ELOOP},
+		{"hidden symlink", []Option{Symlinks(SymlinksHide)}, "loop", syscall.ENOENT},
+	} {
+		f, err := NewFS(source, 1, test.options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.root().Lookup(context.Background(), test.lookup)
+		if got := toErrno(err); got != test.want {
+			t.Errorf("%s: Lookup(%q) = %v, want %v", test.name, test.lookup, err, test.want)
+		}
+	}
+	if os.Geteuid() == 0 {
+		t.Log("running as root; skipping EACCES")
+		return
+	}
+	denied := filepath.Join(source, "denied")
+	if err := os.Mkdir(denied, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(denied, 0755)
+	f, err := NewFS(source, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.lookupPath(context.Background(), "denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.(*directory).ReadDirAll(context.Background())
+	if got := toErrno(err); got != syscall.EACCES {
+		t.Errorf("ReadDirAll on an unreadable directory = %v, want EACCES", err)
+	}
+}
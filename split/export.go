@@ -0,0 +1,287 @@
+package split
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// NFSExport makes the filesystem suitable for re-exporting over NFS. NFS
+// clients refer to files by handles made of the FUSE node ID and generation
+// number, which must keep referring to the same node after the kernel
+// evicted it from its caches, and after remounts. The filesystem is then
+// served with the inode numbers of nodes as their node IDs, and the birth
+// time of source files as their generation numbers, and can find any node
+// again from its node ID, with InodePath.
+//
+// The mount must also advertise export support to the kernel, with the
+// fusefs.ExportSupport mount option.
+//
+// As node IDs are inode numbers, no two nodes may share one: NFS export
+// requires DedupHardLinks, and is incompatible with SymlinksFollow.
+func NFSExport(nfsExport bool) Option {
+	return func(f *FS) error {
+		f.nfsExport = nfsExport
+		return nil
+	}
+}
+
+// NFSExported reports whether the filesystem is to be exported over NFS.
+func (f *FS) NFSExported() bool {
+	return f.nfsExport
+}
+
+// rememberPath records the root-relative path of the source file with the
+// given stat, which was looked up, so that InodePath finds it quickly.
+func (f *FS) rememberPath(stat *syscall.Stat_t, rootRelativePath string) {
+	if !f.nfsExport {
+		return
+	}
+	inode := f.sourceInode(uint64(stat.Dev), stat.Ino)
+	i := &f.inodes
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.paths[inode] = rootRelativePath
+}
+
+// Generation returns the generation number of the node at the given
+// root-relative path: the birth time of its source file in nanoseconds, so
+// that an inode number reused by another source file does not refer to the
+// same node. It is 0 for nodes that are not source files, and if the source
+// filesystem does not record birth times.
+func (f *FS) Generation(rootRelativePath string) (uint64, error) {
+	n, err := f.lookupPath(context.Background(), rootRelativePath)
+	if err != nil {
+		return 0, err
+	}
+	source, ok := n.(interface{ sourceNode() *node })
+	if !ok {
+		return 0, nil
+	}
+	sn := source.sourceNode()
+	start := time.Now()
+	_, btime, err := birthTime(sn.FullPath(), sn.follow)
+	f.metrics.syscall(syscallStatx, start)
+	if err != nil || btime.IsZero() {
+		return 0, nil
+	}
+	return uint64(btime.UnixNano()), nil
+}
+
+// InodePath returns the root-relative path of the node with the given inode
+// number. Source files that were looked up since the filesystem was created
+// are found quickly; others are found by walking the source directory. The
+// node at the returned path may have another inode number, if the source
+// changed since.
+func (f *FS) InodePath(inode uint64) (string, error) {
+	root := Attr{}
+	if err := f.root().Attr(context.Background(), &root); err != nil {
+		return "", err
+	}
+	return f.inodePath(inode, root.Inode)
+}
+
+// inodePath implements InodePath, given the inode number of the root.
+func (f *FS) inodePath(inode, rootInode uint64) (string, error) {
+	if inode == rootInode {
+		return "", nil
+	}
+	if inode>>63 == 0 {
+		index, ino := inode>>inodeSourceBits, inode&(1<<inodeSourceBits-1)
+		dev, ok := f.inodeDevice(index)
+		if !ok {
+			return "", rejection("unknown source device")
+		}
+		return f.sourcePath(inode, dev, ino)
+	}
+	switch inode >> 60 {
+	case inodeInternalKind >> 60:
+		if inode>>56 == inodeLinkKind>>56 {
+			break
+		}
+		return f.internalPath(inode)
+	case inodeOverflowKind >> 60:
+		key, ok := f.inodeOverflowKey(inode)
+		switch {
+		case !ok:
+			return "", rejection("unknown inode number")
+		case key.kind == 0:
+			return f.sourcePath(inode, key.a, key.b)
+		}
+		return f.derivedPath(key.a, key.kind, key.b, rootInode)
+	}
+	kind, source, number, ok := decodeDerivedInode(inode)
+	if !ok {
+		return "", rejection("unknown inode number")
+	}
+	return f.derivedPath(source, kind, number, rootInode)
+}
+
+// sourcePath returns the root-relative path of the source file with the
+// given inode number, whose device and inode numbers in the source are
+// given.
+func (f *FS) sourcePath(inode, dev, ino uint64) (string, error) {
+	i := &f.inodes
+	i.mu.Lock()
+	rootRelativePath, ok := i.paths[inode]
+	i.mu.Unlock()
+	if ok {
+		start := time.Now()
+		info, err := os.Lstat(path.Join(f.sourceDirectory, rootRelativePath))
+		f.metrics.syscall(syscallLstat, start)
+		if err == nil && sameFile(info, dev, ino) {
+			return rootRelativePath, nil
+		}
+	}
+	return f.findPath(dev, ino)
+}
+
+// sameFile reports whether the file has the given device and inode numbers.
+func sameFile(info os.FileInfo, dev, ino uint64) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && uint64(stat.Dev) == dev && stat.Ino == ino
+}
+
+// findPath walks the source directory to find the root-relative path of the
+// file with the given device and inode numbers. It is only needed for files
+// that were not looked up since the filesystem was created. Hard-linked
+// files are found at their canonical path.
+func (f *FS) findPath(dev, ino uint64) (string, error) {
+	found := ""
+	var foundStat *syscall.Stat_t
+	err := filepath.Walk(f.sourceDirectory, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if sameFile(info, dev, ino) {
+			found, foundStat = fullPath, info.Sys().(*syscall.Stat_t)
+			return io.EOF
+		}
+		return nil
+	})
+	if err != io.EOF {
+		return "", rejection("source file not found")
+	}
+	rootRelativePath, err := filepath.Rel(f.sourceDirectory, found)
+	if err != nil {
+		return "", err
+	}
+	rootRelativePath = filepath.ToSlash(rootRelativePath)
+	if foundStat.Mode&syscall.S_IFMT == syscall.S_IFREG && f.dedupHardLinks {
+		if canonical := f.canonicalPath(rootRelativePath, foundStat); canonical != "" {
+			return canonical, nil
+		}
+	}
+	return rootRelativePath, nil
+}
+
+// linkPath returns the root-relative path of the secondary hard link with
+// the given number of the file at the given canonical root-relative path.
+// If several hard links have the number, the first of them in path order is
+// returned.
+func (f *FS) linkPath(canonical string, number uint64) (string, error) {
+	stat := &syscall.Stat_t{}
+	start := time.Now()
+	err := syscall.Lstat(path.Join(f.sourceDirectory, canonical), stat)
+	f.metrics.syscall(syscallLstat, start)
+	if err != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return "", rejection("hard link not found")
+	}
+	// Make sure the index of hard links is up to date.
+	if f.canonicalPath(canonical, stat) != canonical {
+		return "", rejection("hard link not found")
+	}
+	id := fileID{uint64(stat.Dev), stat.Ino}
+	h := &f.hardLinks
+	h.mu.Lock()
+	var links []string
+	for rootRelativePath, linkID := range h.ids {
+		if linkID == id && rootRelativePath != canonical && linkNumber(rootRelativePath) == number {
+			links = append(links, rootRelativePath)
+		}
+	}
+	h.mu.Unlock()
+	sort.Strings(links)
+	for _, link := range links {
+		if f.isHardLinkOf(link, id) {
+			return link, nil
+		}
+	}
+	return "", rejection("hard link not found")
+}
+
+// internalPath returns the root-relative path of the control directory, one
+// of its files, or the hard links manifest, given its inode number.
+func (f *FS) internalPath(inode uint64) (string, error) {
+	switch {
+	case inode == hardLinksManifestInode && f.dedupHardLinks:
+		return hardLinksManifestName, nil
+	case f.control == nil:
+		return "", rejection("unknown inode number")
+	case inode == controlDirectoryInode:
+		return controlDirectoryName, nil
+	}
+	for name := range (&controlDirectory{f}).files() {
+		if internalInode(name) == inode {
+			return path.Join(controlDirectoryName, name), nil
+		}
+	}
+	return "", rejection("unknown inode number")
+}
+
+// derivedPath returns the root-relative path of the chunk, subdirectory or
+// secondary hard link with the given number of the source file with the
+// given inode number.
+func (f *FS) derivedPath(source, kind, number, rootInode uint64) (string, error) {
+	sourcePath, err := f.inodePath(source, rootInode)
+	if err != nil {
+		return "", err
+	}
+	if kind == inodeLinkKind {
+		return f.linkPath(sourcePath, number)
+	}
+	n, err := f.lookupPath(context.Background(), sourcePath)
+	if err != nil {
+		return "", err
+	}
+	file, ok := n.(*fileAsDir)
+	if !ok {
+		return "", rejection("not a split file")
+	}
+	data, err := file.getData()
+	if err != nil {
+		return "", err
+	}
+	segments := hashSegments(file.hash)
+	lastLevel := len(segments) - 1
+	names := []string{sourcePath}
+	switch {
+	case kind == inodeChunkKind:
+		if number >= uint64(data.numberOfChunks) {
+			return "", rejection("chunk index out of range")
+		}
+		chunk := int64(number)
+		names = append(names, segments[:lastLevel]...)
+		names = append(names, groupPath(data.numberOfChunks, f.chunkFanOut, chunk, 1)...)
+		names = append(names, f.template().render(file.chunkNameValues(segments[lastLevel], data), chunk))
+	case number < maxHashSegmentDirectories:
+		if int(number) >= lastLevel {
+			return "", rejection("hash segment out of range")
+		}
+		names = append(names, segments[:number+1]...)
+	default:
+		group, ok := groupByNumber(data.numberOfChunks, f.chunkFanOut, number)
+		if !ok {
+			return "", rejection("fan-out directory out of range")
+		}
+		names = append(names, segments[:lastLevel]...)
+		names = append(names, groupPath(data.numberOfChunks, f.chunkFanOut, group.first, group.size)...)
+	}
+	return path.Join(names...), nil
+}
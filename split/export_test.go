@@ -0,0 +1,27 @@
+package split
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNFSExportRequirements(t *testing.T) {
+	source := t.TempDir()
+	for _, test := range []struct {
+		name    string
+		options []Option
+		want    string
+	}{
+		{"without dedup_hard_links", []Option{NFSExport(true)}, "requires deduplicating hard links"},
+		{"following symlinks", []Option{NFSExport(true), DedupHardLinks(true), Symlinks(SymlinksFollow)}, "cannot follow symlinks"},
+		{"supported", []Option{NFSExport(true), DedupHardLinks(true), Symlinks(SymlinksRewrite)}, ""},
+	} {
+		_, err := NewFS(source, 1, test.options...)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: NewFS = %v", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: NewFS = %v, want an error about %q", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package split
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// ChunkFanOut nests the chunks of files with more than fanOut chunks into
+// subdirectories, so that no directory has more than fanOut entries. Each
+// subdirectory is named after the range of 1-based chunk indices it holds,
+// like "00001001-00002000", so the name of the last one ends with the total
+// number of chunks. Zero disables fan-out.
+func ChunkFanOut(fanOut int64) Option {
+	return func(f *FS) error {
+		if fanOut != 0 && fanOut < 2 {
+			return fmt.Errorf("chunk fan-out (%d) must be at least 2, or 0 to disable it", fanOut)
+		}
+		f.chunkFanOut = fanOut
+		return nil
+	}
+}
+
+// chunkGroup is the range of chunks held by a fan-out subdirectory.
+type chunkGroup struct {
+	// first is the 0-based index of the first chunk of the group.
+	first int64
+	// size is the number of chunks the group holds, unless it is the last
+	// one. It is a power of the fan-out.
+	size int64
+	// number is the number of the subdirectory among those of the file.
+	number uint64
+}
+
+// groupNumber returns the number of the fan-out subdirectory holding the
+// chunks from first, of the given size, among the subdirectories of a file
+// with the given number of chunks. Subdirectories are numbered level by
+// level from the top, after the hash segments, so that a file with n chunks
+// uses at most n/(fanOut-1) numbers, plus one per level.
+func groupNumber(numberOfChunks, fanOut, first, size int64) uint64 {
+	number := uint64(maxHashSegmentDirectories)
+	for unit := topGroupSize(numberOfChunks, fanOut); unit > size; unit /= fanOut {
+		number += uint64((numberOfChunks + unit - 1) / unit)
+	}
+	return number + uint64(first/size)
+}
+
+// topGroupSize returns the size of the groups at the top level of a file
+// with the given number of chunks, or 1 if it has no groups.
+func topGroupSize(numberOfChunks, fanOut int64) int64 {
+	size := int64(1)
+	if fanOut == 0 {
+		return size
+	}
+	for size*fanOut < numberOfChunks {
+		size *= fanOut
+	}
+	return size
+}
+
+// groupByNumber returns the group of a file with the given number of chunks
+// that has the given number, as returned by groupNumber.
+func groupByNumber(numberOfChunks, fanOut int64, number uint64) (*chunkGroup, bool) {
+	if number < maxHashSegmentDirectories {
+		return nil, false
+	}
+	rest := number - maxHashSegmentDirectories
+	for size := topGroupSize(numberOfChunks, fanOut); size > 1; size /= fanOut {
+		count := uint64((numberOfChunks + size - 1) / size)
+		if rest < count {
+			first := int64(rest) * size
+			return &chunkGroup{first: first, size: size, number: number}, true
+		}
+		rest -= count
+	}
+	return nil, false
+}
+
+// groupPath returns the names of the nested fan-out subdirectories of a
+// file with the given number of chunks that hold the chunk first, from the
+// top level down to the group of the given size. A size of 1 gives all of
+// the subdirectories the chunk is in.
+func groupPath(numberOfChunks, fanOut, first, size int64) []string {
+	var names []string
+	for unit := topGroupSize(numberOfChunks, fanOut); unit > 1 && unit >= size; unit /= fanOut {
+		start := first - first%unit
+		end := start + unit
+		if end > numberOfChunks {
+			end = numberOfChunks
+		}
+		names = append(names, groupName(start, end))
+	}
+	return names
+}
+
+// chunkListing describes the entries of a directory of a split file.
+type chunkListing struct {
+	count int64
+	entry func(int64) dirent
+	// The fields below are only set for directories holding chunks or
+	// chunk groups.
+	data     fileAsDirData
+	values   *chunkNameValues
+	first    int64
+	end      int64
+	unit     int64
+	template *chunkNameTemplate
+}
+
+// groupName returns the name of the fan-out subdirectory holding the chunks
+// from first to end, excluded.
+func groupName(first, end int64) string {
+	return fmt.Sprintf("%0*d-%0*d", minFormatZeroes, first+1, minFormatZeroes, end)
+}
+
+// listing returns the entries of the directory.
+func (f *fileAsDir) listing() (*chunkListing, error) {
+	segments := hashSegments(f.hash)
+	if f.level < len(segments)-1 {
+		return &chunkListing{count: 1, entry: func(int64) dirent {
+			return dirent{
+				inode: f.splitFS.chunkDirectoryInode(f.inode, uint64(f.level)),
+				typ:   os.ModeDir,
+				name:  segments[f.level],
+			}
+		}}, nil
+	}
+	data, err := f.getData()
+	if err != nil {
+		return nil, err
+	}
+	l := &chunkListing{
+		data:     data,
+		values:   f.chunkNameValues(segments[f.level], data),
+		template: f.splitFS.template(),
+		end:      data.numberOfChunks,
+		unit:     1,
+	}
+	fanOut := f.splitFS.chunkFanOut
+	if f.group != nil {
+		l.first = f.group.first
+		if end := f.group.first + f.group.size; end < l.end {
+			l.end = end
+		}
+		l.unit = f.group.size / fanOut
+	} else {
+		// The top level holds groups of the smallest power of the fan-out that
+		// keeps it within the fan-out.
+		l.unit = topGroupSize(data.numberOfChunks, fanOut)
+	}
+	if l.end < l.first {
+		l.end = l.first
+	}
+	l.count = (l.end - l.first + l.unit - 1) / l.unit
+	l.entry = func(i int64) dirent {
+		first := l.first + i*l.unit
+		if l.unit == 1 {
+			return dirent{
+				inode: f.splitFS.chunkInode(f.inode, first),
+				name:  l.template.render(l.values, first),
+			}
+		}
+		end := first + l.unit
+		if end > l.end {
+			end = l.end
+		}
+		return dirent{
+			inode: f.splitFS.chunkDirectoryInode(f.inode, groupNumber(l.data.numberOfChunks, fanOut, first, l.unit)),
+			typ:   os.ModeDir,
+			name:  groupName(first, end),
+		}
+	}
+	return l, nil
+}
+
+// lookupGroup returns the fan-out subdirectory with the given name.
+func (f *fileAsDir) lookupGroup(l *chunkListing, name string) (*fileAsDir, error) {
+	bounds := strings.SplitN(name, "-", 2)
+	if len(bounds) != 2 {
+		return nil, rejection("malformed fan-out directory name")
+	}
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || first < 1 {
+		return nil, rejection("malformed fan-out directory name")
+	}
+	i := (first - 1 - l.first) / l.unit
+	if first-1 < l.first || i >= l.count || l.entry(i).name != name {
+		return nil, rejection("fan-out directory mismatch")
+	}
+	first = l.first + i*l.unit
+	return &fileAsDir{
+		node:  f.node,
+		hash:  f.hash,
+		inode: f.inode,
+		level: f.level,
+		group: &chunkGroup{
+			first:  first,
+			size:   l.unit,
+			number: groupNumber(l.data.numberOfChunks, f.splitFS.chunkFanOut, first, l.unit),
+		},
+	}, nil
+}
+
+// fileAsDirStream streams the entries of a directory of a split file. The
+// offsets are entry indices, so that reads can resume at any entry.
+type fileAsDirStream struct {
+	dir *fileAsDir
+	// listing is computed when the directory is first read, and again when
+	// it is read from the start.
+	listing *chunkListing
+	offset  int64
+}
+
+func (f *fileAsDir) openDir(context.Context) (_ dirStream, err error) {
+	op := f.splitFS.startOp(opOpen, f.rootRelativePath)
+	defer op.end(&err)
+	return &fileAsDirStream{dir: f}, nil
+}
+
+func (s *fileAsDirStream) next() (dirent, int64, error) {
+	if s.listing == nil {
+		listing, err := s.dir.listing()
+		if err != nil {
+			return dirent{}, 0, s.dir.sourceErr(err)
+		}
+		s.listing = listing
+	}
+	if s.offset >= s.listing.count {
+		return dirent{}, 0, io.EOF
+	}
+	s.offset++
+	return s.listing.entry(s.offset - 1), s.offset, nil
+}
+
+func (s *fileAsDirStream) seek(offset int64) error {
+	if offset == 0 {
+		s.listing = nil
+	}
+	s.offset = offset
+	return nil
+}
+
+func (s *fileAsDirStream) close() error {
+	return nil
+}
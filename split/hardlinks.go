@@ -0,0 +1,311 @@
+package split
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// hardLinksManifestName is the name of the file, at the root of the
+// filesystem, that maps the secondary paths of hard-linked files to their
+// canonical path. It shadows any file of the same name in the source.
+const hardLinksManifestName = ".splitfs-hardlinks.json"
+
+// hardLinksManifestInode is the inode number of the hard links manifest.
+const hardLinksManifestInode = controlDirectoryInode - 1
+
+// DedupHardLinks makes regular files with several hard links in the source
+// show up only once. The path that sorts first is the canonical one, and is
+// presented as usual; the others are presented as symlinks to it. A manifest
+// at the root of the filesystem records the relationship, so that hard links
+// can be restored from a copy of the mount.
+func DedupHardLinks(dedupHardLinks bool) Option {
+	return func(f *FS) error {
+		f.dedupHardLinks = dedupHardLinks
+		return nil
+	}
+}
+
+// fileID identifies a file in the source, regardless of its path.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinks indexes the regular files of the source that have several
+// hard links. It is built by walking the whole source directory the first
+// time a file with several hard links is looked up, and again whenever a file
+// that was not hard-linked at the time shows up with several hard links.
+// Otherwise, lookups update it as they come across hard links that were
+// created, replaced or removed since. The walk does not block lookups of
+// files that are not hard-linked, nor those of known hard links.
+type hardLinks struct {
+	// scanMu is held while the source directory is walked, which is done
+	// without holding mu, so that lookups of other files go on meanwhile.
+	scanMu sync.Mutex
+	mu     sync.Mutex
+	// scanned is set once the source directory was walked, and scans is the
+	// number of walks started.
+	scanned bool
+	scans   int
+	// canonical maps each hard-linked file to its canonical root-relative path.
+	canonical map[fileID]string
+	// ids maps the root-relative path of every hard link to its file.
+	ids map[string]fileID
+	// manifest is the manifest as last rendered, and stale is set if the
+	// index changed since.
+	manifest []byte
+	stale    bool
+	// modified is the time at which the rendered manifest last changed.
+	modified time.Time
+}
+
+// scan rebuilds the index by walking the source directory. h.mu must be
+// held; it is released during the walk. If another walk started while
+// waiting for the one in progress, that walk's index is used instead.
+func (h *hardLinks) scan(f *FS) {
+	requested := h.scans
+	h.mu.Unlock()
+	h.scanMu.Lock()
+	defer h.scanMu.Unlock()
+	h.mu.Lock()
+	if h.scans != requested {
+		return
+	}
+	h.scans++
+	h.mu.Unlock()
+	canonical, ids := f.walkHardLinks()
+	h.mu.Lock()
+	h.canonical, h.ids = canonical, ids
+	h.scanned = true
+	h.stale = true
+}
+
+// walkHardLinks walks the source directory, and returns the canonical path
+// of each hard-linked file and the file of each hard link, as indexed by
+// hardLinks.
+func (f *FS) walkHardLinks() (map[fileID]string, map[string]fileID) {
+	index := &hardLinks{canonical: make(map[fileID]string), ids: make(map[string]fileID)}
+	filepath.Walk(f.sourceDirectory, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Nlink < 2 {
+			return nil
+		}
+		rootRelativePath, err := filepath.Rel(f.sourceDirectory, fullPath)
+		if err != nil {
+			return nil
+		}
+		// Walk visits directories in lexical order, which is not quite the
+		// order of full paths.
+		index.add(rootRelativePath, fileID{uint64(stat.Dev), stat.Ino})
+		return nil
+	})
+	return index.canonical, index.ids
+}
+
+// add indexes a hard link. h.mu must be held.
+func (h *hardLinks) add(rootRelativePath string, id fileID) {
+	h.ids[rootRelativePath] = id
+	if canonical, ok := h.canonical[id]; !ok || rootRelativePath < canonical {
+		h.canonical[id] = rootRelativePath
+	}
+	h.stale = true
+}
+
+// remove forgets a hard link, which no longer refers to the file it was
+// indexed for. If it was the canonical one, the remaining hard link that
+// sorts first becomes canonical. h.mu must be held.
+func (h *hardLinks) remove(rootRelativePath string) {
+	id, ok := h.ids[rootRelativePath]
+	if !ok {
+		return
+	}
+	delete(h.ids, rootRelativePath)
+	h.stale = true
+	if h.canonical[id] != rootRelativePath {
+		return
+	}
+	delete(h.canonical, id)
+	for other, otherID := range h.ids {
+		if canonical, ok := h.canonical[id]; otherID == id && (!ok || other < canonical) {
+			h.canonical[id] = other
+		}
+	}
+}
+
+// canonicalPath returns the canonical root-relative path of the regular file
+// at the given root-relative path, whose stat is given.
+func (f *FS) canonicalPath(rootRelativePath string, stat *syscall.Stat_t) string {
+	if !f.dedupHardLinks || stat.Nlink < 2 {
+		return rootRelativePath
+	}
+	id := fileID{uint64(stat.Dev), stat.Ino}
+	h := &f.hardLinks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.scanned {
+		h.scan(f)
+	}
+	if known, ok := h.ids[rootRelativePath]; ok && known != id {
+		// The path was replaced by another file.
+		h.remove(rootRelativePath)
+	}
+	if _, ok := h.canonical[id]; !ok {
+		// The file was not hard-linked when the index was built: find its
+		// other hard links.
+		h.scan(f)
+	}
+	if _, ok := h.ids[rootRelativePath]; !ok {
+		// A new hard link, or one outside of the other hard links' reach,
+		// such as a file whose other hard links are outside of the source.
+		// Remember it, so as not to scan again on every lookup.
+		h.add(rootRelativePath, id)
+	}
+	for {
+		canonical := h.canonical[id]
+		if canonical == rootRelativePath || f.isHardLinkOf(canonical, id) {
+			return canonical
+		}
+		h.remove(canonical)
+	}
+}
+
+// isHardLinkOf reports whether the given root-relative path still refers to
+// the given file.
+func (f *FS) isHardLinkOf(rootRelativePath string, id fileID) bool {
+	if rootRelativePath == "" {
+		return false
+	}
+	stat := &syscall.Stat_t{}
+	start := time.Now()
+	err := syscall.Lstat(path.Join(f.sourceDirectory, rootRelativePath), stat)
+	f.metrics.syscall(syscallLstat, start)
+	return err == nil && fileID{uint64(stat.Dev), stat.Ino} == id
+}
+
+// hardLinkTarget returns the target of the symlink that replaces the
+// secondary hard link at the given root-relative path.
+func hardLinkTarget(rootRelativePath, canonical string) string {
+	target, err := filepath.Rel(path.Dir(rootRelativePath), canonical)
+	if err != nil {
+		return canonical
+	}
+	return target
+}
+
+// hardLinksManifest returns the manifest of hard links, as a JSON object
+// mapping secondary paths to canonical paths. If validate is set, the hard
+// links are checked to still refer to the files they were indexed for;
+// otherwise, the manifest is that of the index as it stands.
+func (f *FS) hardLinksManifest(validate bool) []byte {
+	h := &f.hardLinks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.scanned {
+		h.scan(f)
+	} else if validate {
+		for rootRelativePath, id := range h.ids {
+			if !f.isHardLinkOf(rootRelativePath, id) {
+				h.remove(rootRelativePath)
+			}
+		}
+	}
+	if !h.stale {
+		return h.manifest
+	}
+	links := make(map[string]string)
+	for rootRelativePath, id := range h.ids {
+		if canonical := h.canonical[id]; canonical != rootRelativePath {
+			links[rootRelativePath] = canonical
+		}
+	}
+	// Keys are sorted, so that the manifest is stable.
+	manifest, _ := json.MarshalIndent(links, "", "  ")
+	manifest = append(manifest, '\n')
+	if !bytes.Equal(manifest, h.manifest) {
+		h.manifest = manifest
+		h.modified = time.Now()
+	}
+	h.stale = false
+	return h.manifest
+}
+
+// hardLinksManifestModified returns the time at which the manifest of hard
+// links last changed.
+func (f *FS) hardLinksManifestModified() time.Time {
+	h := &f.hardLinks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.modified
+}
+
+// hardLinkSymlink is a secondary hard link, presented as a symlink to the
+// canonical one.
+type hardLinkSymlink struct {
+	*node
+	target string
+}
+
+var _ fsNode = (*hardLinkSymlink)(nil)
+var _ nodeReadlinker = (*hardLinkSymlink)(nil)
+
+func (s *hardLinkSymlink) Attr(ctx context.Context, attr *Attr) error {
+	if err := s.node.Attr(ctx, attr); err != nil {
+		return err
+	}
+	attr.Inode = s.splitFS.linkInode(attr.Inode, s.rootRelativePath)
+	attr.Mode = os.ModeSymlink | 0777
+	attr.Size = uint64(len(s.target))
+	attr.Blocks = 0
+	attr.Nlink = 1
+	return nil
+}
+
+func (s *hardLinkSymlink) Readlink(context.Context) (_ string, err error) {
+	op := s.splitFS.startOp(opReadlink, s.rootRelativePath)
+	defer op.end(&err)
+	return s.target, nil
+}
+
+// hardLinksManifestFile is the manifest of hard links at the root of the
+// filesystem. Its content is checked against the source when it is opened;
+// its size is that of the manifest as last rendered, as computing it would
+// mean checking every hard link on every stat.
+type hardLinksManifestFile struct {
+	splitFS *FS
+}
+
+var _ fsNode = (*hardLinksManifestFile)(nil)
+var _ nodeOpener = (*hardLinksManifestFile)(nil)
+
+func (m *hardLinksManifestFile) Attr(_ context.Context, attr *Attr) error {
+	attr.Inode = hardLinksManifestInode
+	attr.Mode = 0444
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	attr.Nlink = 1
+	attr.Size = uint64(len(m.splitFS.hardLinksManifest(false)))
+	attr.Mtime = m.splitFS.hardLinksManifestModified()
+	// The manifest changes whenever hard links change in the source.
+	attr.Valid = time.Nanosecond
+	// Serve the content as of the open, whatever its size when last stat'ed.
+	attr.Volatile = true
+	return nil
+}
+
+func (m *hardLinksManifestFile) Open(_ context.Context, write bool) (fileHandle, error) {
+	if write {
+		return nil, syscall.EROFS
+	}
+	return dataHandle(m.splitFS.hardLinksManifest(true)), nil
+}
@@ -0,0 +1,247 @@
+package split
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// readManifest returns the manifest of hard links as served when opened.
+func readManifest(t *testing.T, f *FS) map[string]string {
+	t.Helper()
+	links := make(map[string]string)
+	if err := json.Unmarshal(f.hardLinksManifest(true), &links); err != nil {
+		t.Fatalf("cannot parse manifest: %v", err)
+	}
+	return links
+}
+
+// lookupTarget looks up the given path, and returns the target of the symlink
+// it is presented as, if any.
+func lookupTarget(t *testing.T, f *FS, rootRelativePath string) string {
+	t.Helper()
+	n, err := f.lookupPath(context.Background(), rootRelativePath)
+	if err != nil {
+		t.Fatalf("lookup of %s: %v", rootRelativePath, err)
+	}
+	if s, ok := n.(*hardLinkSymlink); ok {
+		return s.target
+	}
+	return ""
+}
+
+func TestHardLinks(t *testing.T) {
+	source := t.TempDir()
+	link := func(oldname, newname string) {
+		t.Helper()
+		if err := os.Link(filepath.Join(source, oldname), filepath.Join(source, newname)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "single"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link("b", "dir/c")
+	f, err := NewFS(source, 1, DedupHardLinks(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := lookupTarget(t, f, "dir/c"); target != "../b" {
+		t.Errorf("dir/c is a symlink to %q, want ../b", target)
+	}
+	if got, want := readManifest(t, f), map[string]string{"dir/c": "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %v, want %v", got, want)
+	}
+
+	// A new hard link to an indexed file is picked up when looked up.
+	link("b", "a")
+	if target := lookupTarget(t, f, "a"); target != "" {
+		t.Errorf("a is a symlink to %q, want the canonical file", target)
+	}
+	if target := lookupTarget(t, f, "b"); target != "a" {
+		t.Errorf("b is a symlink to %q, want a", target)
+	}
+	if got, want := readManifest(t, f), map[string]string{"b": "a", "dir/c": "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %v, want %v", got, want)
+	}
+
+	// A file that gets a second hard link is found with a new walk.
+	link("single", "z")
+	if target := lookupTarget(t, f, "z"); target != "single" {
+		t.Errorf("z is a symlink to %q, want single", target)
+	}
+
+	// Removed hard links are dropped when the manifest is opened, and the
+	// next one becomes canonical.
+	if err := os.Remove(filepath.Join(source, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readManifest(t, f), map[string]string{"dir/c": "b", "z": "single"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %v, want %v", got, want)
+	}
+	if target := lookupTarget(t, f, "b"); target != "" {
+		t.Errorf("b is a symlink to %q, want the canonical file", target)
+	}
+}
+
+// TestHardLinksManifestAttr checks that stat'ing the manifest reports the
+// size of the manifest as last read, rather than checking the source.
+func TestHardLinksManifestAttr(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(source, "a"), filepath.Join(source, "b")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFS(source, 1, DedupHardLinks(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &hardLinksManifestFile{f}
+	var attr Attr
+	if err := manifest.Attr(context.Background(), &attr); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(len(f.hardLinksManifest(true))); attr.Size != want {
+		t.Errorf("manifest size = %d, want %d", attr.Size, want)
+	}
+	if err := os.Remove(filepath.Join(source, "b")); err != nil {
+		t.Fatal(err)
+	}
+	var stale Attr
+	if err := manifest.Attr(context.Background(), &stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale.Size != attr.Size || !stale.Mtime.Equal(attr.Mtime) {
+		t.Errorf("stat'ing the manifest checked the source")
+	}
+	if got := readManifest(t, f); len(got) != 0 {
+		t.Errorf("manifest = %v, want no hard links", got)
+	}
+	if err := manifest.Attr(context.Background(), &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Size != uint64(len("{}\n")) {
+		t.Errorf("manifest size = %d after reading it, want %d", attr.Size, len("{}\n"))
+	}
+}
+
+// TestHardLinksConcurrentLookups looks up hard links and other files at the
+// same time before the index is built, and checks that the source is only
+// walked once, and that every lookup sees the whole index.
+func TestHardLinksConcurrentLookups(t *testing.T) {
+	source := t.TempDir()
+	for _, name := range []string{"a", "single"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"b", "c", "d"} {
+		if err := os.Link(filepath.Join(source, "a"), filepath.Join(source, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewFS(source, 1, DedupHardLinks(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b", "c", "d", "single"}
+	targets := make([]string, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			n, err := f.lookupPath(context.Background(), name)
+			if s, ok := n.(*hardLinkSymlink); ok {
+				targets[i] = s.target
+			}
+			errs[i] = err
+		}(i, name)
+	}
+	wg.Wait()
+	for i, name := range names {
+		want := "a"
+		if name == "a" || name == "single" {
+			want = ""
+		}
+		if errs[i] != nil || targets[i] != want {
+			t.Errorf("lookup of %s = %q, %v, want a symlink to %q", name, targets[i], errs[i], want)
+		}
+	}
+	if scans := f.hardLinks.scans; scans != 1 {
+		t.Errorf("the source was walked %d times, want once", scans)
+	}
+}
+
+// TestHardLinkInodes checks that secondary hard links get inode numbers that
+// InodePath resolves, even in a filesystem that never looked them up, as
+// after a restart of an NFS-exported mount.
+func TestHardLinkInodes(t *testing.T) {
+	source := t.TempDir()
+	if err := os.Mkdir(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := []string{"b", "dir/c", "dir/d"}
+	for _, name := range links {
+		if err := os.Link(filepath.Join(source, "a"), filepath.Join(source, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewFS(source, 1, DedupHardLinks(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodes := make(map[uint64]string)
+	for _, name := range links {
+		n, err := f.lookupPath(context.Background(), name)
+		if err != nil {
+			t.Fatalf("lookup of %s: %v", name, err)
+		}
+		attr := Attr{}
+		if err := n.Attr(context.Background(), &attr); err != nil {
+			t.Fatalf("attr of %s: %v", name, err)
+		}
+		if other, ok := inodes[attr.Inode]; ok {
+			t.Errorf("%s and %s share inode %#x", name, other, attr.Inode)
+		}
+		inodes[attr.Inode] = name
+	}
+	restarted, err := NewFS(source, 1, DedupHardLinks(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for inode, name := range inodes {
+		if got, err := restarted.InodePath(inode); err != nil || got != name {
+			t.Errorf("InodePath(%#x) = %q, %v, want %q", inode, got, err, name)
+		}
+	}
+
+	// A removed hard link is no longer found.
+	if err := os.Remove(filepath.Join(source, "dir/c")); err != nil {
+		t.Fatal(err)
+	}
+	for inode, name := range inodes {
+		if name != "dir/c" {
+			continue
+		}
+		if got, err := restarted.InodePath(inode); err == nil {
+			t.Errorf("InodePath(%#x) of removed %s = %q", inode, name, got)
+		}
+	}
+}
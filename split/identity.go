@@ -0,0 +1,127 @@
+package split
+
+import (
+	"fmt"
+	"path"
+	"syscall"
+	"time"
+)
+
+// ChunkNameKey is what the hash in chunk names is computed over.
+type ChunkNameKey int
+
+const (
+	// ChunkNamesByPath hashes the path of the file, so that renaming a file
+	// renames all of its chunks.
+	ChunkNamesByPath ChunkNameKey = iota
+	// ChunkNamesByIdentity hashes the identity of the file in the source, so
+	// that chunk names survive renames and moves within the source
+	// filesystem. See (*FS).fileIdentity.
+	ChunkNamesByIdentity
+)
+
+// ChunkNameKeyNames are the names of the chunk name keys, for use in flags.
+var ChunkNameKeyNames = []string{"path", "identity"}
+
+func (k ChunkNameKey) String() string {
+	if k < 0 || int(k) >= len(ChunkNameKeyNames) {
+		return fmt.Sprintf("ChunkNameKey(%d)", int(k))
+	}
+	return ChunkNameKeyNames[k]
+}
+
+// ParseChunkNameKey returns the chunk name key with the given name.
+func ParseChunkNameKey(name string) (ChunkNameKey, error) {
+	for i, keyName := range ChunkNameKeyNames {
+		if name == keyName {
+			return ChunkNameKey(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid chunk name key %q; must use one of %v", name, ChunkNameKeyNames)
+}
+
+// ChunkNamesKeyedOn sets what the hash in chunk names is computed over.
+func ChunkNamesKeyedOn(key ChunkNameKey) Option {
+	return func(f *FS) error {
+		if key < 0 || int(key) >= len(ChunkNameKeyNames) {
+			return fmt.Errorf("invalid chunk name key %v", key)
+		}
+		f.chunkNameKey = key
+		return nil
+	}
+}
+
+// identityXattr is the extended attribute that overrides the identity of a
+// source file.
+const identityXattr = "user.splitfs.id"
+
+// maxIdentityXattrSize is the largest identity read from identityXattr.
+const maxIdentityXattrSize = 256
+
+// hashedName returns what the hash in the chunk names of the file at the
+// given root-relative path is computed over.
+func (f *FS) hashedName(rootRelativePath string) (string, error) {
+	if f.chunkNameKey == ChunkNamesByIdentity {
+		return f.fileIdentity(path.Join(f.sourceDirectory, rootRelativePath))
+	}
+	return rootRelativePath, nil
+}
+
+// fileIdentity returns a string that identifies the file at the given path
+// for as long as it exists, whatever its name.
+//
+// If the file has a "user.splitfs.id" extended attribute, its value is the
+// identity; it can be set to keep chunk names across copies to another
+// filesystem. splitfs never sets it itself, and keeps no record of
+// identities: they are derived from the source file every time. Otherwise,
+// the identity is made of the inode number and birth time of the file. The
+// birth time tells apart files that reused the inode number of a deleted
+// file. If the source filesystem does not record birth times, the ID of the
+// filesystem is used instead, to tell apart files from filesystems mounted
+// within the source. Unlike device numbers, filesystem IDs do not change when
+// the disks of the source are found in another order at boot.
+func (f *FS) fileIdentity(fullPath string) (string, error) {
+	if identity, ok := f.xattrIdentity(fullPath); ok {
+		return identity, nil
+	}
+	start := time.Now()
+	ino, btime, err := birthTime(fullPath, true)
+	f.metrics.syscall(syscallStatx, start)
+	if err == nil && !btime.IsZero() {
+		return fmt.Sprintf("ino:%d:btime:%d.%09d", ino, btime.Unix(), btime.Nanosecond()), nil
+	}
+	return f.fsidIdentity(fullPath)
+}
+
+// xattrIdentity returns the identity set in the "user.splitfs.id" extended
+// attribute of the file at the given path, if any.
+func (f *FS) xattrIdentity(fullPath string) (string, bool) {
+	xattr := make([]byte, maxIdentityXattrSize)
+	start := time.Now()
+	size, err := syscall.Getxattr(fullPath, identityXattr, xattr)
+	f.metrics.syscall(syscallGetxattr, start)
+	if err != nil || size <= 0 {
+		return "", false
+	}
+	return "xattr:" + string(xattr[:size]), true
+}
+
+// fsidIdentity returns the identity of the file at the given path made of the
+// ID of its filesystem and its inode number, for filesystems that do not
+// record birth times.
+func (f *FS) fsidIdentity(fullPath string) (string, error) {
+	start := time.Now()
+	fsid, err := filesystemID(fullPath)
+	f.metrics.syscall(syscallStatfs, start)
+	if err != nil {
+		return "", err
+	}
+	stat := &syscall.Stat_t{}
+	start = time.Now()
+	err = syscall.Stat(fullPath, stat)
+	f.metrics.syscall(syscallStat, start)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("fsid:%016x:ino:%d", fsid, stat.Ino), nil
+}
@@ -0,0 +1,155 @@
+package split
+
+import (
+	"errors"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// chunkInodes returns the inode numbers of the chunks of the split file at
+// the given path, by chunk name.
+func chunkInodes(t *testing.T, source, name string, options ...Option) map[string]uint64 {
+	t.Helper()
+	f, err := NewFS(source, 4, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := iofs.ReadDir(f.IOFS(), name)
+	if err != nil {
+		t.Fatalf("listing %s: %v", name, err)
+	}
+	chunks := make(map[string]uint64)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks[entry.Name()] = info.Sys().(*Attr).Inode
+	}
+	if len(chunks) == 0 {
+		t.Fatalf("%s has no chunks", name)
+	}
+	return chunks
+}
+
+// rename renames a file in the given source directory.
+func rename(t *testing.T, source, oldname, newname string) {
+	t.Helper()
+	if err := os.Rename(filepath.Join(source, oldname), filepath.Join(source, newname)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkNamesSurviveRenames(t *testing.T) {
+	source := t.TempDir()
+	if err := os.Mkdir(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "a.bin"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	byIdentity := ChunkNamesKeyedOn(ChunkNamesByIdentity)
+	before := chunkInodes(t, source, "a.bin", byIdentity)
+	beforeByPath := chunkInodes(t, source, "a.bin")
+	rename(t, source, "a.bin", "dir/b.bin")
+	if after := chunkInodes(t, source, "dir/b.bin", byIdentity); !reflect.DeepEqual(after, before) {
+		t.Errorf("chunks keyed on identity changed with a rename:\n%v\n%v", before, after)
+	}
+	if after := chunkInodes(t, source, "dir/b.bin"); reflect.DeepEqual(after, beforeByPath) {
+		t.Errorf("chunks keyed on path did not change with a rename: %v", after)
+	}
+}
+
+func TestFileIdentity(t *testing.T) {
+	source := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewFS(source, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// identities returns the identities of a and b, with the given function,
+	// checking that they differ and that they survive renames.
+	identities := func(identity func(string) (string, error)) (string, string) {
+		t.Helper()
+		a, err := identity(filepath.Join(source, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := identity(filepath.Join(source, "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == b {
+			t.Errorf("a and b share identity %q", a)
+		}
+		rename(t, source, "a", "c")
+		defer rename(t, source, "c", "a")
+		c, err := identity(filepath.Join(source, "c"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != a {
+			t.Errorf("identity changed from %q to %q with a rename", a, c)
+		}
+		return a, b
+	}
+
+	t.Run("fsid", func(t *testing.T) {
+		a, _ := identities(f.fsidIdentity)
+		if !strings.HasPrefix(a, "fsid:") {
+			t.Errorf("identity %q is not made of the filesystem ID", a)
+		}
+	})
+
+	t.Run("btime", func(t *testing.T) {
+		if _, btime, err := birthTime(filepath.Join(source, "a"), true); err != nil || btime.IsZero() {
+			t.Skipf("the source filesystem does not record birth times: %v", err)
+		}
+		a, _ := identities(f.fileIdentity)
+		if !strings.HasPrefix(a, "ino:") || !strings.Contains(a, ":btime:") {
+			t.Errorf("identity %q is not made of the inode number and birth time", a)
+		}
+	})
+
+	t.Run("xattr", func(t *testing.T) {
+		for _, name := range []string{"a", "b"} {
+			err := syscall.Setxattr(filepath.Join(source, name), identityXattr, []byte("id-"+name), 0)
+			if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
+				t.Skipf("the source filesystem does not support user extended attributes: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		a, b := identities(f.fileIdentity)
+		if a != "xattr:id-a" || b != "xattr:id-b" {
+			t.Errorf("identities are %q and %q, want xattr:id-a and xattr:id-b", a, b)
+		}
+		// A copy with the same attribute gets the same chunk names.
+		byIdentity := ChunkNamesKeyedOn(ChunkNamesByIdentity)
+		copied := t.TempDir()
+		for _, dir := range []string{source, copied} {
+			if err := os.WriteFile(filepath.Join(dir, "big.bin"), []byte("0123456789"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := syscall.Setxattr(filepath.Join(dir, "big.bin"), identityXattr, []byte("big"), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		original, duplicate := chunkInodes(t, source, "big.bin", byIdentity), chunkInodes(t, copied, "big.bin", byIdentity)
+		for name := range original {
+			if _, ok := duplicate[name]; !ok {
+				t.Errorf("chunk %s of the original is missing from the copy: %v", name, duplicate)
+			}
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package split
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Inode numbers are allocated so that no two nodes of the filesystem share
+// one, even across source filesystems, and so that the same node gets the
+// same number on every mount. From the most significant bit, they are laid
+// out as follows:
+//
+//	0    | device:5 | inode:58                   source files and directories
+//	10   | device:5 | inode:32 | chunk:25        chunk files
+//	110  | device:5 | inode:32 | directory:24    subdirectories of split files
+//	1110 | sequence:60                           overflow
+//	11110000 | hash:56                           control files
+//	11110001 | device:5 | inode:32 | link:19     secondary hard links
+//	11111111 | ...                               control directory and manifest
+//
+// The device is an index for the source filesystem the node is on: 0 for
+// the filesystem of the source directory, and a hash of the device number
+// for the filesystems mounted below it. The inode is the inode number of the
+// source file, and the directory is the number of a subdirectory within the
+// split file: hash segments come first, then fan-out subdirectories. The
+// link is a hash of the path of a secondary hard link, presented as a
+// symlink to the canonical one of the same source file; two secondary hard
+// links of a file whose paths hash the same share a number.
+//
+// Nodes whose numbers do not fit, such as the chunks or hard links of a
+// file whose inode number takes more than 32 bits, or whose device does not
+// get an index because 31 other filesystems already took them, get the next
+// number of the overflow range instead. Those are only stable for the lifetime of the
+// mount.
+const (
+	inodeDeviceBits    = 5
+	inodeSourceBits    = 58
+	inodeFileBits      = 32
+	inodeChunkBits     = 25
+	inodeDirectoryBits = 24
+	inodeLinkBits      = 19
+
+	inodeChunkKind     = 0x2 << 62
+	inodeDirectoryKind = 0x6 << 61
+	inodeOverflowKind  = 0xe << 60
+	inodeInternalKind  = 0xf << 60
+	inodeLinkKind      = 0xf1 << 56
+
+	maxDevices = 1 << inodeDeviceBits
+)
+
+// maxHashSegmentDirectories is the number of directory numbers reserved for
+// hash segments, before those of fan-out subdirectories. The longest hashes
+// are encrypted names: a root-relative path of up to PATH_MAX (4096) bytes
+// and its 16-byte synthetic IV make 6580 characters of base32, split into 42
+// segments, 41 of which are directories. Files whose hash would need more
+// directories are refused with ENAMETOOLONG.
+const maxHashSegmentDirectories = 64
+
+// inodeKey identifies a node that got a number from the overflow range: a
+// source file by its device and inode numbers, or a node derived from a
+// source file by its kind, the inode number of the source file and its own
+// number.
+type inodeKey struct {
+	kind uint64
+	a, b uint64
+}
+
+// inodes holds the state of inode allocation.
+type inodes struct {
+	mu sync.Mutex
+	// devices maps source device numbers to their index, and deviceIDs
+	// maps indices back to device numbers.
+	devices   map[uint64]uint64
+	deviceIDs [maxDevices]uint64
+	used      [maxDevices]bool
+	// overflow maps the nodes that got a number from the overflow range to
+	// that number, and overflowKeys maps them back.
+	overflow     map[inodeKey]uint64
+	overflowKeys map[uint64]inodeKey
+	// paths maps the inode numbers of the source files that were looked up
+	// to their root-relative path, for NFS export.
+	paths map[uint64]string
+}
+
+// init registers the device of the source directory, which gets index 0.
+func (i *inodes) init(rootDevice uint64) {
+	i.devices = map[uint64]uint64{rootDevice: 0}
+	i.deviceIDs[0], i.used[0] = rootDevice, true
+	i.overflow = make(map[inodeKey]uint64)
+	i.overflowKeys = make(map[uint64]inodeKey)
+	i.paths = make(map[uint64]string)
+}
+
+// deviceIndex returns the index of the given device. Devices are hashed to
+// an index, and take the next free one if it is taken already, so that the
+// same devices get the same indices on every mount unless their hashes
+// collide. i.mu must be held.
+func (i *inodes) deviceIndex(dev uint64) (uint64, bool) {
+	if index, ok := i.devices[dev]; ok {
+		return index, true
+	}
+	// Fibonacci hashing spreads the major and minor numbers over the index.
+	start := dev * 0x9e3779b97f4a7c15 >> (64 - inodeDeviceBits)
+	for n := uint64(0); n < maxDevices-1; n++ {
+		index := 1 + (start+n)%(maxDevices-1)
+		if !i.used[index] {
+			i.used[index], i.deviceIDs[index] = true, dev
+			i.devices[dev] = index
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// overflowInode returns the number of the given node in the overflow range.
+// i.mu must be held.
+func (i *inodes) overflowInode(key inodeKey) uint64 {
+	if inode, ok := i.overflow[key]; ok {
+		return inode
+	}
+	inode := inodeOverflowKind | uint64(len(i.overflow))
+	i.overflow[key] = inode
+	i.overflowKeys[inode] = key
+	return inode
+}
+
+// sourceInode returns the inode number of the source file with the given
+// device and inode numbers.
+func (f *FS) sourceInode(dev, ino uint64) uint64 {
+	i := &f.inodes
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	index, ok := i.deviceIndex(dev)
+	if !ok || ino>>inodeSourceBits != 0 {
+		return i.overflowInode(inodeKey{a: dev, b: ino})
+	}
+	return index<<inodeSourceBits | ino
+}
+
+// derivedInode returns the inode number of a node derived from the source
+// file with the given inode number: a chunk, or a subdirectory.
+func (f *FS) derivedInode(kind uint64, numberBits uint, source, number uint64) uint64 {
+	index, ino := source>>inodeSourceBits, source&(1<<inodeSourceBits-1)
+	if source>>63 == 0 && ino>>inodeFileBits == 0 && number>>numberBits == 0 {
+		return kind | index<<(inodeFileBits+numberBits) | ino<<numberBits | number
+	}
+	i := &f.inodes
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.overflowInode(inodeKey{kind: kind, a: source, b: number})
+}
+
+// decodeDerivedInode returns the kind of a node derived from a source file,
+// the inode number of the source file and the node's own number, given the
+// node's inode number. It fails for numbers of the overflow range.
+func decodeDerivedInode(inode uint64) (kind, source, number uint64, ok bool) {
+	var numberBits uint
+	switch {
+	case inode>>62 == inodeChunkKind>>62:
+		kind, numberBits = inodeChunkKind, inodeChunkBits
+	case inode>>61 == inodeDirectoryKind>>61:
+		kind, numberBits = inodeDirectoryKind, inodeDirectoryBits
+	case inode>>56 == inodeLinkKind>>56:
+		kind, numberBits = inodeLinkKind, inodeLinkBits
+	default:
+		return 0, 0, 0, false
+	}
+	number = inode & (1<<numberBits - 1)
+	ino := inode >> numberBits & (1<<inodeFileBits - 1)
+	index := inode >> (numberBits + inodeFileBits) & (1<<inodeDeviceBits - 1)
+	return kind, index<<inodeSourceBits | ino, number, true
+}
+
+// chunkInode returns the inode number of a chunk of the source file with the
+// given inode number.
+func (f *FS) chunkInode(source uint64, chunk int64) uint64 {
+	return f.derivedInode(inodeChunkKind, inodeChunkBits, source, uint64(chunk))
+}
+
+// chunkDirectoryInode returns the inode number of a subdirectory of the
+// source file with the given inode number.
+func (f *FS) chunkDirectoryInode(source, directory uint64) uint64 {
+	return f.derivedInode(inodeDirectoryKind, inodeDirectoryBits, source, directory)
+}
+
+// linkInode returns the inode number of the secondary hard link at the
+// given root-relative path of the source file with the given inode number.
+func (f *FS) linkInode(source uint64, rootRelativePath string) uint64 {
+	return f.derivedInode(inodeLinkKind, inodeLinkBits, source, linkNumber(rootRelativePath))
+}
+
+// linkNumber returns the number of the secondary hard link at the given
+// root-relative path among those of its file: the low bits of the 64-bit
+// FNV-1a hash of the path.
+func linkNumber(rootRelativePath string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(rootRelativePath))
+	return h.Sum64() & (1<<inodeLinkBits - 1)
+}
+
+// inodeDevice returns the device number of the source filesystem with the
+// given index.
+func (f *FS) inodeDevice(index uint64) (uint64, bool) {
+	i := &f.inodes
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.deviceIDs[index], i.used[index]
+}
+
+// inodeOverflowKey returns what the given inode number of the overflow range
+// was allocated for.
+func (f *FS) inodeOverflowKey(inode uint64) (inodeKey, bool) {
+	i := &f.inodes
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key, ok := i.overflowKeys[inode]
+	return key, ok
+}
+
+// internalInode returns the inode number of an entry of the control
+// directory: the 64-bit FNV-1a hash of eight zero bytes followed by the name,
+// with an 'x' appended until the hash is above 1, keeping the low 56 bits.
+// The numbers must not change, as NFS clients may hold handles to them.
+func internalInode(name string) uint64 {
+	h := fnv.New64a()
+	h.Write(make([]byte, 8))
+	h.Write([]byte(name))
+	hash := h.Sum64()
+	for hash <= 1 {
+		h.Write([]byte{'x'})
+		hash = h.Sum64()
+	}
+	return inodeInternalKind | hash&(1<<56-1)
+}
@@ -0,0 +1,286 @@
+package split
+
+import (
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+	"perot.me/splitfs/hashes"
+)
+
+// newTestInodes returns a filesystem whose source directory is on the given
+// device, for inode allocation only.
+func newTestInodes(rootDevice uint64) *FS {
+	f := &FS{}
+	f.inodes.init(rootDevice)
+	return f
+}
+
+func TestInodeRangesDoNotOverlap(t *testing.T) {
+	f := newTestInodes(100)
+	kinds := map[string]func(inode uint64) bool{
+		"source":    func(inode uint64) bool { return inode>>63 == 0 },
+		"chunk":     func(inode uint64) bool { return inode>>62 == 0x2 },
+		"directory": func(inode uint64) bool { return inode>>61 == 0x6 },
+		"overflow":  func(inode uint64) bool { return inode>>60 == 0xe },
+		"link":      func(inode uint64) bool { return inode>>56 == 0xf1 },
+		"internal":  func(inode uint64) bool { return inode>>60 == 0xf && inode>>56 != 0xf1 },
+	}
+	check := func(want string, inode uint64) {
+		t.Helper()
+		for kind, matches := range kinds {
+			if matches(inode) != (kind == want) {
+				t.Errorf("inode %#x of a %s node is in the %s range: %v", inode, want, kind, matches(inode))
+			}
+		}
+	}
+	seen := make(map[uint64]string)
+	for _, dev := range []uint64{100, 101, 2049} {
+		for _, ino := range []uint64{1, 2, 1<<32 - 1} {
+			source := f.sourceInode(dev, ino)
+			check("source", source)
+			for _, inode := range []struct {
+				kind   string
+				number uint64
+			}{
+				{"source", source},
+				{"chunk", f.chunkInode(source, 0)},
+				{"chunk", f.chunkInode(source, 1<<inodeChunkBits-1)},
+				{"directory", f.chunkDirectoryInode(source, 0)},
+				{"directory", f.chunkDirectoryInode(source, 1<<inodeDirectoryBits-1)},
+				{"link", f.linkInode(source, "a/b")},
+			} {
+				check(inode.kind, inode.number)
+				if other, ok := seen[inode.number]; ok && inode.kind != "source" {
+					t.Errorf("inode %#x of a %s node was also given to %s", inode.number, inode.kind, other)
+				}
+				seen[inode.number] = inode.kind
+				if inode.kind == "source" {
+					continue
+				}
+				_, decodedSource, _, ok := decodeDerivedInode(inode.number)
+				if !ok || decodedSource != source {
+					t.Errorf("decodeDerivedInode(%#x) = %#x, %v, want %#x", inode.number, decodedSource, ok, source)
+				}
+			}
+		}
+	}
+	check("internal", internalInode("config.json"))
+	check("internal", hardLinksManifestInode)
+	check("internal", controlDirectoryInode)
+}
+
+func TestInodeOverflow(t *testing.T) {
+	f := newTestInodes(100)
+	source := f.sourceInode(100, 1<<inodeFileBits)
+	if source>>60 == 0xe {
+		t.Fatalf("source inode %#x overflowed, but fits in %d bits", source, inodeSourceBits)
+	}
+	for _, test := range []struct {
+		name  string
+		inode func() uint64
+		key   inodeKey
+	}{
+		{"large source inode", func() uint64 { return f.sourceInode(100, 1<<inodeSourceBits) }, inodeKey{a: 100, b: 1 << inodeSourceBits}},
+		{"chunk of a source with a large inode", func() uint64 { return f.chunkInode(source, 0) }, inodeKey{kind: inodeChunkKind, a: source, b: 0}},
+		{"large chunk index", func() uint64 { return f.chunkInode(1, 1<<inodeChunkBits) }, inodeKey{kind: inodeChunkKind, a: 1, b: 1 << inodeChunkBits}},
+		{"large directory number", func() uint64 { return f.chunkDirectoryInode(1, 1<<inodeDirectoryBits) }, inodeKey{kind: inodeDirectoryKind, a: 1, b: 1 << inodeDirectoryBits}},
+		{"link of a source with a large inode", func() uint64 { return f.linkInode(source, "a/b") }, inodeKey{kind: inodeLinkKind, a: source, b: linkNumber("a/b")}},
+	} {
+		inode := test.inode()
+		if inode>>60 != 0xe {
+			t.Errorf("%s: inode %#x is not in the overflow range", test.name, inode)
+			continue
+		}
+		if again := test.inode(); again != inode {
+			t.Errorf("%s: got inode %#x, then %#x", test.name, inode, again)
+		}
+		if key, ok := f.inodeOverflowKey(inode); !ok || key != test.key {
+			t.Errorf("%s: inodeOverflowKey(%#x) = %+v, %v, want %+v", test.name, inode, key, ok, test.key)
+		}
+		if _, _, _, ok := decodeDerivedInode(inode); ok {
+			t.Errorf("%s: decodeDerivedInode(%#x) succeeded", test.name, inode)
+		}
+	}
+	// Devices beyond the first 32 overflow.
+	inodes := make(map[uint64]bool)
+	for dev := uint64(1000); dev < 1000+maxDevices; dev++ {
+		inodes[f.sourceInode(dev, 1)] = true
+	}
+	overflowed := 0
+	for inode := range inodes {
+		if inode>>60 == 0xe {
+			overflowed++
+		}
+	}
+	if len(inodes) != maxDevices || overflowed != 1 {
+		t.Errorf("%d other devices got %d distinct inodes, %d of which overflowed; want %d and 1", maxDevices, len(inodes), overflowed, maxDevices)
+	}
+}
+
+func TestGroupNumbersAreUnique(t *testing.T) {
+	for _, fanOut := range []int64{2, 3, 10} {
+		for _, numberOfChunks := range []int64{1, 2, 3, 9, 10, 11, 99, 100, 101, 1000} {
+			numbers := make(map[uint64]chunkGroup)
+			levels := int64(0)
+			for size := topGroupSize(numberOfChunks, fanOut); size > 1; size /= fanOut {
+				levels++
+				for first := int64(0); first < numberOfChunks; first += size {
+					number := groupNumber(numberOfChunks, fanOut, first, size)
+					group := chunkGroup{first: first, size: size, number: number}
+					if number < maxHashSegmentDirectories {
+						t.Errorf("fan-out %d, %d chunks: group %+v has a hash segment number", fanOut, numberOfChunks, group)
+					}
+					if other, ok := numbers[number]; ok {
+						t.Errorf("fan-out %d, %d chunks: groups %+v and %+v share number %d", fanOut, numberOfChunks, group, other, number)
+					}
+					numbers[number] = group
+					if got, ok := groupByNumber(numberOfChunks, fanOut, number); !ok || *got != group {
+						t.Errorf("fan-out %d, %d chunks: groupByNumber(%d) = %+v, %v, want %+v", fanOut, numberOfChunks, number, got, ok, group)
+					}
+				}
+			}
+			if max := numberOfChunks/(fanOut-1) + levels; int64(len(numbers)) > max {
+				t.Errorf("fan-out %d, %d chunks: %d group numbers, want at most %d", fanOut, numberOfChunks, len(numbers), max)
+			}
+		}
+	}
+}
+
+// listInodes returns the inode numbers of every node of the filesystem, by
+// path.
+func listInodes(t *testing.T, f *FS) map[string]uint64 {
+	t.Helper()
+	inodes := make(map[string]uint64)
+	err := iofs.WalkDir(f.IOFS(), ".", func(name string, entry iofs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		inodes[name] = info.Sys().(*Attr).Inode
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listing: %v", err)
+	}
+	return inodes
+}
+
+func TestInodesAreStableAcrossInstances(t *testing.T) {
+	source := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"a": 3, "dir/b": 9, "dir/sub/c": 1} {
+		if err := os.WriteFile(filepath.Join(source, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var listings []map[string]uint64
+	for i := 0; i < 2; i++ {
+		f, err := NewFS(source, 1, ChunkFanOut(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		listings = append(listings, listInodes(t, f))
+	}
+	if !reflect.DeepEqual(listings[0], listings[1]) {
+		t.Errorf("inode numbers differ across instances:\n%v\n%v", listings[0], listings[1])
+	}
+	owners := make(map[uint64]string)
+	for name, inode := range listings[0] {
+		if other, ok := owners[inode]; ok {
+			t.Errorf("%s and %s share inode %#x", name, other, inode)
+		}
+		owners[inode] = name
+	}
+	// Devices get the same index regardless of the order they are met in.
+	f, g := newTestInodes(100), newTestInodes(100)
+	devices := []uint64{2049, 2050, 64769}
+	for i := range devices {
+		f.sourceInode(devices[i], 1)
+		g.sourceInode(devices[len(devices)-1-i], 1)
+	}
+	for _, dev := range devices {
+		if a, b := f.sourceInode(dev, 1), g.sourceInode(dev, 1); a != b {
+			t.Errorf("device %d got inode %#x and %#x", dev, a, b)
+		}
+	}
+}
+
+// TestLongEncryptedNames checks that the hash segment directories of a file
+// whose encrypted name needs more than 16 of them get inode numbers of their
+// own, distinct from those of its fan-out subdirectories, and that InodePath
+// finds every node again from its inode number.
+func TestLongEncryptedNames(t *testing.T) {
+	source := t.TempDir()
+	dir := strings.Repeat(strings.Repeat("d", 200)+"/", 18)
+	if err := os.MkdirAll(filepath.Join(source, dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, dir, "big"), make([]byte, 9), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hashFunc, err := hashes.GetKeyedHashFunc(hashes.EncryptedName, make([]byte, hashes.MinKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFS(source, 1, ChunkFanOut(2), FilenameHashFunc(hashFunc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.lookupPath(context.Background(), path.Join(dir, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments := len(hashSegments(n.(*fileAsDir).hash)); segments <= 17 {
+		t.Fatalf("the encrypted name has %d segments, want more than 17", segments)
+	}
+	// Paths are reported without the long directories.
+	short := func(name string) string {
+		return strings.TrimPrefix(name, dir)
+	}
+	owners := make(map[uint64]string)
+	for name, inode := range listInodes(t, f) {
+		if other, ok := owners[inode]; ok {
+			t.Errorf("%s and %s share inode %#x", short(name), short(other), inode)
+		}
+		owners[inode] = name
+		if got, err := f.InodePath(inode); err != nil || got != name {
+			t.Errorf("InodePath(%#x) = %q, %v, want %q", inode, short(got), err, short(name))
+		}
+	}
+}
+
+// longHash is a hash whose digest needs one more hash segment directory than
+// are reserved.
+type longHash struct{}
+
+func (longHash) Write(p []byte) (int, error) { return len(p), nil }
+
+func (longHash) Digest() (string, uint64) {
+	return strings.Repeat("a", maxHashSegmentLength*(maxHashSegmentDirectories+2)), 1
+}
+
+func TestTooLongHashes(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFS(source, 1, FilenameHashFunc(func() hashes.Hash { return longHash{} }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.lookupPath(context.Background(), "a"); err != syscall.ENAMETOOLONG {
+		t.Errorf("lookup of a file with a too long hash = %v, want ENAMETOOLONG", err)
+	}
+}
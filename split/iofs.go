@@ -0,0 +1,393 @@
+package split
+
+import (
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// IOFS is the chunked view of a source directory as an io/fs.FS, for
+// programs that use it directly rather than through a server. It is the
+// view that the servers of packages fusefs, httpfs, webdavfs, s3fs, sftpfs
+// and ninepfs are built on, so they all present the same names and bytes.
+//
+// Like os.DirFS, it follows symlinks when opening and stat'ing files, but
+// lists them as symlinks in directories; Lstat and ReadLink, as in
+// io/fs.ReadLinkFS, do not follow them. Symlinks are followed within the
+// chunked view only: those pointing outside of it, or to an absolute path,
+// are dangling. Opened regular files, such as chunks, implement io.ReaderAt
+// and io.Seeker. Opened directories list their entries in directory order,
+// a batch at a time, and implement io.Seeker to the offsets of their
+// entries.
+type IOFS struct {
+	splitFS *FS
+	// dir is the directory that names are relative to, and dirPath its
+	// root-relative path, for views returned by Sub.
+	dir     fsNode
+	dirPath string
+}
+
+var _ iofs.ReadDirFS = (*IOFS)(nil)
+var _ iofs.StatFS = (*IOFS)(nil)
+var _ iofs.SubFS = (*IOFS)(nil)
+
+// NewIOFS returns the chunked view of the given source directory as an
+// io/fs.FS, with the same arguments as NewFS.
+func NewIOFS(sourceDirectory string, chunkSize int64, options ...Option) (*IOFS, error) {
+	f, err := NewFS(sourceDirectory, chunkSize, options...)
+	if err != nil {
+		return nil, err
+	}
+	return f.IOFS(), nil
+}
+
+// IOFS returns the filesystem as an io/fs.FS.
+func (f *FS) IOFS() *IOFS {
+	return &IOFS{splitFS: f, dir: f.root()}
+}
+
+// FS returns the filesystem that the view presents.
+func (v *IOFS) FS() *FS {
+	return v.splitFS
+}
+
+// Path returns the root-relative path of the directory that names are
+// relative to: "" for the view returned by FS.IOFS, and the directory for
+// the views returned by Sub.
+func (v *IOFS) Path() string {
+	return v.dirPath
+}
+
+// resolve returns information about the node with the given name,
+// following symlinks if asked to, and its root-relative path.
+func (v *IOFS) resolve(op, name string, follow bool) (*nodeInfo, string, error) {
+	if !iofs.ValidPath(name) {
+		return nil, "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	relativePath := name
+	if name == "." {
+		relativePath = ""
+	}
+	links := 0
+	info, rootRelativePath, err := v.splitFS.resolve(context.Background(), v.dir, v.dirPath, relativePath, follow, &links)
+	if err != nil {
+		return nil, "", pathError(op, name, err)
+	}
+	resolved := *info
+	resolved.name = path.Base(name)
+	return &resolved, rootRelativePath, nil
+}
+
+// CleanPath returns the name in IOFS of a slash-separated path, such as one
+// sent by a client, which may be absolute, and may not go above the root:
+// "." for the root.
+func CleanPath(p string) string {
+	if p = cleanPath(p); p == "" {
+		return "."
+	}
+	return p
+}
+
+// Open opens the file with the given name, for reading.
+func (v *IOFS) Open(name string) (iofs.File, error) {
+	return v.OpenFile(name, os.O_RDONLY)
+}
+
+// OpenFile opens the file with the given name, with the access mode of the
+// given os.OpenFile flags; other flags are ignored. Only the command files
+// of the control directory can be written to, a command per write;
+// opening other files for writing fails with EROFS.
+func (v *IOFS) OpenFile(name string, flag int) (iofs.File, error) {
+	info, rootRelativePath, err := v.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if info.IsDir() && !write {
+		return &ioDirectory{splitFS: v.splitFS, ctx: ctx, info: info, path: name, rootRelativePath: rootRelativePath}, nil
+	}
+	reader, err := openNode(ctx, info.node, write)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &ioFile{nodeReader: reader, info: info, path: name}, nil
+}
+
+// Stat returns information about the file with the given name. Its Sys
+// method returns an *Attr.
+func (v *IOFS) Stat(name string) (iofs.FileInfo, error) {
+	info, _, err := v.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Lstat returns information about the file with the given name, without
+// following it if it is a symlink.
+func (v *IOFS) Lstat(name string) (iofs.FileInfo, error) {
+	info, _, err := v.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ReadLink returns the target of the symlink with the given name.
+func (v *IOFS) ReadLink(name string) (string, error) {
+	info, _, err := v.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", pathError("readlink", name, syscall.EINVAL)
+	}
+	target, err := readlink(context.Background(), info)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	return target, nil
+}
+
+// ReadDir returns the entries of the directory with the given name, sorted
+// by name.
+func (v *IOFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	file, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	d, ok := file.(*ioDirectory)
+	if !ok {
+		return nil, pathError("readdir", name, syscall.ENOTDIR)
+	}
+	entries, err := d.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, err
+}
+
+// Sub returns the view of the directory with the given name.
+func (v *IOFS) Sub(dir string) (iofs.FS, error) {
+	info, rootRelativePath, err := v.resolve("sub", dir, true)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, pathError("sub", dir, syscall.ENOTDIR)
+	}
+	return &IOFS{splitFS: v.splitFS, dir: info.node, dirPath: rootRelativePath}, nil
+}
+
+// ioFile is a regular file opened through IOFS.
+type ioFile struct {
+	*nodeReader
+	info *nodeInfo
+	path string
+}
+
+var _ iofs.File = (*ioFile)(nil)
+var _ io.ReaderAt = (*ioFile)(nil)
+var _ io.Seeker = (*ioFile)(nil)
+var _ io.Writer = (*ioFile)(nil)
+
+func (f *ioFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *ioFile) Read(p []byte) (int, error) {
+	n, err := f.nodeReader.Read(p)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		err = pathError("read", f.path, err)
+	}
+	return n, err
+}
+
+func (f *ioFile) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := f.nodeReader.ReadAt(p, offset)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		err = pathError("read", f.path, err)
+	}
+	return n, err
+}
+
+func (f *ioFile) Write(p []byte) (int, error) {
+	n, err := f.nodeReader.Write(p)
+	if err != nil {
+		err = pathError("write", f.path, err)
+	}
+	return n, err
+}
+
+// ioDirectory is a directory opened through IOFS. It is only read from the
+// source once ReadDir is called.
+type ioDirectory struct {
+	splitFS          *FS
+	ctx              context.Context
+	info             *nodeInfo
+	path             string
+	rootRelativePath string
+
+	mu     sync.Mutex
+	stream dirStream
+	// offset is the offset of the next entry.
+	offset int64
+}
+
+var _ iofs.ReadDirFile = (*ioDirectory)(nil)
+var _ io.Seeker = (*ioDirectory)(nil)
+
+func (d *ioDirectory) Stat() (iofs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *ioDirectory) Read([]byte) (int, error) {
+	return 0, pathError("read", d.path, syscall.EISDIR)
+}
+
+func (d *ioDirectory) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stream == nil {
+		return nil
+	}
+	err := d.stream.close()
+	d.stream = nil
+	if err != nil {
+		return pathError("close", d.path, err)
+	}
+	return nil
+}
+
+// open opens the stream of entries, if needed. d.mu must be held.
+func (d *ioDirectory) open() error {
+	if d.stream != nil {
+		return nil
+	}
+	stream, err := openDirStream(d.ctx, d.info.node)
+	if err != nil {
+		return err
+	}
+	if err := stream.seek(d.offset); err != nil {
+		stream.close()
+		return err
+	}
+	d.stream = stream
+	return nil
+}
+
+// ReadDir returns the next n entries of the directory, in directory order,
+// or all of the remaining ones if n <= 0. Entries that are added to or
+// removed from the directory while it is read may or may not be returned,
+// but the others are returned once.
+func (d *ioDirectory) ReadDir(n int) ([]iofs.DirEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries, err := d.readDir(n)
+	if err != nil {
+		return entries, pathError("readdir", d.path, err)
+	}
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// readDir implements ReadDir, with the errors returned by nodes. d.mu must
+// be held.
+func (d *ioDirectory) readDir(n int) (entries []iofs.DirEntry, err error) {
+	op := d.splitFS.startOp(opReadDir, d.rootRelativePath)
+	defer op.end(&err)
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	for n <= 0 || len(entries) < n {
+		entry, offset, err := d.stream.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+		d.offset = offset
+		dirEntry := &ioDirEntry{dir: d.info, entry: entry, offset: offset}
+		if entry.typ&os.ModeIrregular != 0 {
+			// The type of the entry is only known once it is looked up.
+			info, err := lookupChild(d.ctx, d.info, entry.name)
+			if err != nil {
+				continue
+			}
+			dirEntry.info, dirEntry.entry.typ = info, info.Mode().Type()
+		}
+		entries = append(entries, dirEntry)
+	}
+	return entries, nil
+}
+
+// Seek positions the directory at the entry with the given offset, as
+// returned by the Offset method of its entries, relative to the start of
+// the directory or to the current entry. Offset 0 is the start of the
+// directory, which is then listed again from the source.
+func (d *ioDirectory) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	default:
+		return 0, pathError("seek", d.path, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathError("seek", d.path, syscall.EINVAL)
+	}
+	d.offset = offset
+	if d.stream != nil {
+		if err := d.stream.seek(offset); err != nil {
+			return 0, pathError("seek", d.path, err)
+		}
+	}
+	return offset, nil
+}
+
+// ioDirEntry is an entry of a directory opened through IOFS. Besides
+// io/fs.DirEntry, it implements Inode() uint64, which returns the inode
+// number of the entry, and Offset() int64, which returns the offset of the
+// entry after it, for the Seek method of the directory.
+type ioDirEntry struct {
+	dir    *nodeInfo
+	entry  dirent
+	offset int64
+	// info is set once the entry was looked up.
+	info *nodeInfo
+}
+
+var _ iofs.DirEntry = (*ioDirEntry)(nil)
+
+func (e *ioDirEntry) Name() string        { return e.entry.name }
+func (e *ioDirEntry) IsDir() bool         { return e.entry.typ.IsDir() }
+func (e *ioDirEntry) Type() iofs.FileMode { return e.entry.typ }
+func (e *ioDirEntry) String() string      { return iofs.FormatDirEntry(e) }
+func (e *ioDirEntry) Inode() uint64       { return e.entry.inode }
+func (e *ioDirEntry) Offset() int64       { return e.offset }
+
+// Info looks up the entry, unless it was already.
+func (e *ioDirEntry) Info() (iofs.FileInfo, error) {
+	if e.info != nil {
+		return e.info, nil
+	}
+	info, err := lookupChild(context.Background(), e.dir, e.entry.name)
+	if err != nil {
+		return nil, pathError("stat", e.entry.name, err)
+	}
+	e.info = info
+	return info, nil
+}
@@ -0,0 +1,33 @@
+package split
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// TestIOFS checks the view against the io/fs conventions, with a split file
+// whose chunks are nested into fan-out directories, a file that is not split
+// in a subdirectory, and a symlink.
+func TestIOFS(t *testing.T) {
+	source := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"big.bin": "0123456789abcdefghij", "dir/a.txt": "a"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/a.txt", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	view, err := NewIOFS(source, 4, ExcludeRegexp(`\.txt$`), ChunkFanOut(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(view, "big.bin", "dir/a.txt", "link"); err != nil {
+		t.Error(err)
+	}
+}
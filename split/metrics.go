@@ -0,0 +1,215 @@
+package split
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of latency histogram buckets.
+var latencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// histogram is a latency histogram with fixed buckets.
+type histogram struct {
+	// count and sumNanos must be first for 64-bit alignment of atomic accesses.
+	count    int64
+	sumNanos int64
+	// buckets holds non-cumulative counts, one per latencyBuckets entry
+	// plus one for +Inf.
+	buckets [11]int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return d <= latencyBuckets[i]
+	})
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sumNanos, int64(d))
+	atomic.AddInt64(&h.count, 1)
+}
+
+// opKind is a FUSE operation that is measured.
+type opKind int
+
+const (
+	opAttr opKind = iota
+	opLookup
+	opReadDirAll
+	opOpen
+	opRead
+	opRelease
+	opReadlink
+	opReadDir
+	numOpKinds
+)
+
+var opNames = [numOpKinds]string{"Attr", "Lookup", "ReadDirAll", "Open", "Read", "Release", "Readlink", "ReadDir"}
+
+// syscallKind is a system call on the source filesystem that is measured.
+type syscallKind int
+
+const (
+	syscallLstat syscallKind = iota
+	syscallStat
+	syscallReadDir
+	syscallOpen
+	syscallReadAt
+	syscallReadlink
+	syscallClose
+	syscallGetxattr
+	syscallStatx
+	syscallStatfs
+	numSyscallKinds
+)
+
+var syscallNames = [numSyscallKinds]string{"lstat", "stat", "readdir", "open", "pread", "readlink", "close", "getxattr", "statx", "statfs"}
+
+// metrics holds the measurements exported in the Prometheus format.
+type metrics struct {
+	ops      [numOpKinds]histogram
+	syscalls [numSyscallKinds]histogram
+
+	// errnosMu protects errnos.
+	errnosMu sync.Mutex
+	// errnos counts FUSE replies by error name and operation.
+	errnos map[errnoKey]int64
+}
+
+type errnoKey struct {
+	op    opKind
+	errno string
+}
+
+// errnoNames are the symbolic names of the most common errnos, as
+// bazil.org/fuse names them. Others are named by their message.
+var errnoNames = map[syscall.Errno]string{
+	syscall.ENOSYS:       "ENOSYS",
+	syscall.ESTALE:       "ESTALE",
+	syscall.ENOENT:       "ENOENT",
+	syscall.EIO:          "EIO",
+	syscall.EPERM:        "EPERM",
+	syscall.EINTR:        "EINTR",
+	syscall.EEXIST:       "EEXIST",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+}
+
+// errnoName returns a symbolic name for an error returned by a node.
+func errnoName(err error) string {
+	var errno syscall.Errno
+	switch e := err.(type) {
+	case errorNumber:
+		errno = e.Errno()
+	case syscall.Errno:
+		errno = e
+	default:
+		return "EIO"
+	}
+	if name, ok := errnoNames[errno]; ok {
+		return name
+	}
+	return errno.Error()
+}
+
+// op records the outcome of a FUSE operation.
+func (m *metrics) op(kind opKind, latency time.Duration, err error) {
+	m.ops[kind].observe(latency)
+	if err == nil {
+		return
+	}
+	key := errnoKey{kind, errnoName(err)}
+	m.errnosMu.Lock()
+	defer m.errnosMu.Unlock()
+	if m.errnos == nil {
+		m.errnos = make(map[errnoKey]int64)
+	}
+	m.errnos[key]++
+}
+
+// syscall records the latency of a system call on the source filesystem
+// that started at the given time.
+func (m *metrics) syscall(kind syscallKind, start time.Time) {
+	m.syscalls[kind].observe(time.Since(start))
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeHistogram writes the samples of a histogram with the given labels.
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	cumulative := int64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += atomic.LoadInt64(&h.buckets[i])
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound.Seconds(), cumulative)
+	}
+	cumulative += atomic.LoadInt64(&h.buckets[len(latencyBuckets)])
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, time.Duration(atomic.LoadInt64(&h.sumNanos)).Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, atomic.LoadInt64(&h.count))
+}
+
+// WritePrometheusMetrics writes the metrics of the given filesystems, keyed
+// by mountpoint, in the Prometheus text exposition format.
+func WritePrometheusMetrics(w io.Writer, filesystems map[string]*FS) {
+	mountpoints := make([]string, 0, len(filesystems))
+	for mountpoint := range filesystems {
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	sort.Strings(mountpoints)
+	family := func(name, kind, help string, write func(labels string, f *FS)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, mountpoint := range mountpoints {
+			write(fmt.Sprintf("mountpoint=\"%s\"", escapeLabel(mountpoint)), filesystems[mountpoint])
+		}
+	}
+	family("splitfs_fuse_op_duration_seconds", "histogram", "Latency of FUSE operations.", func(labels string, f *FS) {
+		for kind := opKind(0); kind < numOpKinds; kind++ {
+			writeHistogram(w, "splitfs_fuse_op_duration_seconds", fmt.Sprintf("%s,op=\"%s\"", labels, opNames[kind]), &f.metrics.ops[kind])
+		}
+	})
+	family("splitfs_fuse_op_errors_total", "counter", "FUSE operations that returned an error, by errno.", func(labels string, f *FS) {
+		f.metrics.errnosMu.Lock()
+		keys := make([]errnoKey, 0, len(f.metrics.errnos))
+		for key := range f.metrics.errnos {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].op != keys[j].op {
+				return keys[i].op < keys[j].op
+			}
+			return keys[i].errno < keys[j].errno
+		})
+		for _, key := range keys {
+			fmt.Fprintf(w, "splitfs_fuse_op_errors_total{%s,op=\"%s\",errno=\"%s\"} %d\n", labels, opNames[key.op], key.errno, f.metrics.errnos[key])
+		}
+		f.metrics.errnosMu.Unlock()
+	})
+	family("splitfs_source_syscall_duration_seconds", "histogram", "Latency of system calls on the source directory.", func(labels string, f *FS) {
+		for kind := syscallKind(0); kind < numSyscallKinds; kind++ {
+			writeHistogram(w, "splitfs_source_syscall_duration_seconds", fmt.Sprintf("%s,syscall=\"%s\"", labels, syscallNames[kind]), &f.metrics.syscalls[kind])
+		}
+	})
+	family("splitfs_read_bytes_total", "counter", "Bytes read from the mount.", func(labels string, f *FS) {
+		fmt.Fprintf(w, "splitfs_read_bytes_total{%s} %d\n", labels, atomic.LoadInt64(&f.stats.bytesServed))
+	})
+	family("splitfs_open_handles", "gauge", "File handles currently open.", func(labels string, f *FS) {
+		fmt.Fprintf(w, "splitfs_open_handles{%s} %d\n", labels, f.OpenHandles())
+	})
+}
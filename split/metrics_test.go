@@ -0,0 +1,105 @@
+package split
+
+import (
+	"bytes"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseMetrics parses metrics in the Prometheus text exposition format into
+// the values of their samples, keyed by name and labels, and the types of
+// their families, keyed by name.
+func parseMetrics(t *testing.T, text string) (samples map[string]float64, types map[string]string) {
+	t.Helper()
+	samples, types = make(map[string]float64), make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		space := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[space+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		samples[line[:space]] = value
+	}
+	return samples, types
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "big.bin"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	view, err := NewIOFS(source, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := view.ReadDir("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := iofs.ReadFile(view, "big.bin/"+entries[0].Name()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := view.Stat("missing"); err == nil {
+		t.Fatal("missing file was found")
+	}
+	var out bytes.Buffer
+	WritePrometheusMetrics(&out, map[string]*FS{"/mnt": view.FS()})
+	samples, types := parseMetrics(t, out.String())
+
+	for name, want := range map[string]string{
+		"splitfs_fuse_op_duration_seconds":        "histogram",
+		"splitfs_fuse_op_errors_total":            "counter",
+		"splitfs_source_syscall_duration_seconds": "histogram",
+		"splitfs_read_bytes_total":                "counter",
+		"splitfs_open_handles":                    "gauge",
+	} {
+		if types[name] != want {
+			t.Errorf("%s has type %q, want %q", name, types[name], want)
+		}
+	}
+	if len(types) != 5 {
+		t.Errorf("got %d metric families, want 5: %v", len(types), types)
+	}
+	for sample, want := range map[string]float64{
+		`splitfs_read_bytes_total{mountpoint="/mnt"}`:                                      4,
+		`splitfs_open_handles{mountpoint="/mnt"}`:                                          0,
+		`splitfs_fuse_op_duration_seconds_count{mountpoint="/mnt",op="Read"}`:              1,
+		`splitfs_fuse_op_duration_seconds_count{mountpoint="/mnt",op="Release"}`:           1,
+		`splitfs_fuse_op_errors_total{mountpoint="/mnt",op="Lookup",errno="ENOENT"}`:       1,
+		`splitfs_source_syscall_duration_seconds_count{mountpoint="/mnt",syscall="pread"}`: 1,
+	} {
+		if got, ok := samples[sample]; !ok || got != want {
+			t.Errorf("%s = %v (present: %v), want %v", sample, got, ok, want)
+		}
+	}
+	// Every histogram has one series per operation or system call, and its
+	// +Inf bucket counts every observation.
+	for kind := opKind(0); kind < numOpKinds; kind++ {
+		labels := `mountpoint="/mnt",op="` + opNames[kind] + `"`
+		count, ok := samples["splitfs_fuse_op_duration_seconds_count{"+labels+"}"]
+		if !ok {
+			t.Errorf("no latency histogram for %s", opNames[kind])
+		}
+		if inf := samples["splitfs_fuse_op_duration_seconds_bucket{"+labels+`,le="+Inf"}`]; inf != count {
+			t.Errorf("%s: +Inf bucket = %v, want the count %v", opNames[kind], inf, count)
+		}
+	}
+	for kind := syscallKind(0); kind < numSyscallKinds; kind++ {
+		labels := `mountpoint="/mnt",syscall="` + syscallNames[kind] + `"`
+		if _, ok := samples["splitfs_source_syscall_duration_seconds_count{"+labels+"}"]; !ok {
+			t.Errorf("no latency histogram for %s", syscallNames[kind])
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package split
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// dirent is an entry of a directory, as listed before it is looked up.
+type dirent struct {
+	inode uint64
+	// typ is the type bits of the mode of the entry.
+	typ  os.FileMode
+	name string
+}
+
+// dirStream reads the entries of a directory a batch at a time, so that
+// large directories never have to be materialized. Entries are positioned
+// by offsets that stay valid while the stream is open.
+type dirStream interface {
+	// next returns the next entry and the offset of the entry after it, or
+	// io.EOF.
+	next() (entry dirent, offset int64, err error)
+	// seek positions the stream at the entry with the given offset, as
+	// returned by next. Offset 0 is the start of the directory, which is
+	// listed again from the source.
+	seek(offset int64) error
+	close() error
+}
+
+// openDirStream opens the given directory node for reading.
+func openDirStream(ctx context.Context, n fsNode) (dirStream, error) {
+	if opener, ok := n.(nodeDirOpener); ok {
+		return opener.openDir(ctx)
+	}
+	if readDirAller, ok := n.(nodeReadDirAller); ok {
+		return &direntSliceStream{ctx: ctx, dir: readDirAller}, nil
+	}
+	return nil, syscall.ENOTDIR
+}
+
+// direntSliceStream reads the entries of a directory that are listed all at
+// once. The offsets are entry indices.
+type direntSliceStream struct {
+	ctx     context.Context
+	dir     nodeReadDirAller
+	entries []dirent
+	listed  bool
+	offset  int64
+}
+
+func (s *direntSliceStream) next() (dirent, int64, error) {
+	if !s.listed {
+		entries, err := s.dir.ReadDirAll(s.ctx)
+		if err != nil {
+			return dirent{}, 0, err
+		}
+		s.entries, s.listed = entries, true
+	}
+	if s.offset >= int64(len(s.entries)) {
+		return dirent{}, 0, io.EOF
+	}
+	s.offset++
+	return s.entries[s.offset-1], s.offset, nil
+}
+
+func (s *direntSliceStream) seek(offset int64) error {
+	if offset == 0 {
+		s.listed = false
+	}
+	s.offset = offset
+	return nil
+}
+
+func (s *direntSliceStream) close() error {
+	return nil
+}
+
+// direntBufferSize is the size of the buffer that source directories are
+// read into, a batch of entries at a time.
+const direntBufferSize = 32 << 10
+
+// Positions of the fields of the linux_dirent64 entries returned by
+// getdents, which are the same on all architectures. Numbers are in the
+// byte order of the kernel.
+const (
+	sourceDirentIno    = 0
+	sourceDirentOff    = 8
+	sourceDirentReclen = 16
+	sourceDirentType   = 18
+	sourceDirentName   = 19
+)
+
+// direntReader reads the entries of a source directory in batches with
+// getdents, without stat'ing or sorting them. Entries are positioned by the
+// offsets that the source filesystem gives them, which stay valid while
+// entries are added to or removed from the directory: reading from an
+// offset neither skips nor repeats the entries that were there all along.
+type direntReader struct {
+	splitFS *FS
+	file    *os.File
+	// stat is that of the directory, whose device its entries share, except
+	// for mount points.
+	stat syscall.Stat_t
+	buf  []byte
+	// buf[pos:end] are the entries read but not returned yet.
+	pos, end int
+	// offset is the offset of the next entry, and bufOffset that of the
+	// first entry in buf.
+	offset    int64
+	bufOffset int64
+}
+
+func (f *FS) openDirentReader(fullPath string) (*direntReader, error) {
+	start := time.Now()
+	file, err := os.Open(fullPath)
+	f.metrics.syscall(syscallOpen, start)
+	if err != nil {
+		return nil, err
+	}
+	r := &direntReader{splitFS: f, file: file, buf: make([]byte, direntBufferSize)}
+	start = time.Now()
+	err = syscall.Fstat(int(file.Fd()), &r.stat)
+	f.metrics.syscall(syscallStat, start)
+	if err != nil {
+		file.Close()
+		return nil, &os.PathError{Op: "fstat", Path: fullPath, Err: err}
+	}
+	return r, nil
+}
+
+// seek positions the reader at the entry with the given offset. Offset 0 is
+// the start of the directory. Entries that were read already are not read
+// again from the source.
+func (r *direntReader) seek(offset int64) error {
+	if offset == r.offset {
+		return nil
+	}
+	for pos, entryOffset := 0, r.bufOffset; offset != 0 && r.end > 0; {
+		if entryOffset == offset {
+			r.pos, r.offset = pos, offset
+			return nil
+		}
+		if pos >= r.end {
+			break
+		}
+		entry := r.buf[pos:r.end]
+		pos += int(binary.NativeEndian.Uint16(entry[sourceDirentReclen:]))
+		entryOffset = int64(binary.NativeEndian.Uint64(entry[sourceDirentOff:]))
+	}
+	if _, err := syscall.Seek(int(r.file.Fd()), offset, io.SeekStart); err != nil {
+		return &os.PathError{Op: "seek", Path: r.file.Name(), Err: err}
+	}
+	r.pos, r.end = 0, 0
+	r.offset = offset
+	return nil
+}
+
+// next returns the name, type and inode number of the next entry, other
+// than "." and "..", or io.EOF.
+func (r *direntReader) next() (name string, direntType uint8, ino uint64, err error) {
+	for {
+		if r.pos >= r.end {
+			start := time.Now()
+			n, err := syscall.Getdents(int(r.file.Fd()), r.buf)
+			r.splitFS.metrics.syscall(syscallReadDir, start)
+			if err != nil {
+				return "", 0, 0, &os.PathError{Op: "getdents", Path: r.file.Name(), Err: err}
+			}
+			if n <= 0 {
+				return "", 0, 0, io.EOF
+			}
+			r.pos, r.end, r.bufOffset = 0, n, r.offset
+		}
+		entry := r.buf[r.pos:r.end]
+		reclen := int(binary.NativeEndian.Uint16(entry[sourceDirentReclen:]))
+		ino = binary.NativeEndian.Uint64(entry[sourceDirentIno:])
+		direntType = entry[sourceDirentType]
+		nameBytes := entry[sourceDirentName:reclen]
+		if i := bytes.IndexByte(nameBytes, 0); i != -1 {
+			nameBytes = nameBytes[:i]
+		}
+		r.pos += reclen
+		r.offset = int64(binary.NativeEndian.Uint64(entry[sourceDirentOff:]))
+		name = string(nameBytes)
+		if ino == 0 || name == "." || name == ".." {
+			continue
+		}
+		return name, direntType, ino, nil
+	}
+}
+
+func (r *direntReader) close() error {
+	start := time.Now()
+	err := r.file.Close()
+	r.splitFS.metrics.syscall(syscallClose, start)
+	return err
+}
+
+// direntModes maps the types of getdents entries to file modes.
+var direntModes = map[uint8]os.FileMode{
+	syscall.DT_REG:  0,
+	syscall.DT_DIR:  os.ModeDir,
+	syscall.DT_LNK:  os.ModeSymlink,
+	syscall.DT_FIFO: os.ModeNamedPipe,
+	syscall.DT_SOCK: os.ModeSocket,
+	syscall.DT_CHR:  os.ModeDevice | os.ModeCharDevice,
+	syscall.DT_BLK:  os.ModeDevice,
+}
+
+// direntInfo is what getdents tells about a file, which is enough to list it
+// unless its hard links matter.
+type direntInfo struct {
+	name string
+	mode os.FileMode
+	stat syscall.Stat_t
+}
+
+func (i *direntInfo) Name() string       { return i.name }
+func (i *direntInfo) Size() int64        { return 0 }
+func (i *direntInfo) Mode() os.FileMode  { return i.mode }
+func (i *direntInfo) ModTime() time.Time { return time.Time{} }
+func (i *direntInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *direntInfo) Sys() interface{}   { return &i.stat }
+
+// sourceEntry returns information about an entry of the directory, as read
+// by a direntReader. It only stats the entry when getdents does not tell its
+// type, or when its number of hard links is needed.
+func (d *directory) sourceEntry(r *direntReader, name string, direntType uint8, ino uint64) (os.FileInfo, error) {
+	mode, ok := direntModes[direntType]
+	if ok && !(mode.IsRegular() && d.splitFS.dedupHardLinks) {
+		return &direntInfo{name: name, mode: mode, stat: syscall.Stat_t{Dev: r.stat.Dev, Ino: ino}}, nil
+	}
+	start := time.Now()
+	info, err := os.Lstat(d.FullPath() + "/" + name)
+	d.splitFS.metrics.syscall(syscallLstat, start)
+	return info, err
+}
+
+// hasManifest reports whether the hard links manifest is listed in the
+// directory.
+func (d *directory) hasManifest() bool {
+	return d.rootRelativePath == "" && d.splitFS.dedupHardLinks
+}
+
+// manifestDirent is the entry of the hard links manifest.
+var manifestDirent = dirent{
+	inode: hardLinksManifestInode,
+	name:  hardLinksManifestName,
+}
+
+// directoryStream streams the entries of a source directory, so that memory
+// use does not grow with the size of the directory. The offsets are those
+// of the source filesystem, shifted by one at the root when the hard links
+// manifest comes first.
+type directoryStream struct {
+	dir    *directory
+	reader *direntReader
+	// offset is the offset of the next entry.
+	offset int64
+}
+
+func (d *directory) openDir(context.Context) (_ dirStream, err error) {
+	op := d.splitFS.startOp(opOpen, d.rootRelativePath)
+	defer op.end(&err)
+	reader, err := d.splitFS.openDirentReader(d.FullPath())
+	if err != nil {
+		return nil, d.sourceErr(err)
+	}
+	return &directoryStream{dir: d, reader: reader}, nil
+}
+
+func (s *directoryStream) next() (dirent, int64, error) {
+	shift := int64(0)
+	if s.dir.hasManifest() {
+		if s.offset == 0 {
+			s.offset = 1
+			return manifestDirent, s.offset, nil
+		}
+		shift = 1
+	}
+	for {
+		name, direntType, ino, err := s.reader.next()
+		if err == io.EOF {
+			return dirent{}, 0, err
+		}
+		if err != nil {
+			return dirent{}, 0, s.dir.sourceErr(err)
+		}
+		s.offset = s.reader.offset + shift
+		info, err := s.dir.sourceEntry(s.reader, name, direntType, ino)
+		if err != nil {
+			// The entry was removed since it was read.
+			continue
+		}
+		if entry, ok := s.dir.dirent(info); ok {
+			return entry, s.offset, nil
+		}
+	}
+}
+
+func (s *directoryStream) seek(offset int64) error {
+	s.offset = offset
+	if s.dir.hasManifest() && offset > 0 {
+		offset--
+	}
+	if err := s.reader.seek(offset); err != nil {
+		return s.dir.sourceErr(err)
+	}
+	return nil
+}
+
+func (s *directoryStream) close() (err error) {
+	op := s.dir.splitFS.startOp(opRelease, s.dir.rootRelativePath)
+	defer op.end(&err)
+	if err := s.reader.close(); err != nil {
+		return s.dir.sourceErr(err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package split
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+)
+
+// namingProbe is hashed to check whether two hash functions are the same.
+const namingProbe = "splitfs naming probe"
+
+// hashFuncDigest returns the digest of namingProbe under the settings' hash function.
+func (s *settings) hashFuncDigest() string {
+	h := s.filenameHashFunc()
+	h.Write([]byte(namingProbe))
+	digest, _ := h.Digest()
+	return digest
+}
+
+// checkReloadable returns an error if the two settings would produce
+// different chunk names for the same split file, or otherwise differ in a
+// way that requires remounting.
+func (s *settings) checkReloadable(other *settings) error {
+	if s.chunkSize != other.chunkSize {
+		return fmt.Errorf("chunk size cannot change from %d to %d bytes", s.chunkSize, other.chunkSize)
+	}
+	if s.hashFuncDigest() != other.hashFuncDigest() {
+		return fmt.Errorf("filename hash function cannot change")
+	}
+	if s.template().source != other.template().source {
+		return fmt.Errorf("chunk name template cannot change from %q to %q", s.template().source, other.template().source)
+	}
+	if s.hideSpecialFiles != other.hideSpecialFiles {
+		return fmt.Errorf("whether special files are hidden cannot change")
+	}
+	if s.chunkFanOut != other.chunkFanOut {
+		return fmt.Errorf("chunk fan-out cannot change from %d to %d", s.chunkFanOut, other.chunkFanOut)
+	}
+	if s.chunkNameKey != other.chunkNameKey {
+		return fmt.Errorf("chunk name key cannot change from %v to %v", s.chunkNameKey, other.chunkNameKey)
+	}
+	if s.dedupHardLinks != other.dedupHardLinks {
+		return fmt.Errorf("whether hard links are deduplicated cannot change")
+	}
+	if s.nfsExport != other.nfsExport {
+		return fmt.Errorf("whether the filesystem can be exported over NFS cannot change")
+	}
+	if s.symlinks != other.symlinks {
+		return fmt.Errorf("symlink policy cannot change from %v to %v", s.symlinks, other.symlinks)
+	}
+	return nil
+}
+
+// Reload applies the given options to a filesystem that may be mounted.
+// The chunk size and options must not change the chunk names of files that
+// remain split; only exclusion rules and cache TTLs can change. Options
+// that are not specified are reset to their defaults, as in NewFS.
+// Cached entries for files whose exclusion status changed are invalidated,
+// through the invalidator set by SetInvalidator.
+func (f *FS) Reload(chunkSize int64, options ...Option) error {
+	candidate := &FS{settings: defaultSettings}
+	candidate.chunkSize = chunkSize
+	for _, option := range options {
+		if err := option(candidate); err != nil {
+			return fmt.Errorf("cannot apply options: %v", err)
+		}
+	}
+	if err := f.settings.checkReloadable(&candidate.settings); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	oldExclude, oldInclude := f.excludeRegexp, f.includeRegexp
+	f.excludeRegexp = candidate.excludeRegexp
+	f.includeRegexp = candidate.includeRegexp
+	f.attrCacheTTL = candidate.attrCacheTTL
+	invalidator := f.invalidator
+	f.mu.Unlock()
+	if invalidator == nil || (sameRegexp(oldExclude, candidate.excludeRegexp) && sameRegexp(oldInclude, candidate.includeRegexp)) {
+		return nil
+	}
+	wasExcluded := func(path string) bool {
+		if oldExclude == nil || !oldExclude.MatchString(path) {
+			return false
+		}
+		return oldInclude == nil || !oldInclude.MatchString(path)
+	}
+	for _, dir := range invalidator.Directories() {
+		fullPath := path.Join(f.sourceDirectory, dir)
+		files, err := ioutil.ReadDir(fullPath)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			filePath := path.Join(fullPath, file.Name())
+			if wasExcluded(filePath) != f.IsExcluded(filePath) {
+				// Errors only mean that the kernel did not have the entry cached.
+				invalidator.InvalidateEntry(dir, file.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// sameRegexp reports whether two possibly-nil regexps are the same.
+func sameRegexp(a, b *regexp.Regexp) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
@@ -0,0 +1,134 @@
+package split
+
+import (
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"perot.me/splitfs/hashes"
+)
+
+// recordingInvalidator is an Invalidator that records the entries it is asked
+// to invalidate.
+type recordingInvalidator struct {
+	directories []string
+	mu          sync.Mutex
+	entries     []string
+}
+
+func (r *recordingInvalidator) Directories() []string { return r.directories }
+
+func (r *recordingInvalidator) InvalidateEntry(dir, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, filepath.Join(dir, name))
+	return nil
+}
+
+func (r *recordingInvalidator) InvalidateDirectory(dir string) error { return nil }
+
+// reloadSource returns a source directory with a split file and files
+// excluded from splitting depending on the exclusion rules.
+func reloadSource(t *testing.T) string {
+	t.Helper()
+	source := t.TempDir()
+	if err := os.Mkdir(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"big.bin", "a.iso", "b.txt", "dir/c.iso", "dir/d.bin"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+// chunkNames returns the names of the chunks of the split file at the given
+// path.
+func chunkNames(t *testing.T, f *FS, name string) []string {
+	t.Helper()
+	entries, err := iofs.ReadDir(f.IOFS(), name)
+	if err != nil {
+		t.Fatalf("listing %s: %v", name, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestReloadRefusesNamingChanges(t *testing.T) {
+	source := reloadSource(t)
+	f, err := NewFS(source, 4, ExcludeRegexp(`\.iso$`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := chunkNames(t, f, "big.bin")
+	for _, test := range []struct {
+		name      string
+		chunkSize int64
+		options   []Option
+	}{
+		{"chunk size", 8, nil},
+		{"filename hash", 4, []Option{FilenameHashFunc(hashes.GetHashFunc("fnv64a-hex"))}},
+		{"chunk name template", 4, []Option{ChunkNameTemplate("{hash}-{index}")}},
+	} {
+		options := append([]Option{ExcludeRegexp(`\.txt$`)}, test.options...)
+		if err := f.Reload(test.chunkSize, options...); err == nil {
+			t.Errorf("reload changing the %s succeeded", test.name)
+		}
+		if !f.IsExcluded(filepath.Join(source, "a.iso")) || f.IsExcluded(filepath.Join(source, "b.txt")) {
+			t.Errorf("refused reload changing the %s changed the exclusion rules", test.name)
+		}
+		if after := chunkNames(t, f, "big.bin"); !reflect.DeepEqual(after, before) {
+			t.Errorf("refused reload changing the %s changed chunk names from %v to %v", test.name, before, after)
+		}
+	}
+}
+
+func TestReloadInvalidatesExcludedEntries(t *testing.T) {
+	source := reloadSource(t)
+	f, err := NewFS(source, 4, ExcludeRegexp(`\.iso$`), AttrCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidator := &recordingInvalidator{directories: []string{"", "dir"}}
+	f.SetInvalidator(invalidator)
+	if err := f.Reload(4, ExcludeRegexp(`\.txt$`), AttrCacheTTL(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if f.IsExcluded(filepath.Join(source, "a.iso")) || !f.IsExcluded(filepath.Join(source, "b.txt")) {
+		t.Error("the exclusion rules were not swapped")
+	}
+	if f.attrCacheTTL != time.Second {
+		t.Errorf("attribute cache TTL = %v, want 1s", f.attrCacheTTL)
+	}
+	sort.Strings(invalidator.entries)
+	if want := []string{"a.iso", "b.txt", "dir/c.iso"}; !reflect.DeepEqual(invalidator.entries, want) {
+		t.Errorf("invalidated %v, want %v", invalidator.entries, want)
+	}
+	for name, wantDir := range map[string]bool{"a.iso": true, "b.txt": false, "dir/c.iso": true, "dir/d.bin": true} {
+		info, err := iofs.Stat(f.IOFS(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsDir() != wantDir {
+			t.Errorf("%s is a directory: %v, want %v", name, info.IsDir(), wantDir)
+		}
+	}
+
+	// Reloading the same rules invalidates nothing.
+	invalidator.entries = nil
+	if err := f.Reload(4, ExcludeRegexp(`\.txt$`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(invalidator.entries) != 0 {
+		t.Errorf("reload without changes invalidated %v", invalidator.entries)
+	}
+}
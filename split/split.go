@@ -1,41 +1,78 @@
 package split
 
 import (
-	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/big"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 	"golang.org/x/net/context"
 	"perot.me/splitfs/hashes"
 )
 
-type splitFS struct {
-	sourceDirectory             string
+// settings holds the behavior of an FS that is controlled by Options.
+type settings struct {
 	chunkSize                   int64
 	excludeRegexp               *regexp.Regexp
+	includeRegexp               *regexp.Regexp
 	filenameHashFunc            hashes.HashFunc
 	filenameIncludesTotalChunks bool
 	filenameIncludesMtime       bool
-}
-
-var _ fs.FS = (*splitFS)(nil)
-
-type Option func(*splitFS) error
+	hideSpecialFiles            bool
+	symlinks                    SymlinkPolicy
+	dedupHardLinks              bool
+	chunkNameKey                ChunkNameKey
+	chunkNameTemplate           *chunkNameTemplate
+	chunkFanOut                 int64
+	nfsExport                   bool
+	attrCacheTTL                time.Duration
+}
+
+// defaultSettings are the settings used when no Option overrides them.
+var defaultSettings = settings{
+	filenameHashFunc:            hashes.GetHashFunc("sha256-b32"),
+	filenameIncludesTotalChunks: true,
+	attrCacheTTL:                time.Minute,
+}
+
+// FS is a read-only filesystem that mirrors a source directory, presenting
+// regular files as directories of chunks.
+type FS struct {
+	// openHandles is the number of file handles currently open.
+	// It must be accessed atomically, and is first in the struct to
+	// guarantee 64-bit alignment.
+	openHandles int64
+	stats       stats
+	metrics     metrics
+
+	sourceDirectory string
+	// realSourceDirectory is sourceDirectory with all symlinks resolved.
+	realSourceDirectory string
+	control             *ControlHooks
+	accessLog           func(*AccessLogEntry)
+
+	// mu protects the settings that can be changed by Reload, and
+	// invalidator.
+	mu sync.RWMutex
+	settings
+	invalidator Invalidator
+
+	hardLinks hardLinks
+	inodes    inodes
+}
+
+type Option func(*FS) error
 
 func ExcludeRegexp(exclude string) Option {
-	return func(f *splitFS) error {
+	return func(f *FS) error {
 		excludeRegexp, err := regexp.Compile(exclude)
 		if err != nil {
 			return fmt.Errorf("invalid regexp %q: %v", exclude, err)
@@ -45,39 +82,88 @@ func ExcludeRegexp(exclude string) Option {
 	}
 }
 
+// IncludeRegexp makes files matching the given regexp get split even if
+// they match the ExcludeRegexp.
+func IncludeRegexp(include string) Option {
+	return func(f *FS) error {
+		includeRegexp, err := regexp.Compile(include)
+		if err != nil {
+			return fmt.Errorf("invalid regexp %q: %v", include, err)
+		}
+		f.includeRegexp = includeRegexp
+		return nil
+	}
+}
+
+// AttrCacheTTL sets how long the kernel may cache file attributes.
+func AttrCacheTTL(ttl time.Duration) Option {
+	return func(f *FS) error {
+		if ttl <= 0 {
+			return fmt.Errorf("attribute cache TTL (%v) must be positive", ttl)
+		}
+		f.attrCacheTTL = ttl
+		return nil
+	}
+}
+
 func FilenameHashFunc(hashFunc hashes.HashFunc) Option {
-	return func(f *splitFS) error {
+	return func(f *FS) error {
 		f.filenameHashFunc = hashFunc
 		return nil
 	}
 }
 
 func FilenameIncludesTotalChunks(filenameIncludesTotalChunks bool) Option {
-	return func(f *splitFS) error {
+	return func(f *FS) error {
 		f.filenameIncludesTotalChunks = filenameIncludesTotalChunks
 		return nil
 	}
 }
 
+// HideSpecialFiles hides FIFOs, sockets and device nodes from the
+// filesystem, rather than mirroring them.
+func HideSpecialFiles(hideSpecialFiles bool) Option {
+	return func(f *FS) error {
+		f.hideSpecialFiles = hideSpecialFiles
+		return nil
+	}
+}
+
 func FilenameIncludesMtime(filenameIncludesMtime bool) Option {
-	return func(f *splitFS) error {
+	return func(f *FS) error {
 		f.filenameIncludesMtime = filenameIncludesMtime
 		return nil
 	}
 }
 
-func (f *splitFS) Root() (fs.Node, error) {
-	return &directory{&node{f, ""}}, nil
+// root returns the root directory of the filesystem.
+func (f *FS) root() *directory {
+	return f.directory("")
 }
 
-func (f *splitFS) IsExcluded(path string) bool {
-	if f.excludeRegexp == nil {
+// directory returns the node of the directory at the given root-relative
+// path.
+func (f *FS) directory(rootRelativePath string) *directory {
+	// Stat and Lstat agree on directories, except on the symlinks to
+	// directories that are followed.
+	return &directory{&node{splitFS: f, rootRelativePath: rootRelativePath, follow: true}}
+}
+
+func (f *FS) IsExcluded(path string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.excludeRegexp == nil || !f.excludeRegexp.MatchString(path) {
 		return false
 	}
-	return f.excludeRegexp.MatchString(path)
+	return f.includeRegexp == nil || !f.includeRegexp.MatchString(path)
+}
+
+// OpenHandles returns the number of file handles currently open on the filesystem.
+func (f *FS) OpenHandles() int64 {
+	return atomic.LoadInt64(&f.openHandles)
 }
 
-func NewFS(sourceDirectory string, chunkSize int64, options ...Option) (fs.FS, error) {
+func NewFS(sourceDirectory string, chunkSize int64, options ...Option) (*FS, error) {
 	if chunkSize <= 0 {
 		return nil, fmt.Errorf("chunksize (%d bytes) must be larger than 0", chunkSize)
 	}
@@ -92,37 +178,46 @@ func NewFS(sourceDirectory string, chunkSize int64, options ...Option) (fs.FS, e
 	if err != nil {
 		return nil, fmt.Errorf("cannot convert %q to absolute directory: %v", sourceDirectory, err)
 	}
-	f := &splitFS{
-		sourceDirectory:             absoluteSource,
-		chunkSize:                   chunkSize,
-		filenameHashFunc:            hashes.GetHashFunc("sha256-b32"),
-		filenameIncludesTotalChunks: true,
+	realSource, err := filepath.EvalSymlinks(absoluteSource)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve symlinks in %q: %v", absoluteSource, err)
+	}
+	f := &FS{
+		sourceDirectory:     absoluteSource,
+		realSourceDirectory: realSource,
+		settings:            defaultSettings,
 	}
+	f.chunkSize = chunkSize
+	f.inodes.init(uint64(sourceStat.Sys().(*syscall.Stat_t).Dev))
 	for _, option := range options {
 		if err := option(f); err != nil {
 			return nil, fmt.Errorf("canot apply options: %v", err)
 		}
 	}
+	if f.nfsExport && !f.dedupHardLinks {
+		return nil, fmt.Errorf("NFS export requires deduplicating hard links, as hard links share an inode number")
+	}
+	if f.nfsExport && f.symlinks == SymlinksFollow {
+		return nil, fmt.Errorf("NFS export cannot follow symlinks, as followed symlinks share the inode number of their target")
+	}
 	return f, nil
 }
 
 type node struct {
-	splitFS          *splitFS
+	splitFS          *FS
 	rootRelativePath string
+	// follow is set if the node is presented as the target of the source
+	// file, which is a followed symlink.
+	follow bool
 }
 
 func (n *node) FullPath() string {
 	return path.Join(n.splitFS.sourceDirectory, n.rootRelativePath)
 }
 
-func osToFuseErr(err error) error {
-	if os.IsNotExist(err) {
-		return fuse.ENOENT
-	}
-	if os.IsPermission(err) {
-		return fuse.EPERM
-	}
-	return fuse.ENOSYS
+// sourceNode returns the node of the source file that a node presents.
+func (n *node) sourceNode() *node {
+	return n
 }
 
 func convertTime(timespec syscall.Timespec) time.Time {
@@ -130,7 +225,38 @@ func convertTime(timespec syscall.Timespec) time.Time {
 	return time.Unix(sec, nsec)
 }
 
-func copyStatToAttr(stat *syscall.Stat_t, attr *fuse.Attr) {
+// Attr holds the attributes of a node of the filesystem, as returned by the
+// Sys method of the os.FileInfo values of IOFS.
+type Attr struct {
+	// Valid is how long the attributes may be cached.
+	Valid  time.Duration
+	Inode  uint64
+	Size   uint64
+	Blocks uint64
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+	// Crtime is the birth time, which is not known, and left zero.
+	Crtime    time.Time
+	Mode      os.FileMode
+	Nlink     uint32
+	Uid       uint32
+	Gid       uint32
+	Rdev      uint32
+	BlockSize uint32
+	// Volatile is set for files whose content changes all the time, such as
+	// control files. Their size is not known in advance, so they must be
+	// read to their end rather than to their size, and never from a cache.
+	Volatile bool
+}
+
+// ETag returns the entity tag of a node for HTTP-based servers, which
+// changes whenever the source file it is made from is replaced or modified.
+func (a *Attr) ETag() string {
+	return fmt.Sprintf(`"%x-%x-%x"`, a.Inode, a.Size, a.Mtime.UnixNano())
+}
+
+func copyStatToAttr(stat *syscall.Stat_t, attr *Attr) {
 	mode := os.FileMode(stat.Mode & 0777)
 	switch stat.Mode & syscall.S_IFMT {
 	case syscall.S_IFBLK:
@@ -169,12 +295,26 @@ func copyStatToAttr(stat *syscall.Stat_t, attr *fuse.Attr) {
 	attr.Ctime = convertTime(stat.Ctim)
 }
 
-func (n *node) Attr(_ context.Context, attr *fuse.Attr) error {
+func (n *node) Attr(_ context.Context, attr *Attr) (err error) {
+	op := n.splitFS.startOp(opAttr, n.rootRelativePath)
+	defer op.end(&err)
 	stat := &syscall.Stat_t{}
-	if err := syscall.Lstat(n.FullPath(), stat); err != nil {
-		return osToFuseErr(err)
+	start := time.Now()
+	if n.follow {
+		err = syscall.Stat(n.FullPath(), stat)
+		n.splitFS.metrics.syscall(syscallStat, start)
+	} else {
+		err = syscall.Lstat(n.FullPath(), stat)
+		n.splitFS.metrics.syscall(syscallLstat, start)
+	}
+	if err != nil {
+		return n.sourceErr(err)
 	}
 	copyStatToAttr(stat, attr)
+	attr.Inode = n.splitFS.sourceInode(uint64(stat.Dev), stat.Ino)
+	n.splitFS.mu.RLock()
+	attr.Valid = n.splitFS.attrCacheTTL
+	n.splitFS.mu.RUnlock()
 	return nil
 }
 
@@ -182,116 +322,218 @@ type directory struct {
 	*node
 }
 
-var _ fs.Node = (*directory)(nil)
-var _ fs.HandleReadDirAller = (*directory)(nil)
+var _ fsNode = (*directory)(nil)
+var _ nodeLookuper = (*directory)(nil)
+var _ nodeReadDirAller = (*directory)(nil)
+var _ nodeDirOpener = (*directory)(nil)
+
+// dirent returns the entry of the directory for the given source file, and
+// whether it is shown at all.
+func (d *directory) dirent(f os.FileInfo) (dirent, bool) {
+	name := f.Name()
+	if d.hasManifest() && name == hardLinksManifestName {
+		return dirent{}, false
+	}
+	followed := false
+	if f.Mode()&os.ModeSymlink != 0 {
+		switch d.splitFS.symlinks {
+		case SymlinksHide:
+			return dirent{}, false
+		case SymlinksRewrite:
+			if _, err := d.splitFS.readSymlink(path.Join(d.rootRelativePath, name)); err != nil {
+				return dirent{}, false
+			}
+		case SymlinksFollow:
+			target, err := d.splitFS.followSymlink(path.Join(d.rootRelativePath, name))
+			if err != nil {
+				return dirent{}, false
+			}
+			f, followed = target, true
+		}
+	}
+	if isSpecial(f.Mode()) && d.splitFS.hideSpecialFiles {
+		return dirent{}, false
+	}
+	isExcluded := d.splitFS.IsExcluded(path.Join(d.FullPath(), name))
+	var inode uint64
+	var canonical string
+	if sys := f.Sys(); sys != nil {
+		stat := sys.(*syscall.Stat_t)
+		inode = d.splitFS.sourceInode(uint64(stat.Dev), stat.Ino)
+		canonical = path.Join(d.rootRelativePath, name)
+		if f.Mode().IsRegular() && !followed {
+			canonical = d.splitFS.canonicalPath(path.Join(d.rootRelativePath, name), stat)
+		}
+	}
+	direntType := f.Mode().Type()
+	if f.Mode().IsRegular() && canonical != "" && canonical != path.Join(d.rootRelativePath, name) {
+		inode = d.splitFS.linkInode(inode, path.Join(d.rootRelativePath, name))
+		direntType = os.ModeSymlink
+	} else if f.Mode().IsRegular() && !isExcluded {
+		direntType = os.ModeDir
+	}
+	return dirent{
+		inode: inode,
+		typ:   direntType,
+		name:  name,
+	}, true
+}
 
-func (d *directory) ReadDirAll(context.Context) ([]fuse.Dirent, error) {
-	fullPath := d.FullPath()
-	files, err := ioutil.ReadDir(fullPath)
+func (d *directory) ReadDirAll(context.Context) (_ []dirent, err error) {
+	op := d.splitFS.startOp(opReadDirAll, d.rootRelativePath)
+	defer op.end(&err)
+	reader, err := d.splitFS.openDirentReader(d.FullPath())
 	if err != nil {
-		return nil, osToFuseErr(err)
-	}
-	entries := make([]fuse.Dirent, len(files))
-	for i, f := range files {
-		name := f.Name()
-		isExcluded := d.splitFS.IsExcluded(path.Join(fullPath, name))
-		var inode uint64
-		if sys := f.Sys(); sys != nil {
-			inode = sys.(*syscall.Stat_t).Ino
+		return nil, d.sourceErr(err)
+	}
+	defer reader.close()
+	var entries []dirent
+	if d.hasManifest() {
+		entries = append(entries, manifestDirent)
+	}
+	for {
+		name, direntType, ino, err := reader.next()
+		if err == io.EOF {
+			return entries, nil
 		}
-		direntType := fuse.DT_Unknown
-		mode := f.Mode()
-		if mode.IsRegular() {
-			if isExcluded {
-				direntType = fuse.DT_File
-			} else {
-				direntType = fuse.DT_Dir
-			}
-		} else if mode.IsDir() {
-			direntType = fuse.DT_Dir
-		} else if mode&os.ModeSymlink != 0 {
-			direntType = fuse.DT_Link
-		} else if mode&os.ModeSocket != 0 {
-			direntType = fuse.DT_Socket
-		} else if mode&os.ModeDevice != 0 {
-			direntType = fuse.DT_Block
-		} else if mode&os.ModeCharDevice != 0 {
-			direntType = fuse.DT_Char
-		} else if mode&os.ModeNamedPipe != 0 {
-			direntType = fuse.DT_FIFO
+		if err != nil {
+			return nil, d.sourceErr(err)
+		}
+		info, err := d.sourceEntry(reader, name, direntType, ino)
+		if err != nil {
+			continue
 		}
-		entries[i] = fuse.Dirent{
-			Inode: inode,
-			Type:  direntType,
-			Name:  name,
+		if entry, ok := d.dirent(info); ok {
+			entries = append(entries, entry)
 		}
 	}
-	return entries, nil
 }
 
-func (d *directory) Lookup(_ context.Context, name string) (fs.Node, error) {
+func (d *directory) Lookup(_ context.Context, name string) (_ fsNode, err error) {
+	op := d.splitFS.startOp(opLookup, path.Join(d.rootRelativePath, name))
+	defer op.end(&err)
 	rootRelativePath := path.Join(d.rootRelativePath, name)
+	if rootRelativePath == controlDirectoryName && d.splitFS.control != nil {
+		return &controlDirectory{d.splitFS}, nil
+	}
+	if rootRelativePath == hardLinksManifestName && d.splitFS.dedupHardLinks {
+		return &hardLinksManifestFile{d.splitFS}, nil
+	}
 	fullPath := path.Join(d.FullPath(), name)
+	newNode := &node{splitFS: d.splitFS, rootRelativePath: rootRelativePath}
+	start := time.Now()
 	stat, err := os.Lstat(fullPath)
+	d.splitFS.metrics.syscall(syscallLstat, start)
 	if err != nil {
-		return nil, osToFuseErr(err)
+		return nil, newNode.sourceErr(err)
 	}
-	newNode := &node{d.splitFS, rootRelativePath}
+	info := stat
 	mode := stat.Mode()
+	if mode&os.ModeSymlink != 0 {
+		switch d.splitFS.symlinks {
+		case SymlinksHide:
+			return nil, rejection("symlink hidden")
+		case SymlinksRewrite:
+			if _, err := d.splitFS.readSymlink(rootRelativePath); err != nil {
+				return nil, newNode.sourceErr(err)
+			}
+		case SymlinksFollow:
+			target, err := d.splitFS.followSymlink(rootRelativePath)
+			if err != nil {
+				return nil, newNode.sourceErr(err)
+			}
+			newNode.follow = true
+			info = target
+			mode = target.Mode()
+		}
+	}
+	if mode.IsRegular() && !newNode.follow {
+		if canonical := d.splitFS.canonicalPath(rootRelativePath, stat.Sys().(*syscall.Stat_t)); canonical != rootRelativePath {
+			return &hardLinkSymlink{newNode, hardLinkTarget(rootRelativePath, canonical)}, nil
+		}
+	}
+	if !newNode.follow {
+		d.splitFS.rememberPath(stat.Sys().(*syscall.Stat_t), rootRelativePath)
+	}
 	if mode.IsDir() {
-		return &directory{newNode}, nil
+		return d.splitFS.directory(rootRelativePath), nil
 	}
 	if mode.IsRegular() {
 		if d.splitFS.IsExcluded(fullPath) {
 			return &directFile{newNode}, nil
 		}
+		hashedName, err := d.splitFS.hashedName(rootRelativePath)
+		if err != nil {
+			return nil, newNode.sourceErr(err)
+		}
 		fileHash := d.splitFS.filenameHashFunc()
-		rootRelativePathBytes := []byte(rootRelativePath)
-		written, err := fileHash.Write(rootRelativePathBytes)
+		hashedNameBytes := []byte(hashedName)
+		written, err := fileHash.Write(hashedNameBytes)
 		if err != nil {
 			return nil, fmt.Errorf("cannot compute hash: %v", err)
 		}
-		if written != len(rootRelativePathBytes) {
-			return nil, fmt.Errorf("could not write all bytes to file hash: %d bytes written, but expected %d bytes", written, len(rootRelativePathBytes))
+		if written != len(hashedNameBytes) {
+			return nil, fmt.Errorf("could not write all bytes to file hash: %d bytes written, but expected %d bytes", written, len(hashedNameBytes))
+		}
+		h, _ := fileHash.Digest()
+		if len(hashSegments(h))-1 > maxHashSegmentDirectories {
+			return nil, syscall.ENAMETOOLONG
 		}
-		h, inode := fileHash.Digest()
-		return &fileAsDir{newNode, h, inode}, nil
+		infoStat := info.Sys().(*syscall.Stat_t)
+		return &fileAsDir{node: newNode, hash: h, inode: d.splitFS.sourceInode(uint64(infoStat.Dev), infoStat.Ino)}, nil
 	}
 	if mode&os.ModeSymlink != 0 {
 		return &symlink{newNode}, nil
 	}
-	// TODO: Implement other types.
-	return nil, errors.New("unimplemented")
+	if isSpecial(mode) {
+		if d.splitFS.hideSpecialFiles {
+			return nil, rejection("special file hidden")
+		}
+		return &specialFile{newNode}, nil
+	}
+	return nil, newNode.sourceErr(fmt.Errorf("%s: unsupported file mode %v", fullPath, mode))
 }
 
-type directFile struct {
-	*node
+// isSpecial reports whether the mode is that of a FIFO, socket or device node.
+func isSpecial(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice) != 0
 }
 
-var _ fs.Node = (*directFile)(nil)
-var _ fs.NodeOpener = (*directFile)(nil)
+// specialFile is a FIFO, socket or device node.
+// Its attributes, including its type and device number, are mirrored from
+// the source, but it cannot be opened: the io/fs view refuses with ENXIO.
+// Through a mountpoint, the kernel never even forwards opens of such nodes:
+// opening a FIFO creates a pipe local to the mountpoint, unconnected to the
+// one in the source directory; connecting to a socket fails with
+// ECONNREFUSED; and opening a device node fails with EACCES, as fusermount
+// mounts FUSE filesystems with nodev, even for root, unless given the "dev"
+// option. splitfs never passes that option, and its mount helper drops it.
+type specialFile struct {
+	*node
+}
 
-var handleIDProvider <-chan fuse.HandleID
+var _ fsNode = (*specialFile)(nil)
 
-func init() {
-	idProvider := make(chan fuse.HandleID)
-	handleIDProvider = idProvider
-	go func() {
-		for id := fuse.HandleID(2); ; id++ {
-			idProvider <- id
-		}
-	}()
+type directFile struct {
+	*node
 }
 
-func (f *directFile) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if !req.Flags.IsReadOnly() {
-		return nil, fuse.Errno(syscall.EROFS)
+var _ fsNode = (*directFile)(nil)
+var _ nodeOpener = (*directFile)(nil)
+
+func (f *directFile) Open(_ context.Context, write bool) (_ fileHandle, err error) {
+	op := f.splitFS.startOp(opOpen, f.rootRelativePath)
+	defer op.end(&err)
+	if write {
+		return nil, syscall.EROFS
 	}
+	start := time.Now()
 	file, err := os.Open(f.FullPath())
+	f.splitFS.metrics.syscall(syscallOpen, start)
 	if err != nil {
-		return nil, osToFuseErr(err)
+		return nil, f.sourceErr(err)
 	}
-	resp.Handle = <-handleIDProvider
+	atomic.AddInt64(&f.splitFS.openHandles, 1)
 	return &directFileHandle{f, file}, nil
 }
 
@@ -300,23 +542,31 @@ type directFileHandle struct {
 	file *os.File
 }
 
-var _ fs.Handle = (*directFileHandle)(nil)
-var _ fs.HandleReader = (*directFileHandle)(nil)
-var _ fs.HandleReleaser = (*directFileHandle)(nil)
+var _ handleReader = (*directFileHandle)(nil)
+var _ handleReleaser = (*directFileHandle)(nil)
 
-func (f *directFileHandle) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	bytes := make([]byte, req.Size)
-	read, err := f.file.ReadAt(bytes, req.Offset)
+func (f *directFileHandle) Read(_ context.Context, p []byte, offset int64) (_ int, err error) {
+	op := f.splitFS.startOp(opRead, f.rootRelativePath)
+	defer op.end(&err)
+	start := time.Now()
+	read, err := f.file.ReadAt(p, offset)
+	f.splitFS.metrics.syscall(syscallReadAt, start)
 	if err != nil && err != io.EOF {
-		return osToFuseErr(err)
+		return read, f.sourceErr(err)
 	}
-	resp.Data = bytes[:read]
-	return nil
+	atomic.AddInt64(&f.splitFS.stats.bytesServed, int64(read))
+	return read, nil
 }
 
-func (f *directFileHandle) Release(_ context.Context, req *fuse.ReleaseRequest) error {
-	if err := f.file.Close(); err != nil {
-		return osToFuseErr(err)
+func (f *directFileHandle) Release(context.Context) (err error) {
+	op := f.splitFS.startOp(opRelease, f.rootRelativePath)
+	defer op.end(&err)
+	atomic.AddInt64(&f.splitFS.openHandles, -1)
+	start := time.Now()
+	err = f.file.Close()
+	f.splitFS.metrics.syscall(syscallClose, start)
+	if err != nil {
+		return f.sourceErr(err)
 	}
 	return nil
 }
@@ -325,40 +575,95 @@ type symlink struct {
 	*node
 }
 
-var _ fs.Node = (*symlink)(nil)
-var _ fs.NodeReadlinker = (*symlink)(nil)
+var _ fsNode = (*symlink)(nil)
+var _ nodeReadlinker = (*symlink)(nil)
 
-func (s *symlink) Readlink(context.Context, *fuse.ReadlinkRequest) (string, error) {
-	link, err := os.Readlink(s.FullPath())
+func (s *symlink) Readlink(context.Context) (_ string, err error) {
+	op := s.splitFS.startOp(opReadlink, s.rootRelativePath)
+	defer op.end(&err)
+	link, err := s.splitFS.readSymlink(s.rootRelativePath)
 	if err != nil {
-		return "", osToFuseErr(err)
+		return "", s.sourceErr(err)
 	}
 	return link, nil
 }
 
 type fileAsDir struct {
 	*node
-	hash      string
-	inodeBase uint64
-}
-
-var _ fs.Node = (*fileAsDir)(nil)
-var _ fs.HandleReadDirAller = (*fileAsDir)(nil)
-
-func (f *fileAsDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	hash string
+	// inode is the inode number of the file.
+	inode uint64
+	// level is the depth of this directory below the file's own directory,
+	// for hashes that are split into segments.
+	level int
+	// group is the range of chunks held by the directory, if it is a fan-out
+	// subdirectory.
+	group *chunkGroup
+}
+
+var _ fsNode = (*fileAsDir)(nil)
+var _ nodeLookuper = (*fileAsDir)(nil)
+var _ nodeReadDirAller = (*fileAsDir)(nil)
+var _ nodeDirOpener = (*fileAsDir)(nil)
+
+func (f *fileAsDir) Attr(ctx context.Context, attr *Attr) error {
 	if err := f.node.Attr(ctx, attr); err != nil {
 		return err
 	}
 	attr.Mode = (attr.Mode & 0555) | os.ModeDir
+	if f.group != nil {
+		attr.Inode = f.splitFS.chunkDirectoryInode(f.inode, f.group.number)
+	} else if f.level > 0 {
+		attr.Inode = f.splitFS.chunkDirectoryInode(f.inode, uint64(f.level-1))
+	}
 	return nil
 }
 
+// maxHashSegmentLength is the length of the longest hash that is used as is
+// in chunk names. Longer hashes, such as encrypted names, are split into
+// segments of this length. All but the last one are nested directories
+// within the file's directory, which contain the chunks.
+const maxHashSegmentLength = 160
+
+// hashSegments splits a hash into segments of at most maxHashSegmentLength.
+func hashSegments(hash string) []string {
+	var segments []string
+	for len(hash) > maxHashSegmentLength {
+		segments = append(segments, hash[:maxHashSegmentLength])
+		hash = hash[maxHashSegmentLength:]
+	}
+	return append(segments, hash)
+}
+
+// HashFromChunkPath returns the full hash of a chunk file, given its path in
+// a copy of the filesystem and the template its name was rendered from. The
+// path must include the directories that hold the hash's segments, if any.
+func HashFromChunkPath(chunkPath, template string) (string, error) {
+	t, err := parseChunkNameTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	hashRegexp, err := t.hashRegexp()
+	if err != nil {
+		return "", err
+	}
+	match := hashRegexp.FindStringSubmatch(filepath.Base(chunkPath))
+	if match == nil {
+		return "", fmt.Errorf("%q: chunk name does not match template %q", chunkPath, template)
+	}
+	hash := match[1]
+	for dir := filepath.Dir(chunkPath); ; dir = filepath.Dir(dir) {
+		segment := filepath.Base(dir)
+		if len(segment) != maxHashSegmentLength || strings.ContainsAny(segment, "_.") {
+			return hash, nil
+		}
+		hash = segment + hash
+	}
+}
+
 const minFormatZeroes = 8
 const chunkFileExtension = ".splitfs.chunk"
 
-var fileAsDirWithTotalChunksFormatString = fmt.Sprintf("%%s_%%0%dd_of_%%0%dd%%s%s", minFormatZeroes, minFormatZeroes, chunkFileExtension)
-var fileAsDirWithoutTotalChunksFormatString = fmt.Sprintf("%%s_%%0%dd%%s%s", minFormatZeroes, chunkFileExtension)
-
 // ceilAndRemainder returns (ceil(x / y), x mod y).
 // It panics if y == 0.
 func ceilAndRemainder(x, y int64) (int64, int64) {
@@ -377,109 +682,79 @@ type fileAsDirData struct {
 }
 
 func (f *fileAsDir) getData() (fileAsDirData, error) {
+	start := time.Now()
 	stat, err := os.Stat(f.FullPath())
+	f.splitFS.metrics.syscall(syscallStat, start)
 	if err != nil {
 		return fileAsDirData{}, err
 	}
 	numChunks, lastChunkSize := ceilAndRemainder(stat.Size(), f.splitFS.chunkSize)
+	if lastChunkSize == 0 {
+		// The size of the file is a multiple of the chunk size.
+		lastChunkSize = f.splitFS.chunkSize
+	}
 	return fileAsDirData{numChunks, lastChunkSize, stat.ModTime().Truncate(time.Second)}, nil
 }
 
-func (f *fileAsDir) ReadDirAll(context.Context) ([]fuse.Dirent, error) {
-	data, err := f.getData()
-	if err != nil {
-		return nil, osToFuseErr(err)
-	}
-	mtime := ""
-	if f.splitFS.filenameIncludesMtime {
-		mtime = fmt.Sprintf(".mtime=%d", data.mtime.Unix())
-	}
-	entries := make([]fuse.Dirent, data.numberOfChunks)
-	for i := int64(0); i < data.numberOfChunks; i++ {
-		var name string
-		if f.splitFS.filenameIncludesTotalChunks {
-			name = fmt.Sprintf(fileAsDirWithTotalChunksFormatString, f.hash, i+1, data.numberOfChunks, mtime)
-		} else {
-			name = fmt.Sprintf(fileAsDirWithoutTotalChunksFormatString, f.hash, i+1, mtime)
-		}
-		entries[i] = fuse.Dirent{
-			Inode: f.inodeBase + uint64(i+1),
-			Type:  fuse.DT_File,
-			Name:  name,
-		}
+// chunkNameValues returns the values of chunk name placeholders for the
+// file, whose chunk names use the given hash.
+func (f *fileAsDir) chunkNameValues(hash string, data fileAsDirData) *chunkNameValues {
+	return &chunkNameValues{
+		hash:          hash,
+		basename:      path.Base(f.rootRelativePath),
+		total:         data.numberOfChunks,
+		mtime:         data.mtime,
+		chunkSize:     f.splitFS.chunkSize,
+		lastChunkSize: data.lastChunkSize,
 	}
-	return entries, nil
 }
 
-func (f *fileAsDir) Lookup(_ context.Context, name string) (fs.Node, error) {
-	if !strings.HasSuffix(name, chunkFileExtension) {
-		return nil, fuse.ENOENT
+// ReadDirAll returns all entries of the directory at once. They can also be
+// read a batch at a time, with openDir.
+func (f *fileAsDir) ReadDirAll(context.Context) (_ []dirent, err error) {
+	op := f.splitFS.startOp(opReadDirAll, f.rootRelativePath)
+	defer op.end(&err)
+	l, err := f.listing()
+	if err != nil {
+		return nil, f.sourceErr(err)
 	}
-	name = strings.TrimSuffix(name, chunkFileExtension)
-	var mtime time.Time
-	if f.splitFS.filenameIncludesMtime {
-		dotIndex := strings.LastIndex(name, ".")
-		if dotIndex == -1 {
-			return nil, fuse.ENOENT
-		}
-		mtimeSplit := strings.Split(name[dotIndex+1:], "=")
-		if len(mtimeSplit) != 2 || mtimeSplit[0] != "mtime" {
-			return nil, fuse.ENOENT
-		}
-		mtimeUnix, err := strconv.ParseInt(mtimeSplit[1], 10, 64)
-		if err != nil {
-			return nil, fuse.ENOENT
-		}
-		mtime = time.Unix(mtimeUnix, 0)
-		name = name[:dotIndex]
-	}
-	parts := strings.Split(name, "_")
-	var hashPart, chunkPart, totalChunksPart string
-	if f.splitFS.filenameIncludesTotalChunks {
-		if len(parts) != 4 {
-			return nil, fuse.ENOENT
-		}
-		hashPart, chunkPart, totalChunksPart = parts[0], parts[1], parts[3]
-
-		if parts[2] != "of" {
-			return nil, fuse.ENOENT
-		}
+	entries := make([]dirent, l.count)
+	for i := range entries {
+		entries[i] = l.entry(int64(i))
 	}
-	if !f.splitFS.filenameIncludesTotalChunks {
-		if len(parts) != 2 {
-			return nil, fuse.ENOENT
+	return entries, nil
+}
+
+func (f *fileAsDir) Lookup(_ context.Context, name string) (_ fsNode, err error) {
+	op := f.splitFS.startOp(opLookup, path.Join(f.rootRelativePath, name))
+	defer op.end(&err)
+	segments := hashSegments(f.hash)
+	if f.level < len(segments)-1 {
+		if name != segments[f.level] {
+			return nil, rejection("hash segment mismatch")
 		}
-		hashPart, chunkPart = parts[0], parts[1]
-	}
-	if hashPart != f.hash {
-		return nil, fuse.ENOENT
-	}
-	chunk, err := strconv.ParseInt(chunkPart, 10, 64)
-	if err != nil || chunk < 0 {
-		return nil, fuse.ENOENT
+		return &fileAsDir{node: f.node, hash: f.hash, inode: f.inode, level: f.level + 1}, nil
 	}
-	chunk-- // Filenames are 1-indexed, so convert back down to 0.
-	data, err := f.getData()
+	l, err := f.listing()
 	if err != nil {
-		return nil, osToFuseErr(err)
+		return nil, f.sourceErr(err)
 	}
-	if f.splitFS.filenameIncludesTotalChunks {
-		numChunksFromFilename, err := strconv.ParseInt(totalChunksPart, 10, 64)
-		if err != nil {
-			return nil, fuse.ENOENT
-		}
-		if numChunksFromFilename != data.numberOfChunks {
-			return nil, fuse.ENOENT
-		}
+	if l.unit > 1 {
+		return f.lookupGroup(l, name)
 	}
-	if f.splitFS.filenameIncludesMtime {
-		if mtime != data.mtime {
-			return nil, fuse.ENOENT
-		}
+	chunk, err := l.template.parse(name, l.values)
+	op.setChunk(chunk)
+	if err != nil {
+		return nil, err
 	}
-	if chunk >= data.numberOfChunks {
-		return nil, fuse.ENOENT
+	if chunk < l.first || chunk >= l.end {
+		return nil, rejection("chunk in another fan-out directory")
 	}
+	return f.chunkNode(chunk, l.data), nil
+}
+
+// chunkNode returns the node of the given chunk of the file.
+func (f *fileAsDir) chunkNode(chunk int64, data fileAsDirData) *fileChunk {
 	size := f.splitFS.chunkSize
 	if chunk == data.numberOfChunks-1 {
 		size = data.lastChunkSize
@@ -489,7 +764,7 @@ func (f *fileAsDir) Lookup(_ context.Context, name string) (fs.Node, error) {
 		chunk:  chunk,
 		offset: chunk * f.splitFS.chunkSize,
 		size:   size,
-	}, nil
+	}
 }
 
 type fileChunk struct {
@@ -499,34 +774,40 @@ type fileChunk struct {
 	size   int64
 }
 
-var _ fs.Node = (*fileChunk)(nil)
-var _ fs.NodeOpener = (*fileChunk)(nil)
+var _ fsNode = (*fileChunk)(nil)
+var _ nodeOpener = (*fileChunk)(nil)
 
-func (f *fileChunk) Attr(ctx context.Context, attr *fuse.Attr) error {
+func (f *fileChunk) Attr(ctx context.Context, attr *Attr) error {
 	if err := f.node.Attr(ctx, attr); err != nil {
 		return err
 	}
-	attr.Inode += uint64(f.chunk + 1)
+	attr.Inode = f.splitFS.chunkInode(attr.Inode, f.chunk)
 	attr.Size = uint64(f.size)
 	numBlocks, _ := ceilAndRemainder(f.size, 512)
 	attr.Blocks = uint64(numBlocks)
 	return nil
 }
 
-func (f *fileChunk) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if !req.Flags.IsReadOnly() {
-		return nil, fuse.Errno(syscall.EROFS)
+func (f *fileChunk) Open(_ context.Context, write bool) (_ fileHandle, err error) {
+	op := f.splitFS.startOp(opOpen, f.rootRelativePath)
+	defer op.end(&err)
+	op.setChunk(f.chunk)
+	if write {
+		return nil, syscall.EROFS
 	}
+	start := time.Now()
 	file, err := os.Open(f.FullPath())
+	f.splitFS.metrics.syscall(syscallOpen, start)
 	if err != nil {
-		return nil, osToFuseErr(err)
+		return nil, f.sourceErr(err)
 	}
 	if f.offset != 0 {
 		if _, err := file.Seek(f.offset, 0); err != nil {
-			return nil, osToFuseErr(err)
+			file.Close()
+			return nil, f.sourceErr(err)
 		}
 	}
-	resp.Handle = <-handleIDProvider
+	atomic.AddInt64(&f.splitFS.openHandles, 1)
 	return &fileChunkHandle{f, file}, nil
 }
 
@@ -535,31 +816,41 @@ type fileChunkHandle struct {
 	file *os.File
 }
 
-var _ fs.Handle = (*fileChunkHandle)(nil)
-var _ fs.HandleReader = (*fileChunkHandle)(nil)
-var _ fs.HandleReleaser = (*fileChunkHandle)(nil)
+var _ handleReader = (*fileChunkHandle)(nil)
+var _ handleReleaser = (*fileChunkHandle)(nil)
 
-func (f *fileChunkHandle) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	trueOffset := req.Offset + f.offset
-	trueSize := int64(req.Size)
-	if trueSize > f.size-req.Offset {
-		trueSize = f.size - req.Offset
+func (f *fileChunkHandle) Read(_ context.Context, p []byte, offset int64) (_ int, err error) {
+	op := f.splitFS.startOp(opRead, f.rootRelativePath)
+	defer op.end(&err)
+	op.setChunk(f.chunk)
+	trueOffset := offset + f.offset
+	trueSize := int64(len(p))
+	if trueSize > f.size-offset {
+		trueSize = f.size - offset
 	}
 	if trueSize < 0 {
 		trueSize = 0
 	}
-	bytes := make([]byte, trueSize)
-	read, err := f.file.ReadAt(bytes, trueOffset)
+	start := time.Now()
+	read, err := f.file.ReadAt(p[:trueSize], trueOffset)
+	f.splitFS.metrics.syscall(syscallReadAt, start)
 	if err != nil && err != io.EOF {
-		return osToFuseErr(err)
+		return read, f.sourceErr(err)
 	}
-	resp.Data = bytes[:read]
-	return nil
+	atomic.AddInt64(&f.splitFS.stats.bytesServed, int64(read))
+	return read, nil
 }
 
-func (f *fileChunkHandle) Release(_ context.Context, req *fuse.ReleaseRequest) error {
-	if err := f.file.Close(); err != nil {
-		return osToFuseErr(err)
+func (f *fileChunkHandle) Release(context.Context) (err error) {
+	op := f.splitFS.startOp(opRelease, f.rootRelativePath)
+	defer op.end(&err)
+	op.setChunk(f.chunk)
+	atomic.AddInt64(&f.splitFS.openHandles, -1)
+	start := time.Now()
+	err = f.file.Close()
+	f.splitFS.metrics.syscall(syscallClose, start)
+	if err != nil {
+		return f.sourceErr(err)
 	}
 	return nil
 }
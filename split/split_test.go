@@ -0,0 +1,110 @@
+package split
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// specialSource returns a source directory with a FIFO, a socket and, if the
+// test may create device nodes, a character device with the numbers of
+// /dev/null, with the types they should be listed with.
+func specialSource(t *testing.T) (string, map[string]os.FileMode) {
+	t.Helper()
+	source := t.TempDir()
+	want := map[string]os.FileMode{"fifo": os.ModeNamedPipe, "socket": os.ModeSocket}
+	if err := syscall.Mkfifo(filepath.Join(source, "fifo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(source, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	// /dev/null is character device 1:3.
+	if err := syscall.Mknod(filepath.Join(source, "char"), syscall.S_IFCHR|0600, 1<<8|3); err == nil {
+		want["char"] = os.ModeDevice | os.ModeCharDevice
+	} else {
+		t.Logf("cannot create a device node: %v", err)
+	}
+	return source, want
+}
+
+func TestSpecialFiles(t *testing.T) {
+	source, want := specialSource(t)
+	f, err := NewFS(source, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.root()
+	ctx := context.Background()
+	dirents, err := root.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]os.FileMode)
+	for _, dirent := range dirents {
+		listed[dirent.name] = dirent.typ
+	}
+	for name, direntType := range want {
+		if listed[name] != direntType {
+			t.Errorf("%s listed with type %v, want %v", name, listed[name], direntType)
+		}
+		n, err := root.Lookup(ctx, name)
+		if err != nil {
+			t.Errorf("Lookup(%q) = %v", name, err)
+			continue
+		}
+		special, ok := n.(*specialFile)
+		if !ok {
+			t.Errorf("Lookup(%q) = %T, want *specialFile", name, n)
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(source, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attr Attr
+		if err := special.Attr(ctx, &attr); err != nil {
+			t.Fatalf("Attr of %s = %v", name, err)
+		}
+		if attr.Mode != info.Mode() {
+			t.Errorf("%s has mode %v, want %v", name, attr.Mode, info.Mode())
+		}
+		if rdev := uint32(info.Sys().(*syscall.Stat_t).Rdev); attr.Rdev != rdev {
+			t.Errorf("%s has device number %#x, want %#x", name, attr.Rdev, rdev)
+		}
+		if _, err := openNode(ctx, special, false); err != syscall.ENXIO {
+			t.Errorf("Open of %s = %v, want ENXIO", name, err)
+		}
+	}
+}
+
+func TestHideSpecialFiles(t *testing.T) {
+	source, want := specialSource(t)
+	if err := os.WriteFile(filepath.Join(source, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFS(source, 1, HideSpecialFiles(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := f.root()
+	ctx := context.Background()
+	dirents, err := root.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirents) != 1 || dirents[0].name != "file" {
+		t.Errorf("ReadDirAll = %v, want only file", dirents)
+	}
+	for name := range want {
+		if _, err := root.Lookup(ctx, name); toErrno(err) != syscall.ENOENT {
+			t.Errorf("Lookup(%q) = %v, want ENOENT", name, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package split
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxErrorPaths is the maximum number of distinct paths for which errors are
+// remembered. Errors on further paths are only counted.
+const maxErrorPaths = 1000
+
+// pathErrors records the errors that happened on a single path.
+type pathErrors struct {
+	count     int64
+	lastError string
+	lastTime  time.Time
+}
+
+// counters are the monotonic counters of a filesystem.
+type counters struct {
+	bytesServed          int64
+	directoryCacheHits   int64
+	directoryCacheMisses int64
+	errors               int64
+}
+
+// stats holds the statistics of a filesystem.
+type stats struct {
+	// counters must be first for 64-bit alignment of atomic accesses.
+	counters
+
+	// mu protects the fields below.
+	mu             sync.Mutex
+	pathErrors     map[string]*pathErrors
+	droppedErrors  int64
+	checkpoint     counters
+	checkpointTime time.Time
+}
+
+// snapshot returns the current value of all counters.
+func (s *stats) snapshot() counters {
+	return counters{
+		bytesServed:          atomic.LoadInt64(&s.bytesServed),
+		directoryCacheHits:   atomic.LoadInt64(&s.directoryCacheHits),
+		directoryCacheMisses: atomic.LoadInt64(&s.directoryCacheMisses),
+		errors:               atomic.LoadInt64(&s.errors),
+	}
+}
+
+// recordError remembers that an error happened on the given root-relative path.
+// Missing files are not recorded, as the kernel routinely looks them up.
+func (s *stats) recordError(rootRelativePath string, err error) {
+	if toErrno(err) == syscall.ENOENT {
+		return
+	}
+	atomic.AddInt64(&s.errors, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pathErrors == nil {
+		s.pathErrors = make(map[string]*pathErrors)
+	}
+	p, ok := s.pathErrors[rootRelativePath]
+	if !ok {
+		if len(s.pathErrors) >= maxErrorPaths {
+			s.droppedErrors++
+			return
+		}
+		p = &pathErrors{}
+		s.pathErrors[rootRelativePath] = p
+	}
+	p.count++
+	p.lastError = err.Error()
+	p.lastTime = time.Now()
+}
+
+// doCheckpoint records the current counters, so that later reports can show
+// activity since this point.
+func (s *stats) doCheckpoint() {
+	snapshot := s.snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoint = snapshot
+	s.checkpointTime = time.Now()
+}
+
+// RecordDirectoryCacheLookup counts a lookup of a directory in the cache of
+// directory nodes of a frontend, for the statistics of the control
+// directory.
+func (f *FS) RecordDirectoryCacheLookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&f.stats.directoryCacheHits, 1)
+	} else {
+		atomic.AddInt64(&f.stats.directoryCacheMisses, 1)
+	}
+}
+
+// ratio returns a/(a+b) as a percentage, or 0 if both are 0.
+func ratio(a, b int64) float64 {
+	if a+b == 0 {
+		return 0
+	}
+	return 100 * float64(a) / float64(a+b)
+}
+
+// writeStats writes a human-readable report of the filesystem's statistics.
+func (f *FS) writeStats(w io.Writer) {
+	current := f.stats.snapshot()
+	f.stats.mu.Lock()
+	checkpoint, checkpointTime := f.stats.checkpoint, f.stats.checkpointTime
+	f.stats.mu.Unlock()
+	fmt.Fprintf(w, "open_handles %d\n", f.OpenHandles())
+	fmt.Fprintf(w, "bytes_served %d\n", current.bytesServed)
+	fmt.Fprintf(w, "errors %d\n", current.errors)
+	fmt.Fprintf(w, "directory_cache_hits %d\n", current.directoryCacheHits)
+	fmt.Fprintf(w, "directory_cache_misses %d\n", current.directoryCacheMisses)
+	fmt.Fprintf(w, "directory_cache_hit_rate %.2f%%\n", ratio(current.directoryCacheHits, current.directoryCacheMisses))
+	if !checkpointTime.IsZero() {
+		fmt.Fprintf(w, "checkpoint_time %s\n", checkpointTime.Format(time.RFC3339))
+		fmt.Fprintf(w, "bytes_served_since_checkpoint %d\n", current.bytesServed-checkpoint.bytesServed)
+		fmt.Fprintf(w, "errors_since_checkpoint %d\n", current.errors-checkpoint.errors)
+		hits, misses := current.directoryCacheHits-checkpoint.directoryCacheHits, current.directoryCacheMisses-checkpoint.directoryCacheMisses
+		fmt.Fprintf(w, "directory_cache_hit_rate_since_checkpoint %.2f%%\n", ratio(hits, misses))
+	}
+}
+
+// writeErrors writes the errors recorded per path, most recent first.
+func (f *FS) writeErrors(w io.Writer) {
+	type entry struct {
+		path string
+		pathErrors
+	}
+	f.stats.mu.Lock()
+	entries := make([]entry, 0, len(f.stats.pathErrors))
+	for path, p := range f.stats.pathErrors {
+		entries = append(entries, entry{path, *p})
+	}
+	dropped := f.stats.droppedErrors
+	f.stats.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastTime.After(entries[j].lastTime)
+	})
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t/%s\n", e.lastTime.Format(time.RFC3339), e.count, e.lastError, e.path)
+	}
+	if dropped != 0 {
+		fmt.Fprintf(w, "(%d errors on other paths not shown)\n", dropped)
+	}
+}
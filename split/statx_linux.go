@@ -0,0 +1,35 @@
+package split
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the inode number and, if the filesystem records it, the
+// birth time of the file at the given path; otherwise, the birth time is
+// zero. It follows symlinks if follow is set.
+func birthTime(fullPath string, follow bool) (uint64, time.Time, error) {
+	flags := unix.AT_SYMLINK_NOFOLLOW
+	if follow {
+		flags = 0
+	}
+	stx := unix.Statx_t{}
+	if err := unix.Statx(unix.AT_FDCWD, fullPath, flags, unix.STATX_INO|unix.STATX_BTIME, &stx); err != nil {
+		return 0, time.Time{}, err
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return stx.Ino, time.Time{}, nil
+	}
+	return stx.Ino, time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), nil
+}
+
+// filesystemID returns the f_fsid of the filesystem holding the file at the
+// given path.
+func filesystemID(fullPath string) (uint64, error) {
+	stfs := unix.Statfs_t{}
+	if err := unix.Statfs(fullPath, &stfs); err != nil {
+		return 0, err
+	}
+	return uint64(uint32(stfs.Fsid.Val[0]))<<32 | uint64(uint32(stfs.Fsid.Val[1])), nil
+}
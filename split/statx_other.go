@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package split
+
+import (
+	"syscall"
+	"time"
+)
+
+// birthTime is not implemented outside of Linux, so that birth times are not
+// used.
+func birthTime(fullPath string, follow bool) (uint64, time.Time, error) {
+	return 0, time.Time{}, syscall.ENOSYS
+}
+
+// filesystemID is not implemented outside of Linux.
+func filesystemID(fullPath string) (uint64, error) {
+	return 0, syscall.ENOSYS
+}
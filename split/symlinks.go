@@ -0,0 +1,153 @@
+package split
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SymlinkPolicy controls how symbolic links in the source are presented.
+type SymlinkPolicy int
+
+const (
+	// SymlinksPreserve presents symlinks with their original target.
+	// splitfs never follows them itself: the kernel resolves them relative to
+	// the mountpoint, and bounds link loops with ELOOP.
+	SymlinksPreserve SymlinkPolicy = iota
+	// SymlinksRewrite presents symlinks whose target is inside the source
+	// with a relative target, so that absolute links keep pointing inside the
+	// mount. Symlinks pointing outside of the source are hidden.
+	SymlinksRewrite
+	// SymlinksFollow presents symlinks as the file or directory they point
+	// to, which is split like any other file. Symlinks pointing outside of
+	// the source, dangling symlinks and link loops are hidden; looking up a
+	// symlink to one of its own ancestor directories fails with ELOOP.
+	SymlinksFollow
+	// SymlinksHide hides symlinks.
+	SymlinksHide
+)
+
+// SymlinkPolicyNames are the names of the symlink policies, for use in flags.
+var SymlinkPolicyNames = []string{"preserve", "rewrite", "follow", "hide"}
+
+func (p SymlinkPolicy) String() string {
+	if p < 0 || int(p) >= len(SymlinkPolicyNames) {
+		return fmt.Sprintf("SymlinkPolicy(%d)", int(p))
+	}
+	return SymlinkPolicyNames[p]
+}
+
+// ParseSymlinkPolicy returns the symlink policy with the given name.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	for i, policyName := range SymlinkPolicyNames {
+		if name == policyName {
+			return SymlinkPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid symlink policy %q; must use one of %v", name, SymlinkPolicyNames)
+}
+
+// Symlinks sets how symbolic links in the source are presented.
+func Symlinks(policy SymlinkPolicy) Option {
+	return func(f *FS) error {
+		if policy < 0 || int(policy) >= len(SymlinkPolicyNames) {
+			return fmt.Errorf("invalid symlink policy %v", policy)
+		}
+		f.symlinks = policy
+		return nil
+	}
+}
+
+// isWithin reports whether the given absolute path is the directory itself
+// or one of its descendants.
+func isWithin(directory, p string) bool {
+	return p == directory || strings.HasPrefix(p, strings.TrimSuffix(directory, "/")+"/")
+}
+
+// rewriteSymlink returns the target that the symlink at the given
+// root-relative path should have in the mount, given its target in the
+// source. Absolute targets inside the source are made relative to the
+// symlink's directory. Targets that lead outside of the source are rejected.
+// Relative targets are only checked lexically: any symlink they traverse is
+// itself presented by the mount, and rewritten or hidden in turn.
+func (f *FS) rewriteSymlink(rootRelativePath, target string) (string, error) {
+	linkDirectory := path.Dir(rootRelativePath)
+	if !path.IsAbs(target) {
+		resolved := path.Join(linkDirectory, target)
+		if resolved == ".." || strings.HasPrefix(resolved, "../") {
+			return "", rejection("symlink escapes source")
+		}
+		return target, nil
+	}
+	target = path.Clean(target)
+	for _, source := range []string{f.sourceDirectory, f.realSourceDirectory} {
+		if !isWithin(source, target) {
+			continue
+		}
+		rewritten, err := filepath.Rel(linkDirectory, strings.TrimPrefix(strings.TrimPrefix(target, source), "/"))
+		if err != nil {
+			return "", err
+		}
+		return rewritten, nil
+	}
+	return "", rejection("symlink escapes source")
+}
+
+// readSymlink reads the target of the symlink at the given root-relative
+// path, as presented by the mount.
+func (f *FS) readSymlink(rootRelativePath string) (string, error) {
+	start := time.Now()
+	target, err := os.Readlink(path.Join(f.sourceDirectory, rootRelativePath))
+	f.metrics.syscall(syscallReadlink, start)
+	if err != nil {
+		return "", err
+	}
+	if f.symlinks == SymlinksRewrite {
+		return f.rewriteSymlink(rootRelativePath, target)
+	}
+	return target, nil
+}
+
+// followSymlink returns information about the file that the symlink at the
+// given root-relative path eventually points to. It fails if that file is
+// outside of the source, or if it is a directory that is also an ancestor of
+// the symlink in the mount, which would make the tree infinitely deep.
+func (f *FS) followSymlink(rootRelativePath string) (os.FileInfo, error) {
+	fullPath := path.Join(f.sourceDirectory, rootRelativePath)
+	start := time.Now()
+	stat, err := os.Stat(fullPath)
+	f.metrics.syscall(syscallStat, start)
+	if err != nil {
+		return nil, err
+	}
+	target, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if !isWithin(f.realSourceDirectory, target) {
+		return nil, rejection("symlink escapes source")
+	}
+	if !stat.IsDir() {
+		return stat, nil
+	}
+	// Symlinks may only lead to directories above themselves through other
+	// followed symlinks, so comparing against the real path of every
+	// ancestor catches all loops.
+	for ancestor := rootRelativePath; ancestor != ""; {
+		if ancestor = path.Dir(ancestor); ancestor == "." {
+			ancestor = ""
+		}
+		realAncestor, err := filepath.EvalSymlinks(path.Join(f.sourceDirectory, ancestor))
+		if err != nil {
+			return nil, err
+		}
+		if realAncestor == target {
+			return nil, &os.PathError{Op: "follow", Path: fullPath, Err: syscall.ELOOP}
+		}
+	}
+	return stat, nil
+}
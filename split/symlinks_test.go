@@ -0,0 +1,147 @@
+package split
+
+import (
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// symlinkSource returns a source directory with a split file, a file in a
+// subdirectory, and the given symlinks, by path.
+func symlinkSource(t *testing.T, symlinks map[string]string) string {
+	t.Helper()
+	source := t.TempDir()
+	if err := os.Mkdir(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"big.bin", "dir/small"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range symlinks {
+		if err := os.Symlink(target, filepath.Join(source, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+func TestRewriteSymlinks(t *testing.T) {
+	source := t.TempDir()
+	for _, test := range []struct {
+		name   string
+		link   string
+		target string
+		// want is the rewritten target, or empty if the symlink is rejected.
+		want string
+	}{
+		{"relative", "link", "big.bin", "big.bin"},
+		{"relative from a subdirectory", "dir/link", "../big.bin", "../big.bin"},
+		{"relative to the root", "dir/link", "..", ".."},
+		{"relative escaping from the root", "link", "..", ""},
+		{"relative escaping from a subdirectory", "dir/link", "../../etc/passwd", ""},
+		{"relative escaping and coming back", "link", "../" + filepath.Base(source) + "/big.bin", ""},
+		{"absolute in the source", "link", source + "/dir/small", "dir/small"},
+		{"absolute from a subdirectory", "dir/link", source + "/big.bin", "../big.bin"},
+		{"absolute to the root", "dir/link", source, ".."},
+		{"absolute unclean", "link", source + "/dir/../big.bin", "big.bin"},
+		{"absolute outside", "link", "/etc/passwd", ""},
+		{"absolute in a sibling with the same prefix", "link", source + "-other/big.bin", ""},
+	} {
+		f, err := NewFS(source, 4, Symlinks(SymlinksRewrite))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f.rewriteSymlink(test.link, test.target)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: %s -> %s was rewritten to %s, want it rejected", test.name, test.link, test.target, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: %s -> %s was rewritten to %q, %v, want %q", test.name, test.link, test.target, got, err, test.want)
+		}
+	}
+
+	// The view presents rewritten symlinks, and hides rejected ones.
+	source = symlinkSource(t, map[string]string{"escaping": "../outside"})
+	if err := os.Symlink(filepath.Join(source, "dir", "small"), filepath.Join(source, "dir", "inside")); err != nil {
+		t.Fatal(err)
+	}
+	view, err := NewIOFS(source, 4, Symlinks(SymlinksRewrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := view.ReadLink("dir/inside"); err != nil || target != "small" {
+		t.Errorf("ReadLink of an absolute symlink inside the source = %q, %v, want small", target, err)
+	}
+	if _, err := view.Lstat("escaping"); toErrno(err) != syscall.ENOENT {
+		t.Errorf("Lstat of an escaping symlink = %v, want ENOENT", err)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	source := symlinkSource(t, map[string]string{
+		"link":         "big.bin",
+		"dir/up":       "..",
+		"dir/self":     ".",
+		"dir/sibling":  "../dir",
+		"dangling":     "missing",
+		"outside":      "/etc",
+		"dir/to-small": "small",
+	})
+	view, err := NewIOFS(source, 4, Symlinks(SymlinksFollow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		want syscall.Errno
+		// split is whether the entry is presented as a split file.
+		split bool
+	}{
+		{"link", 0, true},
+		{"dir/to-small", 0, true},
+		{"dir/up", syscall.ELOOP, false},
+		{"dir/self", syscall.ELOOP, false},
+		{"dir/sibling", syscall.ELOOP, false},
+		{"dangling", syscall.ENOENT, false},
+		{"outside", syscall.ENOENT, false},
+	} {
+		info, err := view.Lstat(test.name)
+		if test.want != 0 {
+			if got := toErrno(err); got != test.want {
+				t.Errorf("Lstat(%q) = %v, want %v", test.name, err, test.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Lstat(%q) = %v", test.name, err)
+			continue
+		}
+		if info.Mode()&iofs.ModeSymlink != 0 {
+			t.Errorf("%s is presented as a symlink", test.name)
+		}
+		if info.IsDir() != test.split {
+			t.Errorf("%s is presented as a split file: %v, want %v", test.name, info.IsDir(), test.split)
+		}
+	}
+
+	// A followed file is split like the file it points to.
+	f := view.FS()
+	if got, want := chunkNames(t, f, "link"), chunkNames(t, f, "big.bin"); len(got) != len(want) || len(got) != 3 {
+		t.Errorf("link has chunks %v, want 3 chunks like big.bin: %v", got, want)
+	}
+	entries, err := view.ReadDir("link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := iofs.ReadFile(view, "link/"+entries[0].Name())
+	if err != nil || string(data) != "0123" {
+		t.Errorf("first chunk of link = %q, %v, want %q", data, err, "0123")
+	}
+}
@@ -0,0 +1,346 @@
+package split
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chunkNameField describes a placeholder of chunk name templates.
+type chunkNameField struct {
+	// numeric fields are rendered as decimal numbers, and may be zero-padded.
+	numeric bool
+	// variable fields differ from chunk to chunk, and are parsed from chunk
+	// names. Other fields are the same for all chunks of a file.
+	variable bool
+	// mismatch is the reason given when a chunk name has the wrong value for
+	// a field that is not variable.
+	mismatch string
+}
+
+var chunkNameFields = map[string]chunkNameField{
+	"hash":     {mismatch: "hash mismatch"},
+	"basename": {mismatch: "basename mismatch"},
+	"ext":      {mismatch: "extension mismatch"},
+	"total":    {numeric: true, mismatch: "total chunks mismatch"},
+	"mtime":    {numeric: true, mismatch: "mtime mismatch"},
+	"index":    {numeric: true, variable: true},
+	"index0":   {numeric: true, variable: true},
+	"offset":   {numeric: true, variable: true},
+	"length":   {numeric: true, variable: true},
+}
+
+// ChunkNameFields are the placeholders that chunk name templates can use.
+var ChunkNameFields = []string{"hash", "basename", "ext", "index", "index0", "total", "offset", "length", "mtime"}
+
+// chunkNamePart is either a literal or a placeholder of a template.
+type chunkNamePart struct {
+	literal string
+	field   string
+	width   int
+}
+
+// chunkNameTemplate is a parsed chunk name template.
+type chunkNameTemplate struct {
+	source string
+	parts  []chunkNamePart
+}
+
+// chunkNameValues holds the values of the placeholders for a chunk.
+type chunkNameValues struct {
+	hash      string
+	basename  string
+	total     int64
+	mtime     time.Time
+	chunk     int64
+	chunkSize int64
+	// lastChunkSize is the size of the last chunk of the file.
+	lastChunkSize int64
+}
+
+// chunkLength returns the length of the given chunk.
+func (v *chunkNameValues) chunkLength(chunk int64) int64 {
+	if chunk == v.total-1 {
+		return v.lastChunkSize
+	}
+	return v.chunkSize
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{([a-z0-9]+)(?::([0-9]+))?\}`)
+
+// parseChunkNameTemplate parses a chunk name template. It refuses templates
+// that do not tell chunks apart, or whose chunk names cannot be parsed back
+// without ambiguity: a template must contain {index}, {index0} or {offset},
+// and two placeholders that vary from chunk to chunk must be separated by
+// literal text that is not only made of digits.
+func parseChunkNameTemplate(template string) (*chunkNameTemplate, error) {
+	t := &chunkNameTemplate{source: template}
+	addLiteral := func(literal string) error {
+		if strings.ContainsAny(literal, "{}/\x00") {
+			return fmt.Errorf("chunk name template %q: invalid character in %q", template, literal)
+		}
+		if literal != "" {
+			t.parts = append(t.parts, chunkNamePart{literal: literal})
+		}
+		return nil
+	}
+	end := 0
+	identifiesChunk := false
+	separated := true
+	for _, match := range placeholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		literal := template[end:match[0]]
+		if err := addLiteral(literal); err != nil {
+			return nil, err
+		}
+		if strings.TrimLeft(literal, "0123456789") != "" {
+			separated = true
+		}
+		end = match[1]
+		name := template[match[2]:match[3]]
+		field, ok := chunkNameFields[name]
+		if !ok {
+			return nil, fmt.Errorf("chunk name template %q: unknown placeholder {%s}; must use one of %v", template, name, ChunkNameFields)
+		}
+		part := chunkNamePart{field: name}
+		if match[4] != -1 {
+			if !field.numeric {
+				return nil, fmt.Errorf("chunk name template %q: {%s} cannot have a width", template, name)
+			}
+			part.width, _ = strconv.Atoi(template[match[4]:match[5]])
+		}
+		if field.variable {
+			if !separated {
+				return nil, fmt.Errorf("chunk name template %q: {%s} must be separated from the previous placeholder that varies by chunk by a literal that is not only digits", template, name)
+			}
+			separated = false
+			identifiesChunk = identifiesChunk || name != "length"
+		}
+		t.parts = append(t.parts, part)
+	}
+	if err := addLiteral(template[end:]); err != nil {
+		return nil, err
+	}
+	if !identifiesChunk {
+		return nil, fmt.Errorf("chunk name template %q: must contain {index}, {index0} or {offset}", template)
+	}
+	return t, nil
+}
+
+// mustParseChunkNameTemplate is like parseChunkNameTemplate, but panics on error.
+func mustParseChunkNameTemplate(template string) *chunkNameTemplate {
+	t, err := parseChunkNameTemplate(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// DefaultChunkNameTemplate returns the chunk name template used when none is
+// specified, depending on FilenameIncludesTotalChunks and FilenameIncludesMtime.
+func DefaultChunkNameTemplate(includesTotalChunks, includesMtime bool) string {
+	template := fmt.Sprintf("{hash}_{index:%d}", minFormatZeroes)
+	if includesTotalChunks {
+		template += fmt.Sprintf("_of_{total:%d}", minFormatZeroes)
+	}
+	if includesMtime {
+		template += ".mtime={mtime}"
+	}
+	return template + chunkFileExtension
+}
+
+// defaultChunkNameTemplates are the default templates, indexed by whether
+// they include total chunks and mtimes.
+var defaultChunkNameTemplates = map[[2]bool]*chunkNameTemplate{}
+
+func init() {
+	for _, includesTotalChunks := range []bool{false, true} {
+		for _, includesMtime := range []bool{false, true} {
+			defaultChunkNameTemplates[[2]bool{includesTotalChunks, includesMtime}] = mustParseChunkNameTemplate(DefaultChunkNameTemplate(includesTotalChunks, includesMtime))
+		}
+	}
+}
+
+// ChunkNameTemplate sets the template that chunk names are rendered from.
+// Placeholders are written as {name}, or {name:width} for numbers to be
+// zero-padded to the given width:
+//
+//	{hash}      the filename hash (see FilenameHashFunc)
+//	{basename}  the name of the file
+//	{ext}       the extension of the file, including its leading dot
+//	{index}     the 1-based index of the chunk
+//	{index0}    the 0-based index of the chunk
+//	{total}     the total number of chunks of the file
+//	{offset}    the offset of the chunk in the file, in bytes
+//	{length}    the length of the chunk, in bytes
+//	{mtime}     the mtime of the file, in seconds since the epoch
+//
+// It overrides FilenameIncludesTotalChunks and FilenameIncludesMtime.
+func ChunkNameTemplate(template string) Option {
+	return func(f *FS) error {
+		t, err := parseChunkNameTemplate(template)
+		if err != nil {
+			return err
+		}
+		f.chunkNameTemplate = t
+		return nil
+	}
+}
+
+// template returns the chunk name template in effect.
+func (s *settings) template() *chunkNameTemplate {
+	if s.chunkNameTemplate != nil {
+		return s.chunkNameTemplate
+	}
+	return defaultChunkNameTemplates[[2]bool{s.filenameIncludesTotalChunks, s.filenameIncludesMtime}]
+}
+
+// render returns the text of a placeholder for the given chunk.
+func (p *chunkNamePart) render(v *chunkNameValues, chunk int64) string {
+	var number int64
+	switch p.field {
+	case "":
+		return p.literal
+	case "hash":
+		return v.hash
+	case "basename":
+		return v.basename
+	case "ext":
+		return filepath.Ext(v.basename)
+	case "index":
+		number = chunk + 1
+	case "index0":
+		number = chunk
+	case "total":
+		number = v.total
+	case "offset":
+		number = chunk * v.chunkSize
+	case "length":
+		number = v.chunkLength(chunk)
+	case "mtime":
+		number = v.mtime.Unix()
+	}
+	return fmt.Sprintf("%0*d", p.width, number)
+}
+
+// render returns the name of the given chunk.
+func (t *chunkNameTemplate) render(v *chunkNameValues, chunk int64) string {
+	var name strings.Builder
+	for i := range t.parts {
+		name.WriteString(t.parts[i].render(v, chunk))
+	}
+	return name.String()
+}
+
+// leadingDigits returns the number of digits at the start of s.
+func leadingDigits(s string) int {
+	return len(s) - len(strings.TrimLeft(s, "0123456789"))
+}
+
+// parse returns the chunk that the given name refers to. The values that do
+// not vary from chunk to chunk must be set in v.
+func (t *chunkNameTemplate) parse(name string, v *chunkNameValues) (int64, error) {
+	if last := t.parts[len(t.parts)-1]; last.field == "" && !strings.HasSuffix(name, last.literal) {
+		if strings.HasSuffix(last.literal, chunkFileExtension) && !strings.HasSuffix(name, chunkFileExtension) {
+			return 0, rejection("missing chunk file extension")
+		}
+		return 0, rejection("malformed chunk name")
+	}
+	rest := name
+	chunk := int64(-1)
+	var lengths []int64
+	for i, part := range t.parts {
+		field := chunkNameFields[part.field]
+		if !field.variable {
+			text := part.render(v, 0)
+			if !strings.HasPrefix(rest, text) {
+				if part.field == "" {
+					return 0, rejection("malformed chunk name")
+				}
+				return 0, rejection(field.mismatch)
+			}
+			rest = rest[len(text):]
+			continue
+		}
+		// The digits of the fixed text that follows, up to the next variable
+		// placeholder, are not part of this placeholder.
+		var following strings.Builder
+		for _, next := range t.parts[i+1:] {
+			if chunkNameFields[next.field].variable {
+				break
+			}
+			following.WriteString(next.render(v, 0))
+		}
+		digits := leadingDigits(rest) - leadingDigits(following.String())
+		if digits <= 0 {
+			return 0, rejection("malformed chunk index")
+		}
+		number, err := strconv.ParseInt(rest[:digits], 10, 64)
+		if err != nil {
+			return 0, rejection("malformed chunk index")
+		}
+		rest = rest[digits:]
+		var c int64
+		switch part.field {
+		case "index":
+			c = number - 1
+		case "index0":
+			c = number
+		case "offset":
+			if number%v.chunkSize != 0 {
+				return 0, rejection("malformed chunk offset")
+			}
+			c = number / v.chunkSize
+		case "length":
+			lengths = append(lengths, number)
+			continue
+		}
+		if c < 0 || (chunk != -1 && c != chunk) {
+			return 0, rejection("malformed chunk index")
+		}
+		chunk = c
+	}
+	if rest != "" {
+		return 0, rejection("malformed chunk name")
+	}
+	if chunk >= v.total {
+		return chunk, rejection("chunk index out of range")
+	}
+	for _, length := range lengths {
+		if length != v.chunkLength(chunk) {
+			return chunk, rejection("chunk length mismatch")
+		}
+	}
+	if t.render(v, chunk) != name {
+		return chunk, rejection("non-canonical chunk name")
+	}
+	return chunk, nil
+}
+
+// hashRegexp returns a regexp that matches chunk names rendered from the
+// template, and captures their hash.
+func (t *chunkNameTemplate) hashRegexp() (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	hasHash := false
+	for _, part := range t.parts {
+		switch {
+		case part.field == "":
+			expr.WriteString(regexp.QuoteMeta(part.literal))
+		case part.field == "hash":
+			expr.WriteString(`([0-9A-Za-z+-]+)`)
+			hasHash = true
+		case chunkNameFields[part.field].numeric:
+			expr.WriteString(`[0-9]+`)
+		default:
+			expr.WriteString(`.*`)
+		}
+	}
+	expr.WriteString("$")
+	if !hasHash {
+		return nil, fmt.Errorf("chunk name template %q does not contain {hash}", t.source)
+	}
+	return regexp.MustCompile(expr.String()), nil
+}
@@ -0,0 +1,140 @@
+package split
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChunkNameTemplateRefusals(t *testing.T) {
+	for _, test := range []struct {
+		template string
+		want     string
+	}{
+		{"{hash}.chunk", "must contain {index}, {index0} or {offset}"},
+		{"{hash}_{length}", "must contain {index}, {index0} or {offset}"},
+		{"{hash}_{index}{offset}", "must be separated"},
+		{"{hash}_{index}12{length}", "must be separated"},
+		{"{hash}_{nope}", "unknown placeholder {nope}"},
+		{"{hash:8}_{index}", "{hash} cannot have a width"},
+		{"{basename:3}_{index}", "{basename} cannot have a width"},
+		{"{hash}/{index}", "invalid character"},
+		{"{hash}_{index}}", "invalid character"},
+		{"{{hash}_{index}", "invalid character"},
+		{"{hash}_{index}\x00", "invalid character"},
+	} {
+		_, err := parseChunkNameTemplate(test.template)
+		if err == nil {
+			t.Errorf("parseChunkNameTemplate(%q) succeeded", test.template)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseChunkNameTemplate(%q) = %v, want an error about %q", test.template, err, test.want)
+		}
+	}
+}
+
+func TestChunkNameTemplateRoundTrip(t *testing.T) {
+	values := &chunkNameValues{
+		hash:          "ABCDEF234567",
+		basename:      "movie.2018.mkv",
+		total:         12,
+		mtime:         time.Unix(1530403200, 0),
+		chunkSize:     1000,
+		lastChunkSize: 500,
+	}
+	for _, template := range []string{
+		DefaultChunkNameTemplate(false, false),
+		DefaultChunkNameTemplate(true, false),
+		DefaultChunkNameTemplate(false, true),
+		DefaultChunkNameTemplate(true, true),
+		"{index}",
+		"{hash}{index0:3}",
+		"{basename}.part{index:2}of{total}",
+		"{hash}-{offset}-{length}{ext}",
+		"{offset:12}x{index}x{length}",
+		"{index}1a{index0}",
+		"{mtime}_{index}_{hash}",
+	} {
+		parsed, err := parseChunkNameTemplate(template)
+		if err != nil {
+			t.Errorf("parseChunkNameTemplate(%q) = %v", template, err)
+			continue
+		}
+		names := make(map[string]bool)
+		for chunk := int64(0); chunk < values.total; chunk++ {
+			name := parsed.render(values, chunk)
+			if names[name] {
+				t.Errorf("template %q renders %q for two chunks", template, name)
+			}
+			names[name] = true
+			got, err := parsed.parse(name, values)
+			if err != nil || got != chunk {
+				t.Errorf("template %q: parse(%q) = %d, %v, want %d", template, name, got, err, chunk)
+			}
+		}
+	}
+}
+
+func TestChunkNameTemplateParseRejections(t *testing.T) {
+	values := &chunkNameValues{hash: "HASH", basename: "file", total: 3, chunkSize: 10, lastChunkSize: 5}
+	parsed, err := parseChunkNameTemplate("{hash}_{index:2}_{offset}_{length}.chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"HASH_01_0_10.chunk", ""},
+		{"HASH_03_20_5.chunk", ""},
+		{"OTHER_01_0_10.chunk", "hash mismatch"},
+		{"HASH_01_0_10", "malformed chunk name"},
+		{"HASH_1_0_10.chunk", "non-canonical chunk name"},
+		{"HASH_02_0_10.chunk", "malformed chunk index"},
+		{"HASH_01_5_10.chunk", "malformed chunk offset"},
+		{"HASH_04_30_10.chunk", "chunk index out of range"},
+		{"HASH_03_20_10.chunk", "chunk length mismatch"},
+		{"HASH_xx_0_10.chunk", "malformed chunk index"},
+	} {
+		_, err := parsed.parse(test.name, values)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("parse(%q) = %v", test.name, err)
+		case test.want != "" && (err == nil || err.Error() != test.want):
+			t.Errorf("parse(%q) = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestChunkNameTemplateHashRegexp(t *testing.T) {
+	values := &chunkNameValues{hash: "Ab3-+z", basename: "a.b", total: 2, mtime: time.Unix(42, 0), chunkSize: 10, lastChunkSize: 10}
+	for _, template := range []string{
+		DefaultChunkNameTemplate(true, true),
+		"{basename}.{hash}.{index}{ext}",
+		"{index:3}-{hash}",
+	} {
+		parsed, err := parseChunkNameTemplate(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashRegexp, err := parsed.hashRegexp()
+		if err != nil {
+			t.Errorf("template %q: hashRegexp() = %v", template, err)
+			continue
+		}
+		name := parsed.render(values, 1)
+		match := hashRegexp.FindStringSubmatch(name)
+		if match == nil || match[1] != values.hash {
+			t.Errorf("template %q: %v captured %q from %q, want %q", template, hashRegexp, match, name, values.hash)
+		}
+		if hashRegexp.MatchString("README") {
+			t.Errorf("template %q: %v matches README", template, hashRegexp)
+		}
+	}
+	parsed, err := parseChunkNameTemplate("{basename}_{index}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.hashRegexp(); err == nil {
+		t.Error("hashRegexp of a template without {hash} succeeded")
+	}
+}
@@ -0,0 +1,409 @@
+package split
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The interfaces below are implemented by the nodes of the filesystem, and
+// by the handles of opened files. Nodes only implement those that apply to
+// them.
+type (
+	fsNode interface {
+		Attr(ctx context.Context, attr *Attr) error
+	}
+	nodeLookuper interface {
+		Lookup(ctx context.Context, name string) (fsNode, error)
+	}
+	nodeReadDirAller interface {
+		ReadDirAll(ctx context.Context) ([]dirent, error)
+	}
+	nodeDirOpener interface {
+		openDir(ctx context.Context) (dirStream, error)
+	}
+	nodeReadlinker interface {
+		Readlink(ctx context.Context) (string, error)
+	}
+	nodeOpener interface {
+		Open(ctx context.Context, write bool) (fileHandle, error)
+	}
+
+	// fileHandle is an opened file, which implements some of the handle
+	// interfaces.
+	fileHandle interface{}
+	// handleReader reads the content of a file a range at a time.
+	handleReader interface {
+		Read(ctx context.Context, p []byte, offset int64) (int, error)
+	}
+	// handleReadAller returns the whole content of a file at once.
+	handleReadAller interface {
+		ReadAll(ctx context.Context) ([]byte, error)
+	}
+	handleWriter interface {
+		Write(ctx context.Context, data []byte) error
+	}
+	handleReleaser interface {
+		Release(ctx context.Context) error
+	}
+)
+
+// dataHandle is a handle whose content is known when it is opened.
+type dataHandle []byte
+
+var _ handleReadAller = dataHandle(nil)
+
+func (h dataHandle) ReadAll(context.Context) ([]byte, error) {
+	return h, nil
+}
+
+// The functions below give access to the nodes of the filesystem by path.
+
+// cleanPath returns the root-relative path for a slash-separated path,
+// which may be absolute, and may not go above the root.
+func cleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// parentPath returns the root-relative path of the parent directory of the
+// given root-relative path.
+func parentPath(rootRelativePath string) string {
+	if parent := path.Dir(rootRelativePath); parent != "." {
+		return parent
+	}
+	return ""
+}
+
+// maxSymlinks is the maximum number of symlinks followed when resolving a
+// path.
+const maxSymlinks = 40
+
+// pathError converts an error returned by nodes into an *os.PathError whose
+// underlying error is an errno, so that errors.Is works with it.
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: toErrno(err)}
+}
+
+// lookupPath looks up the node at the given root-relative path, one
+// component at a time.
+func (f *FS) lookupPath(ctx context.Context, rootRelativePath string) (fsNode, error) {
+	var n fsNode = f.root()
+	if rootRelativePath == "" || rootRelativePath == "." {
+		return n, nil
+	}
+	for _, name := range strings.Split(rootRelativePath, "/") {
+		lookuper, ok := n.(nodeLookuper)
+		if !ok {
+			return nil, syscall.ENOTDIR
+		}
+		var err error
+		if n, err = lookuper.Lookup(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// nodeInfo describes a node as an os.FileInfo.
+type nodeInfo struct {
+	name string
+	attr Attr
+	node fsNode
+}
+
+var _ os.FileInfo = (*nodeInfo)(nil)
+
+func (i *nodeInfo) Name() string       { return i.name }
+func (i *nodeInfo) Size() int64        { return int64(i.attr.Size) }
+func (i *nodeInfo) Mode() os.FileMode  { return i.attr.Mode }
+func (i *nodeInfo) ModTime() time.Time { return i.attr.Mtime }
+func (i *nodeInfo) IsDir() bool        { return i.attr.Mode.IsDir() }
+func (i *nodeInfo) Sys() interface{}   { return &i.attr }
+
+// UnixMode returns the mode of a file as in struct stat, for the servers of
+// protocols that use it.
+func UnixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		m |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		m |= syscall.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	default:
+		m |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+// statNode returns information about the node, which has the given name in
+// its parent directory.
+func statNode(ctx context.Context, name string, n fsNode) (*nodeInfo, error) {
+	info := &nodeInfo{name: name, node: n}
+	if err := n.Attr(ctx, &info.attr); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// resolve returns information about the node at the given path, relative
+// to the given directory, whose root-relative path is dirPath, following
+// the symlinks on the way, and the node itself if it is a symlink and asked
+// to. Symlinks are followed within the filesystem only: those pointing
+// outside of it, or to an absolute path, are dangling. It counts the
+// symlinks followed, and also returns the root-relative path of the node,
+// once symlinks are followed.
+func (f *FS) resolve(ctx context.Context, dir fsNode, dirPath, relativePath string, follow bool, links *int) (*nodeInfo, string, error) {
+	if relativePath == "" {
+		info, err := statNode(ctx, path.Base("/"+dirPath), dir)
+		return info, dirPath, err
+	}
+	// The directory is not stat'ed: it is one as long as it can be looked
+	// up in.
+	info := &nodeInfo{node: dir, attr: Attr{Mode: os.ModeDir}}
+	names := strings.Split(relativePath, "/")
+	directory := dirPath
+	for i, name := range names {
+		child, err := lookupChild(ctx, info, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if child.attr.Mode&os.ModeSymlink == 0 || (i == len(names)-1 && !follow) {
+			directory, info = path.Join(directory, name), child
+			continue
+		}
+		if *links++; *links > maxSymlinks {
+			return nil, "", syscall.ELOOP
+		}
+		target, err := readlink(ctx, child)
+		if err != nil {
+			return nil, "", err
+		}
+		if path.IsAbs(target) {
+			return nil, "", syscall.ENOENT
+		}
+		target = path.Join(directory, target)
+		if target == ".." || strings.HasPrefix(target, "../") {
+			return nil, "", syscall.ENOENT
+		}
+		if info, directory, err = f.resolve(ctx, f.root(), "", cleanPath(target), true, links); err != nil {
+			return nil, "", err
+		}
+		// The node keeps the name of the symlink, as with stat(2).
+		resolved := *info
+		resolved.name = name
+		info = &resolved
+	}
+	return info, directory, nil
+}
+
+// lookupChild returns information about the entry of the given directory
+// with the given name.
+func lookupChild(ctx context.Context, dir *nodeInfo, name string) (*nodeInfo, error) {
+	lookuper, ok := dir.node.(nodeLookuper)
+	if !ok || !dir.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	n, err := lookuper.Lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return statNode(ctx, name, n)
+}
+
+// modeDirentType returns the type of directory entries with the given mode,
+// as in struct dirent.
+func modeDirentType(mode os.FileMode) uint8 {
+	switch {
+	case mode.IsDir():
+		return syscall.DT_DIR
+	case mode.IsRegular():
+		return syscall.DT_REG
+	case mode&os.ModeSymlink != 0:
+		return syscall.DT_LNK
+	case mode&os.ModeSocket != 0:
+		return syscall.DT_SOCK
+	case mode&os.ModeCharDevice != 0:
+		return syscall.DT_CHR
+	case mode&os.ModeDevice != 0:
+		return syscall.DT_BLK
+	case mode&os.ModeNamedPipe != 0:
+		return syscall.DT_FIFO
+	}
+	return syscall.DT_UNKNOWN
+}
+
+// readlink returns the target of the symlink node, or "" if the node is not
+// a symlink.
+func readlink(ctx context.Context, info *nodeInfo) (string, error) {
+	readlinker, ok := info.node.(nodeReadlinker)
+	if !ok || info.attr.Mode&os.ModeSymlink == 0 {
+		return "", nil
+	}
+	return readlinker.Readlink(ctx)
+}
+
+// nodeReader reads the content of a node that was opened for reading, or
+// writes to one that was opened for writing.
+type nodeReader struct {
+	ctx    context.Context
+	handle fileHandle
+	// data is the whole content of handles that are read all at once.
+	data   []byte
+	size   int64
+	offset int64
+}
+
+var _ io.ReadSeeker = (*nodeReader)(nil)
+var _ io.ReaderAt = (*nodeReader)(nil)
+
+// openNode opens the given node for reading, or for writing if asked to.
+func openNode(ctx context.Context, n fsNode, write bool) (*nodeReader, error) {
+	attr := Attr{}
+	if err := n.Attr(ctx, &attr); err != nil {
+		return nil, err
+	}
+	switch {
+	case attr.Mode.IsDir():
+		return nil, syscall.EISDIR
+	case isSpecial(attr.Mode):
+		return nil, syscall.ENXIO
+	case !attr.Mode.IsRegular():
+		return nil, syscall.EACCES
+	}
+	var handle fileHandle = n
+	if opener, ok := n.(nodeOpener); ok {
+		var err error
+		if handle, err = opener.Open(ctx, write); err != nil {
+			return nil, err
+		}
+	} else if write {
+		return nil, syscall.EROFS
+	}
+	r := &nodeReader{ctx: ctx, handle: handle, size: int64(attr.Size)}
+	if write {
+		if _, ok := handle.(handleWriter); !ok {
+			r.Close()
+			return nil, syscall.EROFS
+		}
+		return r, nil
+	}
+	if readAller, ok := handle.(handleReadAller); ok {
+		data, err := readAller.ReadAll(ctx)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		r.data, r.size = data, int64(len(data))
+	} else if _, ok := handle.(handleReader); !ok {
+		r.Close()
+		return nil, syscall.EACCES
+	}
+	return r, nil
+}
+
+func (r *nodeReader) ReadAt(p []byte, offset int64) (int, error) {
+	reader, ok := r.handle.(handleReader)
+	if r.data == nil && !ok {
+		return 0, syscall.EBADF
+	}
+	if offset >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-offset {
+		p = p[:r.size-offset]
+	}
+	read := 0
+	if r.data != nil {
+		read = copy(p, r.data[offset:])
+	}
+	for read < len(p) && r.data == nil {
+		n, err := reader.Read(r.ctx, p[read:], offset+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if offset+int64(read) >= r.size {
+		return read, io.EOF
+	}
+	if read < len(p) {
+		return read, io.ErrUnexpectedEOF
+	}
+	return read, nil
+}
+
+func (r *nodeReader) Read(p []byte) (int, error) {
+	read, err := r.ReadAt(p, r.offset)
+	r.offset += int64(read)
+	if err == io.EOF && read > 0 {
+		err = nil
+	}
+	return read, err
+}
+
+// Write writes to a node that was opened for writing. Nodes take writes as
+// a whole, such as commands, rather than at an offset.
+func (r *nodeReader) Write(p []byte) (int, error) {
+	writer, ok := r.handle.(handleWriter)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	if err := writer.Write(r.ctx, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *nodeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Size returns the size of the content of the node.
+func (r *nodeReader) Size() int64 {
+	return r.size
+}
+
+func (r *nodeReader) Close() error {
+	if releaser, ok := r.handle.(handleReleaser); ok {
+		return releaser.Release(r.ctx)
+	}
+	return nil
+}
@@ -8,14 +8,19 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"perot.me/splitfs/fusefs"
 	"perot.me/splitfs/hashes"
+	"perot.me/splitfs/httpfs"
 	"perot.me/splitfs/split"
+	"perot.me/splitfs/webdavfs"
 )
 
 var progName = filepath.Base(os.Args[0])
@@ -23,6 +28,13 @@ var progName = filepath.Base(os.Args[0])
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", progName)
 	fmt.Fprintf(os.Stderr, "  %s [options] <source directory> <target mountpoint>\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [options] --config=<file> [<source directory> <target mountpoint>]\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [options] --serve_http=<host:port> <source directory>\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [options] --serve_webdav=<host:port> <source directory>\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [options] --serve_s3=<host:port> <bucket>=<source directory>...\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [options] --serve_sftp=<host:port> --sftp_host_key=<file> --sftp_authorized_keys=<file> <source directory>\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s [options] --serve_9p=<host:port|unix:path> <source directory>\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s --decrypt_chunk_names --filename_hash=%s --filename_hash_key_file=<file> <chunk file>...\n", progName, hashes.EncryptedName)
 	flag.PrintDefaults()
 }
 
@@ -50,59 +62,250 @@ func parseChunkSize(chunkSize string) (int64, error) {
 	return 0, errors.New("no unit specified")
 }
 
+// mountedFS is a filesystem that is mounted and being served.
+type mountedFS struct {
+	*mountDefinition
+	conn    *fuse.Conn
+	splitFS *split.FS
+	// done is closed once the filesystem stops being served, at which point
+	// err holds the result of serving it.
+	done chan struct{}
+	err  error
+}
+
+// startMount mounts a filesystem and starts serving it.
+// It returns once the mount is ready. reload is called when a reload is
+// requested from the mount's control directory. accessLog may be nil.
+func startMount(mount *mountDefinition, reload func() error, accessLog *accessLog) (*mountedFS, error) {
+	chunkSize, options, err := mount.options.splitOptions()
+	if err != nil {
+		return nil, err
+	}
+	if accessLog != nil {
+		options = append(options, split.AccessLog(accessLog.forMount(mount.mountpoint)))
+	}
+	if mount.options.controlDir {
+		options = append(options, split.ControlDirectory(split.ControlHooks{
+			Config: mount.configJSON,
+			Reload: reload,
+		}))
+	}
+	splitFS, err := split.NewFS(mount.source, chunkSize, options...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize filesystem: %v", err)
+	}
+	fuseOptions, err := mount.options.fuseMountOptions(chunkSize, mount.source)
+	if err != nil {
+		return nil, err
+	}
+	fuseConn, err := fuse.Mount(mount.mountpoint, fuseOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot mount a filesystem at %q: %v", mount.mountpoint, err)
+	}
+	m := &mountedFS{
+		mountDefinition: mount,
+		conn:            fuseConn,
+		splitFS:         splitFS,
+		done:            make(chan struct{}),
+	}
+	go func() {
+		m.err = fusefs.Serve(splitFS, fuseConn)
+		fuseConn.Close()
+		close(m.done)
+	}()
+	<-fuseConn.Ready
+	if err := fuseConn.MountError; err != nil {
+		fuseConn.Close()
+		return nil, fmt.Errorf("mount error: %v", err)
+	}
+	return m, nil
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix(fmt.Sprintf("%s: ", progName))
 	flag.Usage = usage
-	chunkSizeFlag := flag.String("chunk_size", "32MiB", "Chunk size. Available units: B, KiB, MiB, GiB, TiB.")
-	excludeRegexpFlag := flag.String("exclude_regexp", "", "If specified, files with paths matching this regex (rooted at the source directory) will be reflected as plain, non-split files in the mountpoint. The regex is not full-match; use ^ and $ to make it so.")
-	filenameHashFlag := flag.String("filename_hash", "sha256-b32", fmt.Sprintf("Algorithm for filename hashes in chunked filenames. Options: %v", hashes.HashNames))
-	filenameIncludesTotalChunksFlag := flag.Bool("filename_includes_total_chunks", true, "Whether or not chunk filenames will contain the total number of chunks of the overall file.")
-	filenameIncludesMtimeFlag := flag.Bool("filename_includes_mtime", false, "Controls whether or not chunk filenames will contain the mtime of the overall file.")
+	configFlag := flag.String("config", "", "If specified, read options and mount definitions from this JSON file. Flags given on the command line override values from the file.")
 	pprofHostPortFlag := flag.String("pprof_host_port", "", "If specified, bind to this 'host:port'-formatted string and export pprof HTTP handlers on it. Useful for debugging.")
-	flag.Parse()
-	if flag.NArg() != 2 {
+	metricsHostPortFlag := flag.String("metrics_host_port", "", "If specified, bind to this 'host:port'-formatted string and export metrics in the Prometheus format on /metrics. May be the same as --pprof_host_port.")
+	foregroundFlag := flag.Bool("foreground", true, "Whether to stay in the foreground. If false, go into the background once all mounts are ready. Defaults to false when invoked as a mount(8) helper.")
+	pidfileFlag := flag.String("pidfile", "", "If specified, write the process ID to this file once all mounts are ready.")
+	shutdownTimeoutFlag := flag.Duration("shutdown_timeout", 10*time.Second, "On SIGINT or SIGTERM, how long to wait for open files to be closed before forcibly detaching the mounts.")
+	flag.Var(&currentLogLevel, "log_level", fmt.Sprintf("Log verbosity. Options: %v", logLevelNames))
+	accessLogFlag := flag.String("access_log", "", "If specified, log FUSE operations to this file as JSON lines. Use '-' for standard error. The file is reopened on SIGHUP, so that it can be rotated.")
+	flag.Var(&currentAccessLogLevel, "access_log_level", fmt.Sprintf("Access log verbosity: 'error' logs failed operations, 'info' adds Open and Release, 'debug' logs everything. Options: %v", logLevelNames))
+	decryptChunkNamesFlag := flag.Bool("decrypt_chunk_names", false, fmt.Sprintf("Instead of mounting, print the source path of each chunk file given as argument, for chunk files named with --filename_hash=%s.", hashes.EncryptedName))
+	serveHTTPFlag := flag.String("serve_http", "", "If specified, instead of mounting, serve the chunked view of the source directory over HTTP on this 'host:port'-formatted string, read-only, with JSON directory listings.")
+	serveWebDAVFlag := flag.String("serve_webdav", "", "If specified, instead of mounting, serve the chunked view of the source directory over WebDAV on this 'host:port'-formatted string, read-only.")
+	serveS3Flag := flag.String("serve_s3", "", "If specified, instead of mounting, serve the chunked view of source directories as the buckets of a read-only S3-compatible API on this 'host:port'-formatted string. Buckets are given as '<bucket>=<source directory>' arguments.")
+	serveSFTPFlag := flag.String("serve_sftp", "", "If specified, instead of mounting, serve the chunked view of the source directory over SFTP, read-only, with an SSH server listening on this 'host:port'-formatted string.")
+	sftpHostKeyFlag := flag.String("sftp_host_key", "", "Private key file that the SSH server of --serve_sftp identifies itself with, for example created with 'ssh-keygen -t ed25519 -N \"\" -f host_key'.")
+	sftpAuthorizedKeysFlag := flag.String("sftp_authorized_keys", "", "File listing the public keys allowed to connect to the SSH server of --serve_sftp, in the format of OpenSSH's authorized_keys files.")
+	serve9PFlag := flag.String("serve_9p", "", "If specified, instead of mounting, serve the chunked view of the source directory over 9P2000.L, read-only, on this 'host:port'-formatted string, or on the Unix socket at the path following 'unix:'.")
+	commandLineOptions := &mountOptions{}
+	commandLineOptions.register(flag.CommandLine)
+	mountHelper := isMountHelper(os.Args[1:])
+	if mountHelper {
+		*foregroundFlag = false
+		parseMountHelperArgs()
+	} else {
+		flag.Parse()
+	}
+	if *decryptChunkNamesFlag {
+		if err := decryptChunkNames(commandLineOptions, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *serveS3Flag != "" {
+		if flag.NArg() == 0 {
+			usage()
+			os.Exit(2)
+		}
+		if err := serveS3(commandLineOptions, flag.Args(), *serveS3Flag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *serveSFTPFlag != "" {
+		if flag.NArg() != 1 {
+			usage()
+			os.Exit(2)
+		}
+		if err := serveSFTP(commandLineOptions, flag.Arg(0), *serveSFTPFlag, *sftpHostKeyFlag, *sftpAuthorizedKeysFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *serve9PFlag != "" {
+		if flag.NArg() != 1 {
+			usage()
+			os.Exit(2)
+		}
+		if err := serve9P(commandLineOptions, flag.Arg(0), *serve9PFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, server := range []struct {
+		hostPort string
+		protocol string
+		handler  func(*split.IOFS) http.Handler
+	}{
+		{*serveHTTPFlag, "HTTP", httpfs.Handler},
+		{*serveWebDAVFlag, "WebDAV", webdavfs.Handler},
+	} {
+		if server.hostPort == "" {
+			continue
+		}
+		if flag.NArg() != 1 {
+			usage()
+			os.Exit(2)
+		}
+		if err := serveHTTP(commandLineOptions, flag.Arg(0), server.hostPort, server.protocol, server.handler); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() != 0 && flag.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+	if *configFlag == "" && flag.NArg() != 2 {
 		usage()
 		os.Exit(2)
 	}
-	sourceDirectory := flag.Arg(0)
-	targetMountpoint := flag.Arg(1)
+	commandLine := commandLineFlags()
+	mounts, err := loadMounts(*configFlag, flag.Args(), commandLine)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	ready := func(error) {}
+	if !*foregroundFlag {
+		ready = daemonize()
+	}
 	if *pprofHostPortFlag != "" {
 		go http.ListenAndServe(*pprofHostPortFlag, http.DefaultServeMux)
 	}
-	chunkSize, err := parseChunkSize(*chunkSizeFlag)
-	if err != nil {
-		log.Fatalf("Invalid chunk size %q: %v", *chunkSizeFlag, err)
+	var accessLog *accessLog
+	if *accessLogFlag != "" {
+		if accessLog, err = openAccessLog(*accessLogFlag); err != nil {
+			err = fmt.Errorf("cannot open access log: %v", err)
+			ready(err)
+			log.Fatal(err)
+		}
 	}
-	hashFunc := hashes.GetHashFunc(*filenameHashFlag)
-	if hashFunc == nil {
-		log.Fatalf("Invalid hash function %q; must use one of %v", *filenameHashFlag, hashes.HashNames)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	reloader := &reloader{
+		configPath:  *configFlag,
+		args:        flag.Args(),
+		commandLine: commandLine,
 	}
-	var options []split.Option
-	if *excludeRegexpFlag != "" {
-		options = append(options, split.ExcludeRegexp(*excludeRegexpFlag))
+	var mounted []*mountedFS
+	for _, mount := range mounts {
+		m, err := startMount(mount, reloader.reload, accessLog)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", mount.mountpoint, err)
+			unmountAll(mounted, 0)
+			ready(err)
+			log.Fatal(err)
+		}
+		mounted = append(mounted, m)
 	}
-	options = append(options, split.FilenameHashFunc(hashFunc))
-	options = append(options, split.FilenameIncludesTotalChunks(*filenameIncludesTotalChunksFlag))
-	options = append(options, split.FilenameIncludesMtime(*filenameIncludesMtimeFlag))
-	splitFS, err := split.NewFS(sourceDirectory, int64(chunkSize), options...)
-	if err != nil {
-		log.Fatalf("Cannot initialize filesystem: %v", err)
+	reloader.setMounted(mounted)
+	if *metricsHostPortFlag != "" {
+		if err := serveMetrics(*metricsHostPortFlag, *pprofHostPortFlag, mounted); err != nil {
+			err = fmt.Errorf("cannot export metrics: %v", err)
+			unmountAll(mounted, 0)
+			ready(err)
+			log.Fatal(err)
+		}
 	}
-	fuseConn, err := fuse.Mount(
-		targetMountpoint,
-		fuse.FSName("splitfs"),
-		fuse.LocalVolume(),
-		fuse.VolumeName(fmt.Sprintf("splitfs %d %s", chunkSize, filepath.Base(sourceDirectory))))
-	if err != nil {
-		log.Fatalf("Cannot mount a filesystem at %q: %v", targetMountpoint, err)
+	if *pidfileFlag != "" {
+		if err := writePidfile(*pidfileFlag); err != nil {
+			err = fmt.Errorf("cannot write pidfile: %v", err)
+			unmountAll(mounted, 0)
+			ready(err)
+			log.Fatal(err)
+		}
+		defer os.Remove(*pidfileFlag)
 	}
-	defer fuseConn.Close()
-	if err = fs.Serve(fuseConn, splitFS); err != nil {
-		log.Fatalf("Cannot serve filesystem: %v", err)
+	ready(nil)
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Cannot notify service manager: %v", err)
 	}
-	<-fuseConn.Ready
-	if err := fuseConn.MountError; err != nil {
-		log.Fatal("Mount error: %v", err)
+	allDone := make(chan struct{})
+	go func() {
+		for _, m := range mounted {
+			if err := m.wait(); err != nil {
+				log.Printf("%s: cannot serve filesystem: %v", m.mountpoint, err)
+			}
+		}
+		close(allDone)
+	}()
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				infof("Received %v; reloading configuration", sig)
+				sdNotify("RELOADING=1")
+				if accessLog != nil {
+					if err := accessLog.reopen(); err != nil {
+						log.Printf("Cannot reopen access log: %v", err)
+					}
+				}
+				if err := reloader.reload(); err != nil {
+					log.Printf("Cannot reload configuration: %v", err)
+				}
+				sdNotify("READY=1")
+				continue
+			}
+			infof("Received %v; unmounting", sig)
+			sdNotify("STOPPING=1")
+			unmountAll(mounted, *shutdownTimeoutFlag)
+		case <-allDone:
+		}
+		return
 	}
 }
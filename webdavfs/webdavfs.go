@@ -0,0 +1,237 @@
+// Package webdavfs serves the chunked view of package split over WebDAV,
+// for backup tools that only speak WebDAV, with golang.org/x/net/webdav. It
+// is built on the io/fs view of the filesystem, split.IOFS, so it serves the
+// same tree as the mountpoint.
+package webdavfs
+
+import (
+	"io"
+	iofs "io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"syscall"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"perot.me/splitfs/split"
+)
+
+// pathError converts an error returned by split.IOFS into an *os.PathError
+// for the given WebDAV name, whose underlying error is an errno.
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: split.Errno(err)}
+}
+
+// fileSystem presents a filesystem to the WebDAV server, read-only. WebDAV
+// has no notion of symlinks or special files, so those are left out;
+// symlinks show up as their target with the follow symlink policy.
+type fileSystem struct {
+	view *split.IOFS
+}
+
+var _ webdav.FileSystem = (*fileSystem)(nil)
+
+func (w *fileSystem) stat(name string) (*fileInfo, error) {
+	viewName := split.CleanPath(name)
+	info, err := w.view.Lstat(viewName)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil, pathError("stat", name, syscall.ENOENT)
+	}
+	return &fileInfo{FileInfo: info, name: viewName}, nil
+}
+
+func (w *fileSystem) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	return w.stat(name)
+}
+
+func (w *fileSystem) OpenFile(_ context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, pathError("open", name, syscall.EROFS)
+	}
+	info, err := w.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &file{view: w.view, info: info}
+	if info.IsDir() {
+		return f, nil
+	}
+	opened, err := w.view.Open(info.name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	f.reader = opened.(readSeekCloser)
+	return f, nil
+}
+
+func (w *fileSystem) Mkdir(_ context.Context, name string, _ os.FileMode) error {
+	return pathError("mkdir", name, syscall.EROFS)
+}
+
+func (w *fileSystem) RemoveAll(_ context.Context, name string) error {
+	return pathError("remove", name, syscall.EROFS)
+}
+
+func (w *fileSystem) Rename(_ context.Context, oldName, _ string) error {
+	return pathError("rename", oldName, syscall.EROFS)
+}
+
+// fileInfo describes a node to the WebDAV server.
+type fileInfo struct {
+	iofs.FileInfo
+	// name is the name of the node in the view.
+	name string
+}
+
+var _ webdav.ETager = (*fileInfo)(nil)
+var _ webdav.ContentTyper = (*fileInfo)(nil)
+
+func (i *fileInfo) ETag(context.Context) (string, error) {
+	return i.Sys().(*split.Attr).ETag(), nil
+}
+
+// ContentType returns the content type of the node from its extension, so
+// that listing directories does not read from every file.
+func (i *fileInfo) ContentType(context.Context) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(i.Name())); contentType != "" {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// readSeekCloser is a regular file opened through split.IOFS.
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// file is a node opened by the WebDAV server: a directory to list, or a
+// regular file to read.
+type file struct {
+	view *split.IOFS
+	info *fileInfo
+	// reader reads regular files. It is nil for directories.
+	reader readSeekCloser
+	// entries are the entries of directories that were not returned by
+	// Readdir yet, once it was called.
+	entries []os.FileInfo
+	listed  bool
+}
+
+var _ webdav.File = (*file)(nil)
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	if f.reader != nil {
+		return nil, pathError("readdir", f.info.Name(), syscall.ENOTDIR)
+	}
+	if !f.listed {
+		dirEntries, err := f.view.ReadDir(f.info.name)
+		if err != nil {
+			return nil, pathError("readdir", f.info.Name(), err)
+		}
+		for _, dirEntry := range dirEntries {
+			// Entries that disappear while the directory is read are left
+			// out.
+			info, err := dirEntry.Info()
+			if err != nil {
+				continue
+			}
+			if info.IsDir() || info.Mode().IsRegular() {
+				f.entries = append(f.entries, &fileInfo{FileInfo: info, name: path.Join(f.info.name, info.Name())})
+			}
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, pathError("read", f.info.Name(), syscall.EISDIR)
+	}
+	return f.reader.Read(p)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.reader == nil {
+		return 0, nil
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *file) Write([]byte) (int, error) {
+	return 0, pathError("write", f.info.Name(), syscall.EROFS)
+}
+
+func (f *file) Close() error {
+	if f.reader == nil {
+		return nil
+	}
+	return f.reader.Close()
+}
+
+// handler serves a filesystem over WebDAV, read-only.
+type handler struct {
+	handler *webdav.Handler
+}
+
+// Handler returns a handler that serves the given view over WebDAV,
+// read-only. It supports OPTIONS, PROPFIND with a depth of 0 or 1, and GET
+// and HEAD requests with ranges and conditional requests; other methods are
+// not allowed. Listing a whole tree at once with a depth of infinity is
+// refused, as chunked trees are huge.
+func Handler(view *split.IOFS) http.Handler {
+	return &handler{&webdav.Handler{
+		FileSystem: &fileSystem{view: view},
+		LockSystem: webdav.NewMemLS(),
+	}}
+}
+
+// methods are the methods allowed on the read-only WebDAV server.
+const methods = "OPTIONS, GET, HEAD, PROPFIND"
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		// Only advertise class 1 compliance, without locks.
+		w.Header().Set("Allow", methods)
+		w.Header().Set("DAV", "1")
+		w.Header().Set("MS-Author-Via", "DAV")
+	case http.MethodGet, http.MethodHead:
+		h.handler.ServeHTTP(w, r)
+	case "PROPFIND":
+		if depth := r.Header.Get("Depth"); depth != "0" && depth != "1" {
+			// A missing Depth header means infinity.
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`+"\n")
+			return
+		}
+		h.handler.ServeHTTP(w, r)
+	default:
+		w.Header().Set("Allow", methods)
+		http.Error(w, "read-only filesystem", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,138 @@
+package webdavfs
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"perot.me/splitfs/split"
+)
+
+// webdavMultistatus is the body of PROPFIND responses.
+type webdavMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+func webdavSource(t *testing.T) http.Handler {
+	t.Helper()
+	source := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"file.txt": "0123456789", "dir/a.txt": "a", "dir/sub/b.txt": "b"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("file.txt", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := split.NewFS(source, 4, split.ExcludeRegexp(`\.txt$`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Handler(f.IOFS())
+}
+
+// serveWebDAV sends a request with the given method, path and headers.
+func serveWebDAV(h http.Handler, method, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestWebDAVPropfind(t *testing.T) {
+	h := webdavSource(t)
+	for _, test := range []struct {
+		target, depth string
+		want          []string
+	}{
+		{"/", "0", []string{"/"}},
+		{"/", "1", []string{"/", "/dir/", "/file.txt"}},
+		{"/dir/", "1", []string{"/dir/", "/dir/a.txt", "/dir/sub/"}},
+		{"/file.txt", "0", []string{"/file.txt"}},
+		{"/file.txt", "1", []string{"/file.txt"}},
+	} {
+		w := serveWebDAV(h, "PROPFIND", test.target, map[string]string{"Depth": test.depth})
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("PROPFIND %s at depth %s: status %d: %s", test.target, test.depth, w.Code, w.Body)
+			continue
+		}
+		multistatus := &webdavMultistatus{}
+		if err := xml.Unmarshal(w.Body.Bytes(), multistatus); err != nil {
+			t.Errorf("PROPFIND %s at depth %s: %v", test.target, test.depth, err)
+			continue
+		}
+		var hrefs []string
+		for _, response := range multistatus.Responses {
+			hrefs = append(hrefs, response.Href)
+		}
+		sort.Strings(hrefs)
+		if strings.Join(hrefs, " ") != strings.Join(test.want, " ") {
+			t.Errorf("PROPFIND %s at depth %s listed %q, want %q", test.target, test.depth, hrefs, test.want)
+		}
+	}
+	for _, depth := range []string{"infinity", ""} {
+		w := serveWebDAV(h, "PROPFIND", "/", map[string]string{"Depth": depth})
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "propfind-finite-depth") {
+			t.Errorf("PROPFIND at depth %q: status %d: %s", depth, w.Code, w.Body)
+		}
+	}
+	if w := serveWebDAV(h, "PROPFIND", "/link", map[string]string{"Depth": "0"}); w.Code != http.StatusNotFound {
+		t.Errorf("PROPFIND of a symlink: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestWebDAVGet(t *testing.T) {
+	h := webdavSource(t)
+	w := serveWebDAV(h, http.MethodGet, "/file.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("GET: status %d, body %q", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Errorf("GET: no ETag")
+	}
+	w = serveWebDAV(h, http.MethodGet, "/file.txt", map[string]string{"Range": "bytes=2-5"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("GET with a range: status %d, Content-Range %q, body %q", w.Code, w.Header().Get("Content-Range"), w.Body)
+	}
+	w = serveWebDAV(h, http.MethodGet, "/file.txt", map[string]string{"Range": "bytes=-3"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "789" {
+		t.Errorf("GET with a suffix range: status %d, body %q", w.Code, w.Body)
+	}
+	if w := serveWebDAV(h, http.MethodGet, "/file.txt", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("conditional GET: status %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if w := serveWebDAV(h, http.MethodHead, "/file.txt", nil); w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "10" {
+		t.Errorf("HEAD: status %d, Content-Length %q, body %q", w.Code, w.Header().Get("Content-Length"), w.Body)
+	}
+	if w := serveWebDAV(h, http.MethodGet, "/missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing file: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestWebDAVRefusedMethods(t *testing.T) {
+	h := webdavSource(t)
+	w := serveWebDAV(h, http.MethodOptions, "/", nil)
+	if w.Code != http.StatusOK || w.Header().Get("DAV") != "1" || w.Header().Get("Allow") != methods {
+		t.Errorf("OPTIONS: status %d, DAV %q, Allow %q", w.Code, w.Header().Get("DAV"), w.Header().Get("Allow"))
+	}
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPost, "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "PROPPATCH"} {
+		w := serveWebDAV(h, method, "/file.txt", map[string]string{"Destination": "/copy.txt"})
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != methods {
+			t.Errorf("%s: status %d, Allow %q", method, w.Code, w.Header().Get("Allow"))
+		}
+	}
+}